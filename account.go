@@ -0,0 +1,312 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/sessions"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// How long the link confirming a new email address can be used
+const ChangeEmailExpires = 48 * time.Hour
+
+// How long after logging in with single sign-on an user without a password
+// can make the changes that ask for it
+const ReauthenticateWindow = 5 * time.Minute
+
+// ErrInvalidToken is returned for unknown, used or expired tokens
+var ErrInvalidToken = errors.New("the link is not valid or has expired")
+
+// ErrEmailTaken is returned when another user has the email address
+var ErrEmailTaken = errors.New("the email address belongs to another user")
+
+var (
+	usernameRegexp = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,40}$`)
+	emailRegexp    = regexp.MustCompile(`^[a-zA-Z0-9._%+-]+@([a-zA-Z0-9-]+\.)+[A-Za-z]{2,6}$`)
+)
+
+// Profile for JSON schema, the account of the logged in user
+type Profile struct {
+	ID            string `json:"id"`
+	Username      string `json:"username"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	TwoFactor     bool   `json:"two_factor"`
+	Directory     bool   `json:"directory"`
+	SingleSignOn  bool   `json:"single_sign_on"`
+	Admin         bool   `json:"admin"`
+}
+
+// NewProfile returns the profile of an user
+func NewProfile(user *User) Profile {
+	return Profile{
+		ID:            user.ID,
+		Username:      user.Username,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		TwoFactor:     user.TOTPEnabled,
+		Directory:     user.LDAPDN != "",
+		SingleSignOn:  user.OIDCSubject != "",
+		Admin:         user.Admin,
+	}
+}
+
+// CurrentUser returns the logged in user, or nil if it cannot be found
+func CurrentUser(cs *sessions.CookieStore, req *http.Request, connection *Connection) *User {
+	userID := SessionUserID(cs, req, connection)
+
+	user, err := connection.GetUser(userID)
+	if err != nil {
+		return nil
+	}
+	return user
+}
+
+// ChangeUsername renames an user if the new username is free. Directory
+// users keep the username of the directory.
+func ChangeUsername(connection *Connection, directory *LDAPDirectory, user *User, username string) *APIError {
+	username = strings.TrimSpace(username)
+
+	if directory != nil {
+		return NewAPIError(400, APIErrBadRequest, "Your username is managed by the directory.")
+	}
+	if !usernameRegexp.MatchString(username) {
+		return NewAPIError(400, APIErrBadRequest, "Usernames have up to 40 letters, numbers, dots, dashes or underscores.")
+	}
+	if username == user.Username {
+		return nil
+	}
+
+	existing, err := connection.GetUserByUsername(username)
+	if err != nil {
+		return NewAPIError(500, APIErrInternal, "Error changing the username.")
+	}
+	if existing != nil {
+		return NewAPIError(409, APIErrTaken, "Username taken.")
+	}
+
+	if _, err := connection.updateUser(user.ID, map[string]interface{}{"Username": username}); err != nil {
+		return NewAPIError(500, APIErrInternal, "Error changing the username.")
+	}
+
+	user.Username = username
+	return nil
+}
+
+// SSOOnly tells if an user has no password and logs in with single sign-on
+func SSOOnly(directory *LDAPDirectory, user *User) bool {
+	return directory == nil && user.Password == "" && user.OIDCSubject != ""
+}
+
+// reauthenticate checks the password before a sensitive change. Users with
+// no password instead need a session started by a recent single sign-on.
+// Wrong passwords are throttled and lock the username as failed logins do,
+// so a stolen session can't be used to guess the password.
+func reauthenticate(connection *Connection, cfg *Config, directory *LDAPDirectory, throttle *LoginThrottle, user *User, session *Session, password, message string) *APIError {
+	if SSOOnly(directory, user) {
+		if session == nil || time.Since(time.Unix(session.Created, 0)) > ReauthenticateWindow {
+			return NewAPIError(403, APIErrForbidden, "Log in again with single sign-on to confirm the change.")
+		}
+		return nil
+	}
+
+	userKey := UserThrottleKey("login", user.Username)
+	if wait := throttle.Wait(userKey); wait > 0 {
+		return NewAPIError(429, APIErrThrottled, fmt.Sprintf("Too many failed attempts, try again in %d seconds.", int64(math.Ceil(wait.Seconds()))))
+	}
+
+	if !CheckPassword(cfg, directory, user, password) {
+		if throttle.Fail(userKey, cfg.LockoutFailures) {
+			Audit(connection, AuditLoginLockout, user.Username, "", "too many wrong passwords confirming account changes")
+		}
+		return NewAPIError(403, APIErrForbidden, message)
+	}
+
+	throttle.Reset(userKey)
+	return nil
+}
+
+// ChangePassword sets a new password after checking the current one, which
+// closes every session of the user. Users without a password set their
+// first one after a recent single sign-on.
+func ChangePassword(connection *Connection, cfg *Config, directory *LDAPDirectory, throttle *LoginThrottle, user *User, session *Session, current, password string) *APIError {
+	if directory != nil {
+		return NewAPIError(400, APIErrBadRequest, "Your password is managed by the directory.")
+	}
+	if len(password) == 0 {
+		return NewAPIError(400, APIErrBadRequest, "The new password cannot be empty.")
+	}
+	if err := reauthenticate(connection, cfg, directory, throttle, user, session, current, "The current password is wrong."); err != nil {
+		return err
+	}
+
+	if _, err := connection.SetPassword(user.ID, cryptPassword(password, cfg.PasswordKey())); err != nil {
+		return NewAPIError(500, APIErrInternal, "Error changing the password.")
+	}
+
+	return nil
+}
+
+// RequestEmailChange emails a confirmation link to the new address. The
+// email only changes once the link is opened, and the old address is told
+// about the request.
+func RequestEmailChange(connection *Connection, cfg *Config, directory *LDAPDirectory, throttle *LoginThrottle, mailer *Mailer, user *User, session *Session, password, email string) *APIError {
+	email = strings.TrimSpace(email)
+
+	if !emailRegexp.MatchString(email) {
+		return NewAPIError(400, APIErrBadRequest, "Invalid email address.")
+	}
+	if err := reauthenticate(connection, cfg, directory, throttle, user, session, password, "The password is wrong."); err != nil {
+		return err
+	}
+	if strings.EqualFold(email, user.Email) {
+		return NewAPIError(400, APIErrBadRequest, "That is already your email address.")
+	}
+
+	existing, err := connection.GetUserByEmail(email)
+	if err != nil {
+		return NewAPIError(500, APIErrInternal, "Error changing the email address.")
+	}
+	if existing != nil {
+		return NewAPIError(409, APIErrTaken, "Email taken.")
+	}
+
+	secret, token := NewToken(TokenChangeEmail, user.ID, email, ChangeEmailExpires)
+	if _, err := connection.NewToken(token); err != nil {
+		return NewAPIError(500, APIErrInternal, "Error changing the email address.")
+	}
+
+	mailer.SendTemplate(email, "Confirm your new Magnet email address", "email_change", map[string]interface{}{
+		"username": user.Username,
+		"token":    secret,
+	})
+	if user.Email != "" {
+		mailer.Send(user.Email, "Your Magnet email address is changing",
+			fmt.Sprintf("Hi %s,\n\nSomeone asked to change the email address of your Magnet account to %s. If it was not you, change your password.\n", user.Username, email))
+	}
+
+	return nil
+}
+
+// ConfirmEmailChange switches an user to the address a change token was
+// sent to, as long as nobody took it in the meantime
+func ConfirmEmailChange(connection *Connection, secret string) error {
+	token, err := connection.UseToken(TokenChangeEmail, secret)
+	if err != nil {
+		return err
+	}
+	if token == nil {
+		return ErrInvalidToken
+	}
+
+	existing, err := connection.GetUserByEmail(token.Email)
+	if err != nil {
+		return err
+	}
+	if existing != nil && existing.ID != token.User {
+		return ErrEmailTaken
+	}
+
+	_, err = connection.updateUser(token.User, map[string]interface{}{"Email": token.Email, "EmailVerified": true})
+	return err
+}
+
+// DeleteAccount deletes an user with all of their data after checking their
+// password, or a recent single sign-on. The last administrator cannot leave.
+func DeleteAccount(connection *Connection, cfg *Config, directory *LDAPDirectory, throttle *LoginThrottle, user *User, session *Session, password string) *APIError {
+	if err := reauthenticate(connection, cfg, directory, throttle, user, session, password, "The password is wrong."); err != nil {
+		return err
+	}
+
+	if user.Admin {
+		stats, err := connection.GetInstanceStats()
+		if err != nil {
+			return NewAPIError(500, APIErrInternal, "Error deleting the account.")
+		}
+		if stats.Admins < 2 {
+			return NewAPIError(403, APIErrForbidden, "You are the only administrator, make someone else one first.")
+		}
+	}
+
+	if _, err := connection.DeleteUser(user.ID); err != nil {
+		return NewAPIError(500, APIErrInternal, "Error deleting the account.")
+	}
+
+	return nil
+}
+
+// ExportFilename returns the name of the export archive of an user
+func ExportFilename(user *User) string {
+	return fmt.Sprintf("magnet-%s-%s.zip", user.Username, time.Now().Format("2006-01-02"))
+}
+
+// WriteExport writes a zip archive with everything an user has: their
+// profile, bookmarks, tags, saved searches and webhooks
+func WriteExport(connection *Connection, user *User, w io.Writer) error {
+	bookmarks, err := connection.ChangedBookmarks(user.ID, 0)
+	if err != nil {
+		return err
+	}
+	sort.Slice(bookmarks, func(i, j int) bool { return bookmarks[i].Created < bookmarks[j].Created })
+
+	tags := CountTags(bookmarkTags(bookmarks))
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+
+	searches, err := connection.GetSavedSearches(user.ID)
+	if err != nil {
+		return err
+	}
+
+	webhooks, err := connection.GetWebhooks(user.ID)
+	if err != nil {
+		return err
+	}
+
+	files := []struct {
+		name    string
+		content interface{}
+	}{
+		{"profile.json", NewProfile(user)},
+		{"bookmarks.json", bookmarks},
+		{"tags.json", tags},
+		{"saved_searches.json", searches},
+		{"webhooks.json", webhooks},
+	}
+
+	archive := zip.NewWriter(w)
+	for _, file := range files {
+		f, err := archive.Create(file.name)
+		if err != nil {
+			return err
+		}
+
+		encoder := json.NewEncoder(f)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(file.content); err != nil {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
+
+// bookmarkTags puts the tags of bookmarks in the shape CountTags takes
+func bookmarkTags(bookmarks []Bookmark) []interface{} {
+	response := make([]interface{}, len(bookmarks))
+	for i, bookmark := range bookmarks {
+		tags := make([]interface{}, len(bookmark.Tags))
+		for j, tag := range bookmark.Tags {
+			tags[j] = tag
+		}
+		response[i] = map[string]interface{}{"Tags": tags}
+	}
+	return response
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReauthenticate(t *testing.T) {
+	cfg := &Config{SecretKey: "secret"}
+	local := &User{Password: cryptPassword("hunter2", cfg.PasswordKey())}
+	sso := &User{OIDCSubject: "https://id.example.com|ana"}
+	recent := &Session{Created: time.Now().Add(-time.Minute).Unix()}
+	old := &Session{Created: time.Now().Add(-ReauthenticateWindow - time.Minute).Unix()}
+
+	tests := []struct {
+		name     string
+		user     *User
+		session  *Session
+		password string
+		ok       bool
+	}{
+		{"password", local, old, "hunter2", true},
+		{"wrong password", local, recent, "wrong", false},
+		{"empty password", local, recent, "", false},
+		{"recent single sign-on", sso, recent, "", true},
+		{"old single sign-on", sso, old, "", false},
+		{"no session", sso, nil, "", false},
+	}
+
+	for _, test := range tests {
+		throttle := NewLoginThrottle(cfg)
+		if err := reauthenticate(nil, cfg, nil, throttle, test.user, test.session, test.password, "wrong"); (err == nil) != test.ok {
+			t.Errorf("%s: error %v", test.name, err)
+		}
+	}
+}
+
+func TestReauthenticateThrottlesWrongPasswords(t *testing.T) {
+	cfg := &Config{SecretKey: "secret", ThrottleDelay: 60, ThrottleMaxDelay: 60, LockoutDuration: 60}
+	user := &User{Username: "ana", Password: cryptPassword("hunter2", cfg.PasswordKey())}
+	throttle := NewLoginThrottle(cfg)
+
+	if err := reauthenticate(nil, cfg, nil, throttle, user, nil, "wrong", "wrong"); err == nil || err.Status != 403 {
+		t.Fatalf("wrong password: %v", err)
+	}
+	if err := reauthenticate(nil, cfg, nil, throttle, user, nil, "hunter2", "wrong"); err == nil || err.Status != 429 {
+		t.Errorf("right password right after a wrong one: %v", err)
+	}
+	if wait := throttle.Wait(UserThrottleKey("login", "ana")); wait <= 0 {
+		t.Error("logins of the username not throttled")
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gorilla/sessions"
+	"log"
+	"net/http"
+)
+
+// UserInfo for JSON schema, an user as shown to administrators
+type UserInfo struct {
+	ID            string `json:"id"`
+	Username      string `json:"username"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Admin         bool   `json:"admin"`
+	Disabled      bool   `json:"disabled"`
+	TwoFactor     bool   `json:"two_factor"`
+	Directory     bool   `json:"directory"`
+	SingleSignOn  bool   `json:"single_sign_on"`
+	Bookmarks     int64  `json:"bookmarks"`
+}
+
+// InstanceStats for JSON schema
+type InstanceStats struct {
+	Users          int64 `json:"users"`
+	DisabledUsers  int64 `json:"disabled_users"`
+	Admins         int64 `json:"admins"`
+	Bookmarks      int64 `json:"bookmarks"`
+	Tags           int64 `json:"tags"`
+	ActiveSessions int64 `json:"active_sessions"`
+	Webhooks       int64 `json:"webhooks"`
+}
+
+// UserInfos converts users along with their number of bookmarks
+func UserInfos(users []User, bookmarks map[string]int64) []UserInfo {
+	infos := make([]UserInfo, len(users))
+
+	for i, user := range users {
+		infos[i] = UserInfo{
+			ID:            user.ID,
+			Username:      user.Username,
+			Email:         user.Email,
+			EmailVerified: user.EmailVerified,
+			Admin:         user.Admin,
+			Disabled:      user.Disabled,
+			TwoFactor:     user.TOTPEnabled,
+			Directory:     user.LDAPDN != "",
+			SingleSignOn:  user.OIDCSubject != "",
+			Bookmarks:     bookmarks[user.ID],
+		}
+	}
+
+	return infos
+}
+
+// CurrentAdmin returns the logged in user if it is an administrator
+func CurrentAdmin(cs *sessions.CookieStore, req *http.Request, connection *Connection, cfg *Config) (*User, bool) {
+	userID := GetUserID(cs, req, connection, cfg)
+	if userID == "" {
+		return nil, false
+	}
+
+	user, err := connection.GetUser(userID)
+	if err != nil || user == nil || !user.Admin || user.Disabled {
+		return nil, false
+	}
+
+	return user, true
+}
+
+// AdminRequired checks the user session belongs to an administrator
+func AdminRequired(cs *sessions.CookieStore, req *http.Request, w http.ResponseWriter, connection *Connection, cfg *Config) {
+	if _, ok := CurrentAdmin(cs, req, connection, cfg); !ok {
+		WriteJSONResponse(403, true, "Administrator access required.", req, w)
+	}
+}
+
+// APIAdminRequired checks the user session belongs to an administrator for
+// API routes
+func APIAdminRequired(cs *sessions.CookieStore, req *http.Request, w http.ResponseWriter, connection *Connection, cfg *Config) {
+	if _, ok := CurrentAdmin(cs, req, connection, cfg); !ok {
+		WriteAPIError(NewAPIError(403, APIErrForbidden, "Administrator access required."), w)
+	}
+}
+
+// MakeAdmin grants administrator access to an user, used to set up the
+// first administrator
+func MakeAdmin(connection *Connection, username string) error {
+	user, err := connection.GetUserByUsername(username)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return fmt.Errorf("user %s not found", username)
+	}
+
+	if _, err := connection.SetUserAdmin(user.ID, true); err != nil {
+		return fmt.Errorf("error granting administrator access: %s", err)
+	}
+
+	log.Printf("%s is now an administrator", username)
+	return nil
+}
+
+// AdminUserChange is a change an administrator makes to an user, nil fields
+// stay as they are
+type AdminUserChange struct {
+	Disabled *bool `json:"disabled"`
+	Admin    *bool `json:"admin"`
+}
+
+// ApplyAdminChange changes an user on behalf of an administrator, who cannot
+// lock themselves out. It returns the updated user or an API error.
+func ApplyAdminChange(connection *Connection, admin *User, userID string, change AdminUserChange) (*User, *APIError) {
+	user, err := connection.GetUser(userID)
+	if err != nil {
+		return nil, NewAPIError(500, APIErrInternal, "Error retrieving user.")
+	}
+	if user == nil {
+		return nil, NewAPIError(404, APIErrNotFound, "User not found.")
+	}
+
+	if user.ID == admin.ID && ((change.Disabled != nil && *change.Disabled) || (change.Admin != nil && !*change.Admin)) {
+		return nil, NewAPIError(400, APIErrBadRequest, "You cannot disable your own account or administrator access.")
+	}
+
+	if change.Disabled != nil {
+		if _, err := connection.SetUserDisabled(user.ID, *change.Disabled); err != nil {
+			return nil, NewAPIError(500, APIErrInternal, "Error updating user.")
+		}
+		user.Disabled = *change.Disabled
+	}
+
+	if change.Admin != nil {
+		if _, err := connection.SetUserAdmin(user.ID, *change.Admin); err != nil {
+			return nil, NewAPIError(500, APIErrInternal, "Error updating user.")
+		}
+		user.Admin = *change.Admin
+	}
+
+	return user, nil
+}
+
+// AdminDeleteUser deletes an user other than the administrator
+func AdminDeleteUser(connection *Connection, admin *User, userID string) *APIError {
+	if userID == admin.ID {
+		return NewAPIError(400, APIErrBadRequest, "You cannot delete your own account.")
+	}
+
+	response, err := connection.DeleteUser(userID)
+	if err != nil {
+		return NewAPIError(500, APIErrInternal, "Error deleting user.")
+	}
+	if response.Deleted < 1 {
+		return NewAPIError(404, APIErrNotFound, "User not found.")
+	}
+
+	return nil
+}
+
+// AdminResetPassword replaces the password of an user with a random one
+// nobody knows, closing their sessions, and emails them a link to choose a
+// new one. The address the link is sent to is returned.
+func AdminResetPassword(connection *Connection, cfg *Config, directory *LDAPDirectory, mailer *Mailer, userID string) (string, *APIError) {
+	if directory != nil {
+		return "", NewAPIError(400, APIErrBadRequest, "Passwords are managed by the directory.")
+	}
+
+	user, err := connection.GetUser(userID)
+	if err != nil {
+		return "", NewAPIError(500, APIErrInternal, "Error retrieving user.")
+	}
+	if user == nil {
+		return "", NewAPIError(404, APIErrNotFound, "User not found.")
+	}
+	if user.Email == "" {
+		return "", NewAPIError(400, APIErrBadRequest, "The user has no email address to send the reset link to.")
+	}
+
+	secret, token := NewToken(TokenResetPassword, user.ID, user.Email, ResetPasswordExpires)
+	if _, err := connection.NewToken(token); err != nil {
+		return "", NewAPIError(500, APIErrInternal, "Error resetting the password.")
+	}
+	if _, err := connection.SetPassword(user.ID, cryptPassword(RandomToken(32), cfg.PasswordKey())); err != nil {
+		return "", NewAPIError(500, APIErrInternal, "Error resetting the password.")
+	}
+
+	mailer.SendTemplate(user.Email, "Reset your Magnet password", "email_reset", map[string]interface{}{
+		"username": user.Username,
+		"token":    secret,
+	})
+
+	return user.Email, nil
+}
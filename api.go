@@ -0,0 +1,971 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/codegangsta/martini"
+	"github.com/gorilla/sessions"
+	"github.com/justinas/nosurf"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// API error codes
+const (
+	APIErrBadRequest   = "bad_request"
+	APIErrValidation   = "validation_failed"
+	APIErrUnauthorized = "unauthorized"
+	APIErrForbidden    = "forbidden"
+	APIErrCsrf         = "csrf_failed"
+	APIErrNotFound     = "not_found"
+	APIErrConflict     = "version_conflict"
+	APIErrTaken        = "already_taken"
+	APIErrThrottled    = "too_many_attempts"
+	APIErrInternal     = "internal_error"
+)
+
+// APIError for JSON schema
+type APIError struct {
+	Status  int               `json:"-"`
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// NewAPIError creates an error without field details
+func NewAPIError(status int, code, message string) *APIError {
+	return &APIError{Status: status, Code: code, Message: message}
+}
+
+// APIPage for JSON schema
+type APIPage struct {
+	Data interface{} `json:"data"`
+	Page int64       `json:"page"`
+	More bool        `json:"more"`
+}
+
+// bookmarkInput holds the bookmark fields sent by an API client. Fields
+// that were not supplied are nil.
+type bookmarkInput struct {
+	Title      *string   `json:"title"`
+	URL        *string   `json:"url"`
+	Tags       *[]string `json:"tags"`
+	AddTags    []string  `json:"add_tags"`
+	RemoveTags []string  `json:"remove_tags"`
+	Unread     *bool     `json:"unread"`
+	Private    *bool     `json:"private"`
+}
+
+// WriteAPIResponse writes data as the JSON body of the response
+func WriteAPIResponse(status int, data interface{}, w http.ResponseWriter) {
+	if data == nil {
+		w.WriteHeader(status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	jsonResp, _ := json.Marshal(data)
+	w.WriteHeader(status)
+	w.Write(jsonResp)
+}
+
+// WriteAPIError writes an error object to the ResponseWriter
+func WriteAPIError(err *APIError, w http.ResponseWriter) {
+	WriteAPIResponse(err.Status, map[string]interface{}{"error": err}, w)
+}
+
+// APIAuthRequired checks user session for API routes
+func APIAuthRequired(cs *sessions.CookieStore, req *http.Request, w http.ResponseWriter, connection *Connection, cfg *Config) {
+	if GetUserID(cs, req, connection, cfg) == "" {
+		WriteAPIError(NewAPIError(401, APIErrUnauthorized, "User is not logged in."), w)
+	} else {
+		RefreshSessionCookie(cs, req, w, cfg)
+	}
+}
+
+// APICSRFTokenHandler writes out the CSRF token that requests changing data
+// must send in the X-CSRF-Token header, setting its cookie if needed. It
+// needs no session so clients can get the token before logging in.
+func APICSRFTokenHandler(req *http.Request, w http.ResponseWriter) {
+	WriteAPIResponse(200, map[string]interface{}{"token": nosurf.Token(req)}, w)
+}
+
+// APIListBookmarksHandler writes out a page of bookmarks, optionally
+// filtered by the q and tag query parameters
+func APIListBookmarksHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection) {
+	userID := SessionUserID(cs, req, connection)
+	query := req.URL.Query()
+
+	page, err := apiPage(query.Get("page"))
+	if err != nil {
+		WriteAPIError(err, w)
+		return
+	}
+
+	search := &SavedSearch{
+		User:  userID,
+		Query: query.Get("q"),
+		Tags:  ParseTags(strings.Join(query["tag"], ",")),
+	}
+
+	bookmarks, dbErr := connection.FilterBookmarks(search, page)
+	if dbErr != nil {
+		WriteAPIError(NewAPIError(500, APIErrInternal, "Error retrieving bookmarks."), w)
+		return
+	}
+
+	writeBookmarksPage(bookmarks, page, w)
+}
+
+// APICreateBookmarkHandler creates a bookmark and writes it out
+func APICreateBookmarkHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection) {
+	input, err := decodeBookmarkInput(req)
+	if err == nil {
+		err = input.validate(true)
+	}
+	if err != nil {
+		WriteAPIError(err, w)
+		return
+	}
+
+	userID := SessionUserID(cs, req, connection)
+	var tags []string
+	if input.Tags != nil {
+		tags = ParseTags(strings.Join(*input.Tags, ","))
+	}
+	bookmark := NewBookmarkDocument(userID, *input.Title, *input.URL, tags)
+	if input.Unread != nil {
+		bookmark["Unread"] = *input.Unread
+	}
+	if input.Private != nil {
+		bookmark["Private"] = *input.Private
+	}
+
+	response, dbErr := connection.NewBookmark(userID, bookmark)
+	if dbErr != nil || response.Inserted < 1 {
+		WriteAPIError(NewAPIError(500, APIErrInternal, "Error inserting bookmark."), w)
+		return
+	}
+
+	created, dbErr := connection.GetBookmark(userID, martini.Params{"bookmark": response.GeneratedKeys[0]})
+	if dbErr != nil || created == nil {
+		WriteAPIError(NewAPIError(500, APIErrInternal, "Error retrieving the new bookmark."), w)
+		return
+	}
+
+	w.Header().Set("Location", "/api/v2/bookmarks/"+created.ID)
+	w.Header().Set("ETag", BookmarkETag(created.Version))
+	WriteAPIResponse(201, created, w)
+}
+
+// APIGetBookmarkHandler writes out a single bookmark
+func APIGetBookmarkHandler(params martini.Params, req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection) {
+	userID := SessionUserID(cs, req, connection)
+
+	bookmark, err := connection.GetBookmark(userID, params)
+	if err != nil {
+		WriteAPIError(NewAPIError(500, APIErrInternal, "Error retrieving bookmark."), w)
+	} else if bookmark == nil {
+		WriteAPIError(NewAPIError(404, APIErrNotFound, "Bookmark not found."), w)
+	} else {
+		w.Header().Set("ETag", BookmarkETag(bookmark.Version))
+		WriteAPIResponse(200, bookmark, w)
+	}
+}
+
+// APIUpdateBookmarkHandler changes the supplied fields of a bookmark and
+// writes out the updated bookmark. With an If-Match header the update only
+// happens if the bookmark is still at that version.
+func APIUpdateBookmarkHandler(params martini.Params, req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection) {
+	input, err := decodeBookmarkInput(req)
+	if err == nil {
+		err = input.validate(false)
+	}
+	if err != nil {
+		WriteAPIError(err, w)
+		return
+	}
+
+	version, ok := ParseIfMatch(req.Header.Get("If-Match"))
+	if !ok {
+		WriteAPIError(NewAPIError(400, APIErrBadRequest, "If-Match is not a bookmark version."), w)
+		return
+	}
+
+	userID := SessionUserID(cs, req, connection)
+	edit := input.edit()
+	edit.Version = version
+
+	response, dbErr := connection.EditBookmark(userID, params, edit)
+	if dbErr == ErrVersionConflict {
+		WriteAPIError(NewAPIError(412, APIErrConflict, "The bookmark was modified since the given version."), w)
+		return
+	}
+	if dbErr != nil {
+		WriteAPIError(NewAPIError(500, APIErrInternal, "Error updating bookmark."), w)
+		return
+	}
+	if !EditFound(response) {
+		WriteAPIError(NewAPIError(404, APIErrNotFound, "Bookmark not found."), w)
+		return
+	}
+
+	APIGetBookmarkHandler(params, req, w, cs, connection)
+}
+
+// APIDeleteBookmarkHandler deletes a bookmark, honoring If-Match
+func APIDeleteBookmarkHandler(params martini.Params, req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection) {
+	userID := SessionUserID(cs, req, connection)
+
+	version, ok := ParseIfMatch(req.Header.Get("If-Match"))
+	if !ok {
+		WriteAPIError(NewAPIError(400, APIErrBadRequest, "If-Match is not a bookmark version."), w)
+		return
+	}
+
+	response, err := connection.DeleteBookmark(userID, params, version)
+	if err == ErrVersionConflict {
+		WriteAPIError(NewAPIError(412, APIErrConflict, "The bookmark was modified since the given version."), w)
+	} else if err != nil {
+		WriteAPIError(NewAPIError(500, APIErrInternal, "Error deleting bookmark."), w)
+	} else if response.Deleted < 1 {
+		WriteAPIError(NewAPIError(404, APIErrNotFound, "Bookmark not found."), w)
+	} else {
+		WriteAPIResponse(204, nil, w)
+	}
+}
+
+// APIListTagsHandler writes out the tags of the user with their counts
+func APIListTagsHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection) {
+	userID := SessionUserID(cs, req, connection)
+
+	response, err := connection.GetTags(userID)
+	if err != nil {
+		WriteAPIError(NewAPIError(500, APIErrInternal, "Error retrieving tags."), w)
+	} else {
+		WriteAPIResponse(200, map[string]interface{}{"data": CountTags(response)}, w)
+	}
+}
+
+// APIListSavedSearchesHandler writes out the saved searches of the user
+func APIListSavedSearchesHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection) {
+	userID := SessionUserID(cs, req, connection)
+
+	searches, err := connection.GetSavedSearches(userID)
+	if err != nil {
+		WriteAPIError(NewAPIError(500, APIErrInternal, "Error retrieving saved searches."), w)
+	} else {
+		WriteAPIResponse(200, map[string]interface{}{"data": searches}, w)
+	}
+}
+
+// APISavedSearchBookmarksHandler writes out a page of the bookmarks
+// matching a saved search
+func APISavedSearchBookmarksHandler(params martini.Params, req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection) {
+	userID := SessionUserID(cs, req, connection)
+
+	page, err := apiPage(req.URL.Query().Get("page"))
+	if err != nil {
+		WriteAPIError(err, w)
+		return
+	}
+
+	search, dbErr := connection.GetSavedSearch(userID, params)
+	if dbErr != nil {
+		WriteAPIError(NewAPIError(500, APIErrInternal, "Error retrieving saved search."), w)
+		return
+	}
+	if search == nil {
+		WriteAPIError(NewAPIError(404, APIErrNotFound, "Saved search not found."), w)
+		return
+	}
+
+	bookmarks, dbErr := connection.FilterBookmarks(search, page)
+	if dbErr != nil {
+		WriteAPIError(NewAPIError(500, APIErrInternal, "Error retrieving bookmarks."), w)
+		return
+	}
+
+	writeBookmarksPage(bookmarks, page, w)
+}
+
+// APIEventsHandler streams the bookmark events of the user as server-sent
+// events until the client goes away or the server shuts down. With a write
+// timeout the stream ends just before it, and the client reconnects.
+func APIEventsHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection, cfg *Config, shutdown Shutdown) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		WriteAPIError(NewAPIError(500, APIErrInternal, "Streaming is not supported."), w)
+		return
+	}
+
+	userID := SessionUserID(cs, req, connection)
+	events, cancel, err := connection.Subscribe(userID)
+	if err != nil {
+		WriteAPIError(NewAPIError(500, APIErrInternal, "Error subscribing to bookmark events."), w)
+		return
+	}
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(200)
+	fmt.Fprint(w, "retry: 5000\n\n")
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(30 * time.Second)
+	defer heartbeat.Stop()
+
+	var deadline <-chan time.Time
+	if cfg.WriteTimeout > 0 {
+		deadline = time.After(time.Duration(cfg.WriteTimeout)*time.Second - time.Second)
+	}
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			flusher.Flush()
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		case <-deadline:
+			return
+		case <-shutdown:
+			return
+		}
+	}
+}
+
+// APIListWebhooksHandler writes out the webhooks of the user
+func APIListWebhooksHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection) {
+	userID := SessionUserID(cs, req, connection)
+
+	webhooks, err := connection.GetWebhooks(userID)
+	if err != nil {
+		WriteAPIError(NewAPIError(500, APIErrInternal, "Error retrieving webhooks."), w)
+	} else {
+		if webhooks == nil {
+			webhooks = []Webhook{}
+		}
+		WriteAPIResponse(200, map[string]interface{}{"data": webhooks}, w)
+	}
+}
+
+// APICreateWebhookHandler registers a webhook and writes it out along with
+// the secret used to sign its payloads, which is not shown again
+func APICreateWebhookHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection, cfg *Config) {
+	var input struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+		Tag    string   `json:"tag"`
+	}
+
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+			WriteAPIError(NewAPIError(400, APIErrBadRequest, "The request body is not valid JSON."), w)
+			return
+		}
+	} else {
+		input.URL = req.PostFormValue("url")
+		input.Events = ParseTags(req.PostFormValue("events"))
+		input.Tag = req.PostFormValue("tag")
+	}
+
+	userID := SessionUserID(cs, req, connection)
+	webhook := &Webhook{
+		User:    userID,
+		URL:     input.URL,
+		Secret:  RandomToken(32),
+		Events:  ParseTags(strings.Join(input.Events, ",")),
+		Tag:     strings.ToLower(strings.TrimSpace(input.Tag)),
+		Active:  true,
+		Created: float64(time.Now().Unix()),
+	}
+
+	if fields := webhook.Validate(cfg.WebhookAllowPrivate); len(fields) > 0 {
+		WriteAPIError(&APIError{Status: 422, Code: APIErrValidation, Message: "The webhook is not valid.", Fields: fields}, w)
+		return
+	}
+
+	response, err := connection.NewWebhook(webhook)
+	if err != nil || response.Inserted < 1 {
+		WriteAPIError(NewAPIError(500, APIErrInternal, "Error creating webhook."), w)
+		return
+	}
+
+	webhook.ID = response.GeneratedKeys[0]
+	w.Header().Set("Location", "/api/v2/webhooks/"+webhook.ID)
+	WriteAPIResponse(201, struct {
+		*Webhook
+		Secret string `json:"secret"`
+	}{webhook, webhook.Secret}, w)
+}
+
+// APIDeleteWebhookHandler deletes a webhook and its delivery history
+func APIDeleteWebhookHandler(params martini.Params, req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection) {
+	userID := SessionUserID(cs, req, connection)
+
+	response, err := connection.DeleteWebhook(userID, params)
+	if err != nil {
+		WriteAPIError(NewAPIError(500, APIErrInternal, "Error deleting webhook."), w)
+	} else if response.Deleted < 1 {
+		WriteAPIError(NewAPIError(404, APIErrNotFound, "Webhook not found."), w)
+	} else {
+		WriteAPIResponse(204, nil, w)
+	}
+}
+
+// APIWebhookDeliveriesHandler writes out the latest delivery attempts of a
+// webhook, failed ones included
+func APIWebhookDeliveriesHandler(params martini.Params, req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection) {
+	userID := SessionUserID(cs, req, connection)
+
+	webhook, err := connection.GetWebhook(userID, params)
+	if err != nil {
+		WriteAPIError(NewAPIError(500, APIErrInternal, "Error retrieving webhook."), w)
+		return
+	}
+	if webhook == nil {
+		WriteAPIError(NewAPIError(404, APIErrNotFound, "Webhook not found."), w)
+		return
+	}
+
+	deliveries, err := connection.GetWebhookDeliveries(userID, params)
+	if err != nil {
+		WriteAPIError(NewAPIError(500, APIErrInternal, "Error retrieving deliveries."), w)
+		return
+	}
+	if deliveries == nil {
+		deliveries = []WebhookDelivery{}
+	}
+
+	WriteAPIResponse(200, map[string]interface{}{"data": deliveries}, w)
+}
+
+// APIListSessionsHandler writes out the active sessions of the user
+func APIListSessionsHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection) {
+	userID := SessionUserID(cs, req, connection)
+
+	response, err := connection.GetUserSessions(userID)
+	if err != nil {
+		WriteAPIError(NewAPIError(500, APIErrInternal, "Error retrieving sessions."), w)
+	} else {
+		WriteAPIResponse(200, map[string]interface{}{"data": SessionInfos(response, CurrentSessionID(cs, req))}, w)
+	}
+}
+
+// APIRevokeSessionHandler revokes a session of the user, which may be the
+// current one
+func APIRevokeSessionHandler(params martini.Params, req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection) {
+	userID := SessionUserID(cs, req, connection)
+
+	response, err := connection.RevokeSession(userID, params)
+	if err != nil {
+		WriteAPIError(NewAPIError(500, APIErrInternal, "Error revoking session."), w)
+	} else if response.Deleted < 1 {
+		WriteAPIError(NewAPIError(404, APIErrNotFound, "Session not found."), w)
+	} else {
+		WriteAPIResponse(204, nil, w)
+	}
+}
+
+// APIRevokeOtherSessionsHandler revokes every session of the user but the
+// current one
+func APIRevokeOtherSessionsHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection) {
+	userID := SessionUserID(cs, req, connection)
+
+	if _, err := connection.RevokeOtherSessions(userID, CurrentSessionID(cs, req)); err != nil {
+		WriteAPIError(NewAPIError(500, APIErrInternal, "Error revoking sessions."), w)
+	} else {
+		WriteAPIResponse(204, nil, w)
+	}
+}
+
+// APIAccountHandler writes out the profile of the user
+func APIAccountHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection) {
+	user := CurrentUser(cs, req, connection)
+	if user == nil {
+		WriteAPIError(NewAPIError(500, APIErrInternal, "Error retrieving user."), w)
+	} else {
+		WriteAPIResponse(200, NewProfile(user), w)
+	}
+}
+
+// APIUpdateAccountHandler changes the username of the user
+func APIUpdateAccountHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection, directory *LDAPDirectory) {
+	var input struct {
+		Username *string `json:"username"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+		WriteAPIError(NewAPIError(400, APIErrBadRequest, "The body is not valid JSON."), w)
+		return
+	}
+
+	user := CurrentUser(cs, req, connection)
+	if user == nil {
+		WriteAPIError(NewAPIError(500, APIErrInternal, "Error retrieving user."), w)
+		return
+	}
+
+	if input.Username != nil {
+		if err := ChangeUsername(connection, directory, user, *input.Username); err != nil {
+			WriteAPIError(err, w)
+			return
+		}
+	}
+
+	WriteAPIResponse(200, NewProfile(user), w)
+}
+
+// APIChangePasswordHandler changes the password of the user, closing their
+// sessions. A client using a session cookie is given a new session.
+func APIChangePasswordHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, cfg *Config, connection *Connection, directory *LDAPDirectory, throttle *LoginThrottle) {
+	var input struct {
+		CurrentPassword string `json:"current_password"`
+		Password        string `json:"password"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+		WriteAPIError(NewAPIError(400, APIErrBadRequest, "The body is not valid JSON."), w)
+		return
+	}
+
+	user := CurrentUser(cs, req, connection)
+	if user == nil {
+		WriteAPIError(NewAPIError(500, APIErrInternal, "Error retrieving user."), w)
+		return
+	}
+
+	if err := ChangePassword(connection, cfg, directory, throttle, user, CurrentSession(cs, req, connection), input.CurrentPassword, input.Password); err != nil {
+		WriteAPIError(err, w)
+	} else if err := renewSession(user.ID, req, w, cs, cfg, connection); err != nil {
+		WriteAPIError(NewAPIError(500, APIErrInternal, "Error creating the user session."), w)
+	} else {
+		WriteAPIResponse(204, nil, w)
+	}
+}
+
+// APIChangeEmailHandler sends a confirmation link to a new email address
+func APIChangeEmailHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, cfg *Config, connection *Connection, directory *LDAPDirectory, throttle *LoginThrottle, mailer *Mailer) {
+	var input struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+		WriteAPIError(NewAPIError(400, APIErrBadRequest, "The body is not valid JSON."), w)
+		return
+	}
+
+	user := CurrentUser(cs, req, connection)
+	if user == nil {
+		WriteAPIError(NewAPIError(500, APIErrInternal, "Error retrieving user."), w)
+		return
+	}
+
+	if err := RequestEmailChange(connection, cfg, directory, throttle, mailer, user, CurrentSession(cs, req, connection), input.Password, input.Email); err != nil {
+		WriteAPIError(err, w)
+	} else {
+		WriteAPIResponse(202, nil, w)
+	}
+}
+
+// APIExportHandler sends a zip archive with everything the user has
+func APIExportHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection, logger *Logger) {
+	user := CurrentUser(cs, req, connection)
+	if user == nil {
+		WriteAPIError(NewAPIError(500, APIErrInternal, "Error retrieving user."), w)
+		return
+	}
+
+	var archive bytes.Buffer
+	if err := WriteExport(connection, user, &archive); err != nil {
+		logger.Error("export failed", "username", user.Username, "err", err)
+		WriteAPIError(NewAPIError(500, APIErrInternal, "Error exporting data."), w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+ExportFilename(user)+"\"")
+	w.Write(archive.Bytes())
+}
+
+// APIDeleteAccountHandler deletes the user with all of their data
+func APIDeleteAccountHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, cfg *Config, connection *Connection, directory *LDAPDirectory, throttle *LoginThrottle) {
+	var input struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+		WriteAPIError(NewAPIError(400, APIErrBadRequest, "The body is not valid JSON."), w)
+		return
+	}
+
+	user := CurrentUser(cs, req, connection)
+	if user == nil {
+		WriteAPIError(NewAPIError(500, APIErrInternal, "Error retrieving user."), w)
+		return
+	}
+
+	if err := DeleteAccount(connection, cfg, directory, throttle, user, CurrentSession(cs, req, connection), input.Password); err != nil {
+		WriteAPIError(err, w)
+	} else {
+		WriteAPIResponse(204, nil, w)
+	}
+}
+
+// APIListInvitesHandler writes out the unexpired invite codes of the user
+func APIListInvitesHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection) {
+	userID := SessionUserID(cs, req, connection)
+
+	tokens, err := connection.GetUserInvites(userID)
+	if err != nil {
+		WriteAPIError(NewAPIError(500, APIErrInternal, "Error retrieving invites."), w)
+	} else {
+		WriteAPIResponse(200, map[string]interface{}{"data": Invites(tokens)}, w)
+	}
+}
+
+// APINewInviteHandler creates an invite code, only shown in this response
+func APINewInviteHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection, registration *Registration) {
+	userID := SessionUserID(cs, req, connection)
+
+	user, err := connection.GetUser(userID)
+	if err != nil || user == nil {
+		WriteAPIError(NewAPIError(500, APIErrInternal, "Error retrieving user."), w)
+		return
+	}
+
+	invite, apiErr := CreateInvite(connection, registration, user)
+	if apiErr != nil {
+		WriteAPIError(apiErr, w)
+	} else {
+		WriteAPIResponse(201, invite, w)
+	}
+}
+
+// APIDeleteInviteHandler revokes an invite code of the user
+func APIDeleteInviteHandler(params martini.Params, req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection) {
+	userID := SessionUserID(cs, req, connection)
+
+	response, err := connection.DeleteInvite(userID, params["invite"])
+	if err != nil {
+		WriteAPIError(NewAPIError(500, APIErrInternal, "Error revoking invite."), w)
+	} else if response.Deleted < 1 {
+		WriteAPIError(NewAPIError(404, APIErrNotFound, "Invite not found."), w)
+	} else {
+		WriteAPIResponse(204, nil, w)
+	}
+}
+
+// APIAdminStatsHandler writes out instance wide counts
+func APIAdminStatsHandler(w http.ResponseWriter, connection *Connection) {
+	stats, err := connection.GetInstanceStats()
+	if err != nil {
+		WriteAPIError(NewAPIError(500, APIErrInternal, "Error retrieving stats."), w)
+	} else {
+		WriteAPIResponse(200, stats, w)
+	}
+}
+
+// APIAdminListUsersHandler writes out every user
+func APIAdminListUsersHandler(w http.ResponseWriter, connection *Connection) {
+	users, err := connection.GetUsers()
+	if err != nil {
+		WriteAPIError(NewAPIError(500, APIErrInternal, "Error retrieving users."), w)
+		return
+	}
+
+	bookmarks, _ := connection.CountUserBookmarks()
+	WriteAPIResponse(200, map[string]interface{}{"data": UserInfos(users, bookmarks)}, w)
+}
+
+// APIAdminUpdateUserHandler disables, enables or changes the administrator
+// access of an user
+func APIAdminUpdateUserHandler(params martini.Params, req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, cfg *Config, connection *Connection) {
+	var change AdminUserChange
+	if err := json.NewDecoder(req.Body).Decode(&change); err != nil {
+		WriteAPIError(NewAPIError(400, APIErrBadRequest, "The body is not valid JSON."), w)
+		return
+	}
+
+	admin, _ := CurrentAdmin(cs, req, connection, cfg)
+	user, err := ApplyAdminChange(connection, admin, params["user"], change)
+	if err != nil {
+		WriteAPIError(err, w)
+		return
+	}
+
+	bookmarks, _ := connection.CountUserBookmarks()
+	WriteAPIResponse(200, UserInfos([]User{*user}, bookmarks)[0], w)
+}
+
+// APIAdminDeleteUserHandler deletes an user with their bookmarks and
+// sessions
+func APIAdminDeleteUserHandler(params martini.Params, req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, cfg *Config, connection *Connection) {
+	admin, _ := CurrentAdmin(cs, req, connection, cfg)
+
+	if err := AdminDeleteUser(connection, admin, params["user"]); err != nil {
+		WriteAPIError(err, w)
+	} else {
+		WriteAPIResponse(204, nil, w)
+	}
+}
+
+// APIAdminResetPasswordHandler gives an user a new random password
+func APIAdminResetPasswordHandler(params martini.Params, w http.ResponseWriter, cfg *Config, connection *Connection, directory *LDAPDirectory, mailer *Mailer) {
+	if _, err := AdminResetPassword(connection, cfg, directory, mailer, params["user"]); err != nil {
+		WriteAPIError(err, w)
+	} else {
+		WriteAPIResponse(202, nil, w)
+	}
+}
+
+// APISyncHandler writes out the bookmarks changed and deleted since the
+// sync token, or every bookmark without a token, along with the token for
+// the next sync
+func APISyncHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection) {
+	userID := SessionUserID(cs, req, connection)
+
+	delta, err := syncDelta(connection, userID, req.URL.Query().Get("token"))
+	if err != nil {
+		WriteAPIError(err, w)
+	} else {
+		WriteAPIResponse(200, delta, w)
+	}
+}
+
+// APISyncPushHandler applies a batch of client changes, reporting the
+// result of each one, and writes out the changes since the sync token
+func APISyncPushHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection) {
+	var input struct {
+		Token   string       `json:"token"`
+		Changes []SyncChange `json:"changes"`
+	}
+
+	if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+		WriteAPIError(NewAPIError(400, APIErrBadRequest, "The request body is not valid JSON."), w)
+		return
+	}
+
+	if len(input.Changes) > 500 {
+		WriteAPIError(&APIError{
+			Status:  422,
+			Code:    APIErrValidation,
+			Message: "Too many changes.",
+			Fields:  map[string]string{"changes": "must not have more than 500 changes"},
+		}, w)
+		return
+	}
+
+	if _, _, err := ParseSyncToken(input.Token); err != nil {
+		WriteAPIError(syncTokenError(), w)
+		return
+	}
+
+	userID := SessionUserID(cs, req, connection)
+	results := make([]SyncResult, len(input.Changes))
+	for i, change := range input.Changes {
+		results[i] = ApplySyncChange(connection, userID, change)
+	}
+
+	delta, err := syncDelta(connection, userID, input.Token)
+	if err != nil {
+		WriteAPIError(err, w)
+		return
+	}
+
+	WriteAPIResponse(200, struct {
+		*SyncDelta
+		Results []SyncResult `json:"results"`
+	}{delta, results}, w)
+}
+
+func syncDelta(connection *Connection, userID, token string) (*SyncDelta, *APIError) {
+	since, after, err := ParseSyncToken(token)
+	if err != nil {
+		return nil, syncTokenError()
+	}
+
+	// Read before the bookmarks so nothing written meanwhile is skipped
+	now, err := connection.SyncTime()
+	if err != nil {
+		return nil, NewAPIError(500, APIErrInternal, "Error retrieving bookmarks.")
+	}
+
+	delta := &SyncDelta{Deleted: []Tombstone{}}
+
+	delta.Bookmarks, err = connection.SyncBookmarks(userID, since, after, SyncPageSize+1)
+	if err != nil {
+		return nil, NewAPIError(500, APIErrInternal, "Error retrieving bookmarks.")
+	}
+
+	if len(delta.Bookmarks) > SyncPageSize {
+		delta.Bookmarks = delta.Bookmarks[:SyncPageSize]
+		last := delta.Bookmarks[SyncPageSize-1]
+		delta.Token, delta.More = NewSyncToken(last.Updated, last.ID), true
+	} else {
+		delta.Token = NewSyncToken(now-syncWindow.Seconds(), "")
+	}
+	if delta.Bookmarks == nil {
+		delta.Bookmarks = []Bookmark{}
+	}
+
+	if since > 0 {
+		tombstones, err := connection.GetTombstones(userID, since)
+		if err != nil {
+			return nil, NewAPIError(500, APIErrInternal, "Error retrieving deleted bookmarks.")
+		}
+		if tombstones != nil {
+			delta.Deleted = tombstones
+		}
+	}
+
+	return delta, nil
+}
+
+func syncTokenError() *APIError {
+	return &APIError{
+		Status:  400,
+		Code:    APIErrValidation,
+		Message: "Invalid sync token.",
+		Fields:  map[string]string{"token": "was not issued by this server"},
+	}
+}
+
+func writeBookmarksPage(bookmarks []Bookmark, page int64, w http.ResponseWriter) {
+	if bookmarks == nil {
+		bookmarks = []Bookmark{}
+	}
+
+	WriteAPIResponse(200, APIPage{Data: bookmarks, Page: page, More: len(bookmarks) == 50}, w)
+}
+
+// apiPage parses the page query parameter, which defaults to 0
+func apiPage(value string) (int64, *APIError) {
+	if value == "" {
+		return 0, nil
+	}
+
+	page, err := strconv.ParseInt(value, 10, 16)
+	if err != nil || page < 0 {
+		return 0, &APIError{
+			Status:  400,
+			Code:    APIErrValidation,
+			Message: "Invalid query parameters.",
+			Fields:  map[string]string{"page": "must be a non-negative integer"},
+		}
+	}
+
+	return page, nil
+}
+
+// decodeBookmarkInput reads a bookmark from a JSON or form encoded body
+func decodeBookmarkInput(req *http.Request) (*bookmarkInput, *APIError) {
+	input := new(bookmarkInput)
+
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(req.Body).Decode(input); err != nil {
+			return nil, NewAPIError(400, APIErrBadRequest, "The request body is not valid JSON.")
+		}
+		return input, nil
+	}
+
+	if err := req.ParseForm(); err != nil {
+		return nil, NewAPIError(400, APIErrBadRequest, "The request body could not be parsed.")
+	}
+
+	if _, ok := req.PostForm["title"]; ok {
+		title := req.PostFormValue("title")
+		input.Title = &title
+	}
+	if _, ok := req.PostForm["url"]; ok {
+		url := req.PostFormValue("url")
+		input.URL = &url
+	}
+	if _, ok := req.PostForm["tags"]; ok {
+		tags := ParseTags(req.PostFormValue("tags"))
+		input.Tags = &tags
+	}
+	input.AddTags = ParseTags(req.PostFormValue("add_tags"))
+	input.RemoveTags = ParseTags(req.PostFormValue("remove_tags"))
+	if _, ok := req.PostForm["unread"]; ok {
+		unread := req.PostFormValue("unread") == "true"
+		input.Unread = &unread
+	}
+	if _, ok := req.PostForm["private"]; ok {
+		private := req.PostFormValue("private") == "true"
+		input.Private = &private
+	}
+
+	return input, nil
+}
+
+// edit builds the partial update described by the supplied fields
+func (in *bookmarkInput) edit() *BookmarkEdit {
+	edit := &BookmarkEdit{
+		Fields:     make(map[string]interface{}),
+		AddTags:    ParseTags(strings.Join(in.AddTags, ",")),
+		RemoveTags: ParseTags(strings.Join(in.RemoveTags, ",")),
+		Version:    AnyVersion,
+	}
+
+	if in.Title != nil {
+		edit.Fields["Title"] = *in.Title
+	}
+	if in.URL != nil {
+		edit.Fields["URL"] = *in.URL
+	}
+	if in.Tags != nil {
+		edit.Fields["Tags"] = ParseTags(strings.Join(*in.Tags, ","))
+	}
+	if in.Unread != nil {
+		edit.Fields["Unread"] = *in.Unread
+	}
+	if in.Private != nil {
+		edit.Fields["Private"] = *in.Private
+	}
+
+	return edit
+}
+
+// validate checks the supplied fields. On creation title and url are
+// required.
+func (in *bookmarkInput) validate(create bool) *APIError {
+	fields := make(map[string]string)
+
+	if in.Title == nil && create {
+		fields["title"] = "is required"
+	} else if in.Title != nil && len(*in.Title) < 1 {
+		fields["title"] = "must not be empty"
+	}
+
+	if in.URL == nil && create {
+		fields["url"] = "is required"
+	} else if in.URL != nil && !IsValidURL(*in.URL) {
+		fields["url"] = "must be an absolute URL"
+	}
+
+	if len(fields) > 0 {
+		return &APIError{
+			Status:  422,
+			Code:    APIErrValidation,
+			Message: "The bookmark is not valid.",
+			Fields:  fields,
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"time"
+)
+
+// Audit events
+const (
+	AuditLoginLockout  = "login_lockout"
+	AuditSignupLockout = "signup_lockout"
+)
+
+// AuditEntry for JSON schema, a security relevant event
+type AuditEntry struct {
+	ID       string `gorethink:"id,omitempty" json:"id"`
+	Event    string
+	User     string
+	Username string
+	IP       string
+	Details  string
+	Created  float64
+}
+
+// Audit stores an audit entry, linked to the user if the username exists
+func Audit(connection *Connection, event, username, ip, details string) {
+	entry := &AuditEntry{
+		Event:    event,
+		Username: username,
+		IP:       ip,
+		Details:  details,
+		Created:  float64(time.Now().Unix()),
+	}
+
+	if username != "" {
+		if user, err := connection.GetUserByUsername(username); err == nil && user != nil {
+			entry.User = user.ID
+		}
+	}
+
+	connection.logger.Info("audit", "event", event, "username", username, "ip", ip, "details", details)
+	connection.NewAuditEntry(entry)
+}
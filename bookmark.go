@@ -1,5 +1,19 @@
 package main
 
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AnyVersion disables the version check of an edit or delete
+const AnyVersion int64 = -1
+
+// ErrVersionConflict is returned when a bookmark changed since the version
+// the client based its changes on
+var ErrVersionConflict = errors.New("bookmark version conflict")
+
 // Bookmark for JSON schema
 type Bookmark struct {
 	ID      string `json:"id"`
@@ -9,19 +23,76 @@ type Bookmark struct {
 	Created float64
 	User    string
 	Date    string
+	Unread  bool
+	Private bool
+	Updated float64
+	Version int64
+}
+
+// BookmarkEdit describes a partial update of a bookmark. Only the keys
+// present in Fields change, tags in AddTags and RemoveTags are added to or
+// removed from the resulting tags and Version is the version the changes
+// are based on, or AnyVersion.
+type BookmarkEdit struct {
+	Fields     map[string]interface{}
+	AddTags    []string
+	RemoveTags []string
+	Version    int64
 }
 
 // GetBookmarks fetches bookmarks from rethinkdb
-func GetBookmarks(page int64, connection *Connection, userID string) []Bookmark {
+func GetBookmarks(page int64, connection *Connection, userID string) ([]Bookmark, error) {
 	bookmarks, err := connection.GetBookmarks(userID, page)
+	if err != nil {
+		return nil, err
+	}
 
-	if err == nil {
-		for i := range bookmarks {
-			if len(bookmarks[i].Tags) < 1 {
-				bookmarks[i].Tags = []string{"No tags"}
-			}
+	for i := range bookmarks {
+		if len(bookmarks[i].Tags) < 1 {
+			bookmarks[i].Tags = []string{"No tags"}
 		}
 	}
 
-	return bookmarks
+	return bookmarks, nil
+}
+
+// NewBookmarkDocument builds the document stored for a new bookmark.
+// We use a map instead of Bookmark because id would be ""
+func NewBookmarkDocument(userID, title, url string, tags []string) map[string]interface{} {
+	bookmark := make(map[string]interface{})
+	bookmark["Title"] = title
+	bookmark["URL"] = url
+	if len(tags) > 0 {
+		bookmark["Tags"] = tags
+	}
+	bookmark["Unread"] = false
+	bookmark["Private"] = false
+	bookmark["Created"] = float64(time.Now().Unix())
+	bookmark["Date"] = time.Unix(int64(bookmark["Created"].(float64)), 0).Format("Jan 2, 2006 at 3:04pm")
+	bookmark["User"] = userID
+	bookmark["Version"] = 1
+	return bookmark
+}
+
+// BookmarkETag returns the entity tag of a bookmark version
+func BookmarkETag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// ParseIfMatch returns the version required by an If-Match header. A
+// missing header or * match any version. ok is false when the header does
+// not hold a bookmark entity tag.
+func ParseIfMatch(header string) (version int64, ok bool) {
+	header = strings.TrimSpace(header)
+	if header == "" || header == "*" {
+		return AnyVersion, true
+	}
+
+	tag := strings.Trim(strings.TrimPrefix(header, "W/"), `"`)
+	version, err := strconv.ParseInt(tag, 10, 64)
+	if err != nil || version < 0 {
+		return 0, false
+	}
+
+	return version, true
 }
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// command is a subcommand of the magnet CLI
+type command struct {
+	name string
+	args string
+	help string
+	run  func(args []string) error
+}
+
+func commands() []command {
+	return []command{
+		{"serve", "", "start the web server, the default", serveCommand},
+		{"migrate", "", "apply pending schema migrations", migrateCommand},
+		{"create-user", "-username NAME -email EMAIL [-password PASSWORD] [-admin]", "create an user, with a random password if none is given", createUserCommand},
+		{"reset-password", "-username NAME [-password PASSWORD]", "set the password of an user and close their sessions", resetPasswordCommand},
+		{"disable-2fa", "-username NAME", "turn off two-factor authentication for a locked out user", disableTwoFactorCommand},
+		{"make-admin", "-username NAME", "grant administrator access to an user", makeAdminCommand},
+		{"import", "-username NAME FILE", "import bookmarks from a browser export (.html), bookmarks.json or a Magnet export (.zip)", importCommand},
+		{"export", "-username NAME [-output FILE]", "write the export archive of an user", exportCommand},
+		{"wipe-sessions", "[-username NAME] [-expired]", "log out every user, one user or only delete expired sessions", wipeSessionsCommand},
+		{"reindex", "", "rebuild the secondary indexes", reindexCommand},
+		{"config", "", "print the effective config, secrets masked", configCommand},
+	}
+}
+
+// RunCLI runs the subcommand named by the first argument, serving when
+// there is none so plain flags keep working
+func RunCLI(args []string) error {
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	if name == "help" || (name == "serve" && len(args) > 0 && (args[0] == "-h" || args[0] == "-help" || args[0] == "--help")) {
+		printUsage(os.Stdout)
+		return nil
+	}
+
+	for _, cmd := range commands() {
+		if cmd.name == name {
+			return cmd.run(args)
+		}
+	}
+
+	printUsage(os.Stderr)
+	return fmt.Errorf("unknown command %s", name)
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: magnet <command> [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, cmd := range commands() {
+		fmt.Fprintf(w, "  %-15s %s\n", cmd.name, cmd.help)
+		if cmd.args != "" {
+			fmt.Fprintf(w, "  %-15s   %s\n", "", cmd.args)
+		}
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Every command also takes the config flags, see magnet <command> -h.")
+}
+
+// newCommandFlags returns the flag set of a command
+func newCommandFlags(name string) *flag.FlagSet {
+	return flag.NewFlagSet("magnet "+name, flag.ExitOnError)
+}
+
+// parseCommand parses the flags of a command along with the config flags
+// and returns the validated config
+func parseCommand(fs *flag.FlagSet, args []string) (*Config, error) {
+	configFlags := NewConfigFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	config, err := Load(configFlags)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, SetupLogging(config)
+}
+
+// openDatabase connects to the database of the config
+func openDatabase(config *Config) *Connection {
+	connection := &Connection{changefeeds: config.Changefeeds, events: NewBroadcaster()}
+	connection.SetSession(config.ConnectionString, "magnet")
+	return connection
+}
+
+// commandUser returns the user named by the -username flag
+func commandUser(connection *Connection, username string) (*User, error) {
+	if username == "" {
+		return nil, errors.New("-username is required")
+	}
+
+	user, err := connection.GetUserByUsername(username)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, fmt.Errorf("user %s not found", username)
+	}
+
+	return user, nil
+}
+
+func serveCommand(args []string) error {
+	config, err := parseCommand(newCommandFlags("serve"), args)
+	if err != nil {
+		return err
+	}
+
+	if config.SecretKey == DefaultSecretKey {
+		defaultLogger.Warn("using the default MAGNET_SESSION_KEY, set your own before going to production")
+	}
+	if config.CookieEncryptionKey == "" {
+		defaultLogger.Warn("session cookies are only signed, set MAGNET_COOKIE_ENCRYPTION_KEY to encrypt them")
+	}
+
+	DB := &Connection{changefeeds: config.Changefeeds, events: NewBroadcaster(), metrics: NewMetrics()}
+
+	// Init database
+	if err := DB.initDatabase(config.ConnectionString); err != nil {
+		return err
+	}
+
+	// Deliver bookmark events to webhooks
+	webhooks := NewWebhookDispatcher(DB, config.WebhookWorkers, time.Duration(config.WebhookRetention)*time.Second, config.WebhookAllowPrivate)
+	if err := webhooks.Start(); err != nil {
+		defaultLogger.Error("webhook delivery not started", "err", err)
+	}
+
+	err = Start(DB, config)
+
+	webhooks.Stop()
+	if closeErr := DB.Close(); closeErr != nil {
+		defaultLogger.Error("database not closed", "err", closeErr)
+	}
+	defaultLogger.Info("stopped")
+	return err
+}
+
+func migrateCommand(args []string) error {
+	fs := newCommandFlags("migrate")
+	status := fs.Bool("status", false, "print the schema version without migrating")
+
+	config, err := parseCommand(fs, args)
+	if err != nil {
+		return err
+	}
+
+	connection := openDatabase(config)
+	if *status {
+		version, err := connection.SchemaVersion()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Schema version %d, latest %d\n", version, LatestSchemaVersion())
+		return nil
+	}
+
+	if err := Migrate(connection); err != nil {
+		return err
+	}
+	log.Printf("Database at schema version %d", LatestSchemaVersion())
+	return nil
+}
+
+func createUserCommand(args []string) error {
+	fs := newCommandFlags("create-user")
+	username := fs.String("username", "", "username")
+	email := fs.String("email", "", "email address, verified")
+	password := fs.String("password", "", "password, random if empty")
+	admin := fs.Bool("admin", false, "grant administrator access")
+
+	config, err := parseCommand(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if !usernameRegexp.MatchString(*username) {
+		return errors.New("-username must have up to 40 letters, numbers, dots, dashes or underscores")
+	}
+	if !emailRegexp.MatchString(*email) {
+		return errors.New("-email must be an email address")
+	}
+
+	connection := openDatabase(config)
+	user := &User{
+		Username:      *username,
+		Email:         *email,
+		EmailVerified: true,
+		Admin:         *admin,
+	}
+
+	existing, err := connection.SignUp(user)
+	if err != nil {
+		return err
+	}
+	if len(existing) != 0 {
+		return errors.New("username or email taken")
+	}
+
+	generated := *password == ""
+	if generated {
+		*password = RandomToken(8)
+	}
+	user.Password = cryptPassword(*password, config.PasswordKey())
+
+	response, err := connection.SignUpInsert(user)
+	if err != nil {
+		return err
+	}
+	if response.Inserted < 1 {
+		return errors.New("the user was not created")
+	}
+
+	log.Printf("User %s created", user.Username)
+	if generated {
+		fmt.Printf("Password: %s\n", *password)
+	}
+	return nil
+}
+
+func resetPasswordCommand(args []string) error {
+	fs := newCommandFlags("reset-password")
+	username := fs.String("username", "", "username")
+	password := fs.String("password", "", "new password, random if empty")
+
+	config, err := parseCommand(fs, args)
+	if err != nil {
+		return err
+	}
+
+	connection := openDatabase(config)
+	user, err := commandUser(connection, *username)
+	if err != nil {
+		return err
+	}
+
+	generated := *password == ""
+	if generated {
+		*password = RandomToken(8)
+	}
+
+	if _, err := connection.SetPassword(user.ID, cryptPassword(*password, config.PasswordKey())); err != nil {
+		return err
+	}
+
+	log.Printf("Password of %s changed", user.Username)
+	if generated {
+		fmt.Printf("Password: %s\n", *password)
+	}
+	return nil
+}
+
+func disableTwoFactorCommand(args []string) error {
+	fs := newCommandFlags("disable-2fa")
+	username := fs.String("username", "", "username")
+
+	config, err := parseCommand(fs, args)
+	if err != nil {
+		return err
+	}
+
+	return DisableTwoFactorFor(openDatabase(config), *username)
+}
+
+func makeAdminCommand(args []string) error {
+	fs := newCommandFlags("make-admin")
+	username := fs.String("username", "", "username")
+
+	config, err := parseCommand(fs, args)
+	if err != nil {
+		return err
+	}
+
+	return MakeAdmin(openDatabase(config), *username)
+}
+
+func importCommand(args []string) error {
+	fs := newCommandFlags("import")
+	username := fs.String("username", "", "user to import the bookmarks to")
+
+	config, err := parseCommand(fs, args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("import takes one file")
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	bookmarks, err := ParseBookmarkFile(fs.Arg(0), f)
+	if err != nil {
+		return err
+	}
+
+	connection := openDatabase(config)
+	user, err := commandUser(connection, *username)
+	if err != nil {
+		return err
+	}
+
+	imported, skipped, err := ImportBookmarks(connection, user.ID, bookmarks)
+	log.Printf("%d bookmarks imported, %d skipped as invalid or already saved", imported, skipped)
+	return err
+}
+
+func exportCommand(args []string) error {
+	fs := newCommandFlags("export")
+	username := fs.String("username", "", "user to export")
+	output := fs.String("output", "", "archive to write, magnet-<username>-<date>.zip by default")
+
+	config, err := parseCommand(fs, args)
+	if err != nil {
+		return err
+	}
+
+	connection := openDatabase(config)
+	user, err := commandUser(connection, *username)
+	if err != nil {
+		return err
+	}
+
+	if *output == "" {
+		*output = ExportFilename(user)
+	}
+
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+
+	if err := WriteExport(connection, user, f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	log.Printf("Export of %s written to %s", user.Username, *output)
+	return nil
+}
+
+func wipeSessionsCommand(args []string) error {
+	fs := newCommandFlags("wipe-sessions")
+	username := fs.String("username", "", "only log out this user")
+	expired := fs.Bool("expired", false, "only delete expired sessions")
+
+	config, err := parseCommand(fs, args)
+	if err != nil {
+		return err
+	}
+
+	connection := openDatabase(config)
+	deleted := 0
+
+	switch {
+	case *expired:
+		response, wipeErr := connection.WipeExpiredSessions()
+		deleted, err = response.Deleted, wipeErr
+	case *username != "":
+		var user *User
+		if user, err = commandUser(connection, *username); err == nil {
+			response, wipeErr := connection.DeleteUserSessions(user.ID)
+			deleted, err = response.Deleted, wipeErr
+		}
+	default:
+		response, wipeErr := connection.DeleteAllSessions()
+		deleted, err = response.Deleted, wipeErr
+	}
+
+	if err == nil {
+		log.Printf("%d sessions deleted", deleted)
+	}
+	return err
+}
+
+func reindexCommand(args []string) error {
+	config, err := parseCommand(newCommandFlags("reindex"), args)
+	if err != nil {
+		return err
+	}
+
+	return openDatabase(config).Reindex()
+}
+
+func configCommand(args []string) error {
+	fs := newCommandFlags("config")
+	configFlags := NewConfigFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	// Printing works with an invalid config, to help fixing it
+	config, err := Load(configFlags)
+	if err != nil {
+		return err
+	}
+
+	if err := config.Print(os.Stdout); err != nil {
+		return err
+	}
+	return config.Validate()
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// captureStdout returns what run prints to the standard output
+func captureStdout(t *testing.T, run func() error) (string, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := os.Stdout
+	os.Stdout = w
+	err = run()
+	os.Stdout = stdout
+	w.Close()
+
+	out, _ := io.ReadAll(r)
+	return string(out), err
+}
+
+func TestPrintUsageListsEveryCommand(t *testing.T) {
+	var out bytes.Buffer
+	printUsage(&out)
+
+	for _, cmd := range commands() {
+		if !strings.Contains(out.String(), "  "+cmd.name+" ") {
+			t.Errorf("%s missing from the usage", cmd.name)
+		}
+	}
+}
+
+func TestRunCLIRejectsUnknownCommands(t *testing.T) {
+	// The usage printed along with the error is not of interest
+	stderr := os.Stderr
+	os.Stderr, _ = os.Open(os.DevNull)
+	defer func() { os.Stderr = stderr }()
+
+	if err := RunCLI([]string{"destroy"}); err == nil || err.Error() != "unknown command destroy" {
+		t.Errorf("error %v", err)
+	}
+
+	out, err := captureStdout(t, func() error { return RunCLI([]string{"help"}) })
+	if err != nil || !strings.HasPrefix(out, "Usage: magnet <command>") {
+		t.Errorf("help: %q, %v", out, err)
+	}
+}
+
+func TestCommandsCheckTheirFlags(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func([]string) error
+		args []string
+		want string
+	}{
+		{"create-user without username", createUserCommand, []string{"-email", "ana@example.com"}, "-username must have"},
+		{"create-user with an invalid username", createUserCommand, []string{"-username", "ana maria", "-email", "ana@example.com"}, "-username must have"},
+		{"create-user with an invalid email", createUserCommand, []string{"-username", "ana", "-email", "ana"}, "-email must be"},
+		{"import without a file", importCommand, []string{"-username", "ana"}, "import takes one file"},
+		{"import of a missing file", importCommand, []string{"-username", "ana", "missing.html"}, "missing.html"},
+		{"invalid config", migrateCommand, []string{"-port", ""}, "MAGNET_PORT cannot be empty"},
+	}
+
+	for _, test := range tests {
+		if err := test.run(test.args); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: error %v, want %q", test.name, err, test.want)
+		}
+	}
+
+	if _, err := commandUser(nil, ""); err == nil || err.Error() != "-username is required" {
+		t.Errorf("commandUser without username: %v", err)
+	}
+}
+
+func TestConfigCommandMasksSecrets(t *testing.T) {
+	out, err := captureStdout(t, func() error {
+		return configCommand([]string{"-session-key", "a session key nobody should see", "-port", ":4000"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(out, "nobody should see") || !strings.Contains(out, `"SecretKey" : "********"`) {
+		t.Errorf("secret printed:\n%s", out)
+	}
+	if !strings.Contains(out, `"Port" : ":4000"`) {
+		t.Errorf("flag not applied:\n%s", out)
+	}
+
+	// The config is printed even when invalid, to help fixing it
+	out, err = captureStdout(t, func() error { return configCommand([]string{"-log-level", "loud"}) })
+	if err == nil || !strings.Contains(out, `"LogLevel" : "loud"`) {
+		t.Errorf("invalid config: %v\n%s", err, out)
+	}
+}
+
+func TestUserCommands(t *testing.T) {
+	connection := testConnection(t)
+	address := []string{"-connection-string", os.Getenv("MAGNET_TEST_RETHINKDB")}
+
+	out, err := captureStdout(t, func() error {
+		return createUserCommand(append(address, "-username", "cli-ana", "-email", "cli-ana@example.com"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := connection.GetUserByUsername("cli-ana")
+	if err != nil || user == nil {
+		t.Fatalf("user not created: %v", err)
+	}
+	t.Cleanup(func() { connection.DeleteUser(user.ID) })
+
+	cfg := &Config{SecretKey: DefaultSecretKey}
+	password := strings.TrimSpace(strings.TrimPrefix(out, "Password: "))
+	if !user.EmailVerified || user.Admin || !CheckPassword(cfg, nil, user, password) {
+		t.Errorf("user %+v, generated password %q", user, password)
+	}
+
+	if err := createUserCommand(append(address, "-username", "cli-ana", "-email", "other@example.com")); err == nil {
+		t.Error("username taken twice")
+	}
+
+	if err := resetPasswordCommand(append(address, "-username", "cli-ana", "-password", "hunter22")); err != nil {
+		t.Fatal(err)
+	}
+	if err := makeAdminCommand(append(address, "-username", "cli-ana")); err != nil {
+		t.Fatal(err)
+	}
+	user, err = connection.GetUserByUsername("cli-ana")
+	if err != nil || !user.Admin || !CheckPassword(cfg, nil, user, "hunter22") {
+		t.Errorf("user after reset-password and make-admin: %+v, %v", user, err)
+	}
+
+	if err := resetPasswordCommand(append(address, "-username", "cli-nobody")); err == nil || err.Error() != "user cli-nobody not found" {
+		t.Errorf("unknown user: %v", err)
+	}
+}
@@ -1,17 +1,236 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"io"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strconv"
+	"strings"
 )
 
+// DefaultSecretKey is the session key used when none is configured, only
+// acceptable for development
+const DefaultSecretKey = "Here be dragons"
+
 type Config struct {
-	ConnectionString string
-	SecretKey        string
-	Port             string
-	SessionExpires   int
+	ConnectionString       string
+	SecretKey              string
+	PasswordPepper         string
+	CookieKey              string
+	CookieEncryptionKey    string
+	OldCookieKeys          string
+	CookieSecure           bool
+	CookieSameSite         string
+	ContentSecurityPolicy  string
+	FrameOptions           string
+	ReferrerPolicy         string
+	Port                   string
+	TLSCert                string
+	TLSKey                 string
+	TLSRedirectPort        string
+	HSTSMaxAge             int
+	ReadTimeout            int
+	ReadHeaderTimeout      int
+	WriteTimeout           int
+	IdleTimeout            int
+	MaxHeaderBytes         int
+	ShutdownTimeout        int
+	Production             bool
+	LogLevel               string
+	LogFormat              string
+	SessionExpires         int
+	ValidateAPI            bool
+	Changefeeds            bool
+	WebhookWorkers         int
+	WebhookRetention       int
+	WebhookAllowPrivate    bool
+	MetricsToken           string
+	SMTPHost               string
+	SMTPPort               string
+	SMTPUsername           string
+	SMTPPassword           string
+	MailFrom               string
+	BaseURL                string
+	ThrottleDelay          int
+	ThrottleMaxDelay       int
+	LockoutFailures        int
+	IPLockoutFailures      int
+	LockoutDuration        int
+	TrustedProxies         string
+	PasswordLogin          bool
+	OIDCIssuer             string
+	OIDCClientID           string
+	OIDCClientSecret       string
+	OIDCRedirectURL        string
+	OIDCScopes             string
+	OIDCButton             string
+	OIDCAutoProvision      bool
+	OIDCLinkEmail          bool
+	LDAPURL                string
+	LDAPStartTLS           bool
+	LDAPInsecureSkipVerify bool
+	LDAPBindDN             string
+	LDAPBindPassword       string
+	LDAPBaseDN             string
+	LDAPUserFilter         string
+	LDAPUsernameAttribute  string
+	LDAPEmailAttribute     string
+	LDAPAllowedGroup       string
+	LDAPAdminGroup         string
+	Registration           string
+	RegistrationDomains    string
+	InviteExpire           int
+	UserInvites            bool
+}
+
+// configSetting ties a Config field to its environment variable. The flag
+// is the variable without the MAGNET_ prefix, like -smtp-host.
+type configSetting struct {
+	field  string
+	env    string
+	value  string
+	usage  string
+	secret bool
+}
+
+// configSettings lists every setting with its default, in the order of
+// config.sample.json
+var configSettings = []configSetting{
+	{field: "ConnectionString", env: "MAGNET_CONNECTION_STRING", value: "localhost:28015", usage: "RethinkDB address"},
+	{field: "SecretKey", env: "MAGNET_SESSION_KEY", value: DefaultSecretKey, usage: "key signing the session cookies without MAGNET_COOKIE_KEY, and salting passwords without MAGNET_PASSWORD_PEPPER", secret: true},
+	{field: "PasswordPepper", env: "MAGNET_PASSWORD_PEPPER", value: "", usage: "key salting passwords, MAGNET_SESSION_KEY when empty", secret: true},
+	{field: "CookieKey", env: "MAGNET_COOKIE_KEY", value: "", usage: "key signing the session cookies", secret: true},
+	{field: "CookieEncryptionKey", env: "MAGNET_COOKIE_ENCRYPTION_KEY", value: "", usage: "key encrypting the session cookies", secret: true},
+	{field: "OldCookieKeys", env: "MAGNET_OLD_COOKIE_KEYS", value: "", usage: "comma separated signing[:encryption] keys still accepted while rotating", secret: true},
+	{field: "CookieSecure", env: "MAGNET_COOKIE_SECURE", value: "false", usage: "only send cookies over HTTPS, always on with MAGNET_TLS_CERT"},
+	{field: "CookieSameSite", env: "MAGNET_COOKIE_SAMESITE", value: "lax", usage: "SameSite of the session cookie: lax, strict or none"},
+	{field: "ContentSecurityPolicy", env: "MAGNET_CONTENT_SECURITY_POLICY", value: DefaultContentSecurityPolicy, usage: "Content-Security-Policy header, empty to not send it"},
+	{field: "FrameOptions", env: "MAGNET_FRAME_OPTIONS", value: "DENY", usage: "X-Frame-Options header, empty to not send it"},
+	{field: "ReferrerPolicy", env: "MAGNET_REFERRER_POLICY", value: "same-origin", usage: "Referrer-Policy header, empty to not send it"},
+	{field: "Port", env: "MAGNET_PORT", value: ":3000", usage: "address to listen on"},
+	{field: "TLSCert", env: "MAGNET_TLS_CERT", value: "", usage: "certificate file, serves HTTPS along with MAGNET_TLS_KEY"},
+	{field: "TLSKey", env: "MAGNET_TLS_KEY", value: "", usage: "private key file of the certificate"},
+	{field: "TLSRedirectPort", env: "MAGNET_TLS_REDIRECT_PORT", value: "", usage: "address redirecting HTTP to HTTPS, such as :80"},
+	{field: "HSTSMaxAge", env: "MAGNET_HSTS_MAX_AGE", value: "31536000", usage: "seconds browsers only use HTTPS after a TLS response, 0 to not send HSTS"},
+	{field: "ReadTimeout", env: "MAGNET_READ_TIMEOUT", value: "30", usage: "seconds to read a request"},
+	{field: "ReadHeaderTimeout", env: "MAGNET_READ_HEADER_TIMEOUT", value: "10", usage: "seconds to read the headers of a request"},
+	{field: "WriteTimeout", env: "MAGNET_WRITE_TIMEOUT", value: "0", usage: "seconds to write a response, 0 for no limit"},
+	{field: "IdleTimeout", env: "MAGNET_IDLE_TIMEOUT", value: "120", usage: "seconds a keep-alive connection waits for the next request"},
+	{field: "MaxHeaderBytes", env: "MAGNET_MAX_HEADER_BYTES", value: "1048576", usage: "largest request headers accepted"},
+	{field: "ShutdownTimeout", env: "MAGNET_SHUTDOWN_TIMEOUT", value: "30", usage: "seconds to finish the running requests when stopping"},
+	{field: "Production", env: "MAGNET_PRODUCTION", value: "false", usage: "refuse insecure settings"},
+	{field: "LogLevel", env: "MAGNET_LOG_LEVEL", value: "info", usage: "least severe entries logged: debug, info, warn or error"},
+	{field: "LogFormat", env: "MAGNET_LOG_FORMAT", value: "logfmt", usage: "log entries as logfmt or json"},
+	{field: "SessionExpires", env: "MAGNET_SESSION_EXPIRE", value: "1296000", usage: "seconds a session lasts without use"},
+	{field: "ValidateAPI", env: "MAGNET_VALIDATE_API", value: "false", usage: "check requests and responses against the OpenAPI document"},
+	{field: "Changefeeds", env: "MAGNET_CHANGEFEEDS", value: "true", usage: "stream bookmark events from RethinkDB changefeeds"},
+	{field: "WebhookWorkers", env: "MAGNET_WEBHOOK_WORKERS", value: "2", usage: "concurrent webhook deliveries"},
+	{field: "WebhookRetention", env: "MAGNET_WEBHOOK_RETENTION", value: "2592000", usage: "seconds webhook delivery attempts are kept, 0 keeps them forever"},
+	{field: "WebhookAllowPrivate", env: "MAGNET_WEBHOOK_ALLOW_PRIVATE", value: "false", usage: "deliver webhooks to loopback and private addresses"},
+	{field: "MetricsToken", env: "MAGNET_METRICS_TOKEN", value: "", usage: "bearer token required to read /metrics", secret: true},
+	{field: "SMTPHost", env: "MAGNET_SMTP_HOST", value: "", usage: "SMTP relay, emails are only logged without it"},
+	{field: "SMTPPort", env: "MAGNET_SMTP_PORT", value: "25", usage: "SMTP relay port"},
+	{field: "SMTPUsername", env: "MAGNET_SMTP_USERNAME", value: "", usage: "SMTP username"},
+	{field: "SMTPPassword", env: "MAGNET_SMTP_PASSWORD", value: "", usage: "SMTP password", secret: true},
+	{field: "MailFrom", env: "MAGNET_MAIL_FROM", value: "magnet@localhost", usage: "sender of the emails"},
+	{field: "BaseURL", env: "MAGNET_BASE_URL", value: "http://localhost:3000", usage: "public URL used in links"},
+	{field: "ThrottleDelay", env: "MAGNET_THROTTLE_DELAY", value: "1", usage: "seconds to wait after the first failed login"},
+	{field: "ThrottleMaxDelay", env: "MAGNET_THROTTLE_MAX_DELAY", value: "300", usage: "longest wait between failed logins"},
+	{field: "LockoutFailures", env: "MAGNET_LOCKOUT_FAILURES", value: "10", usage: "failed logins locking an username"},
+	{field: "IPLockoutFailures", env: "MAGNET_IP_LOCKOUT_FAILURES", value: "50", usage: "failed logins locking an address"},
+	{field: "LockoutDuration", env: "MAGNET_LOCKOUT_DURATION", value: "900", usage: "seconds a lockout lasts"},
+	{field: "TrustedProxies", env: "MAGNET_TRUSTED_PROXIES", value: "", usage: "comma separated addresses or CIDR ranges of the proxies whose X-Forwarded-For is used"},
+	{field: "PasswordLogin", env: "MAGNET_PASSWORD_LOGIN", value: "true", usage: "allow logging in with a local password, directory logins are not affected"},
+	{field: "OIDCIssuer", env: "MAGNET_OIDC_ISSUER", value: "", usage: "OpenID Connect issuer"},
+	{field: "OIDCClientID", env: "MAGNET_OIDC_CLIENT_ID", value: "", usage: "OpenID Connect client id"},
+	{field: "OIDCClientSecret", env: "MAGNET_OIDC_CLIENT_SECRET", value: "", usage: "OpenID Connect client secret", secret: true},
+	{field: "OIDCRedirectURL", env: "MAGNET_OIDC_REDIRECT_URL", value: "", usage: "OpenID Connect redirect URI"},
+	{field: "OIDCScopes", env: "MAGNET_OIDC_SCOPES", value: "openid email profile", usage: "OpenID Connect scopes"},
+	{field: "OIDCButton", env: "MAGNET_OIDC_BUTTON", value: "Log in with single sign-on", usage: "label of the single sign-on button"},
+	{field: "OIDCAutoProvision", env: "MAGNET_OIDC_AUTO_PROVISION", value: "true", usage: "create users on their first single sign-on"},
+	{field: "OIDCLinkEmail", env: "MAGNET_OIDC_LINK_EMAIL", value: "false", usage: "link single sign-on to users with the same email"},
+	{field: "LDAPURL", env: "MAGNET_LDAP_URL", value: "", usage: "LDAP server, ldap:// or ldaps://"},
+	{field: "LDAPStartTLS", env: "MAGNET_LDAP_STARTTLS", value: "false", usage: "use StartTLS with ldap://"},
+	{field: "LDAPInsecureSkipVerify", env: "MAGNET_LDAP_INSECURE_SKIP_VERIFY", value: "false", usage: "skip verifying the LDAP certificate"},
+	{field: "LDAPBindDN", env: "MAGNET_LDAP_BIND_DN", value: "", usage: "LDAP service account"},
+	{field: "LDAPBindPassword", env: "MAGNET_LDAP_BIND_PASSWORD", value: "", usage: "LDAP service account password", secret: true},
+	{field: "LDAPBaseDN", env: "MAGNET_LDAP_BASE_DN", value: "", usage: "LDAP search base"},
+	{field: "LDAPUserFilter", env: "MAGNET_LDAP_USER_FILTER", value: "(uid=%s)", usage: "LDAP user filter, %s is the username"},
+	{field: "LDAPUsernameAttribute", env: "MAGNET_LDAP_USERNAME_ATTRIBUTE", value: "uid", usage: "LDAP username attribute"},
+	{field: "LDAPEmailAttribute", env: "MAGNET_LDAP_EMAIL_ATTRIBUTE", value: "mail", usage: "LDAP email attribute"},
+	{field: "LDAPAllowedGroup", env: "MAGNET_LDAP_ALLOWED_GROUP", value: "", usage: "LDAP group allowed to log in"},
+	{field: "LDAPAdminGroup", env: "MAGNET_LDAP_ADMIN_GROUP", value: "", usage: "LDAP group of administrators"},
+	{field: "Registration", env: "MAGNET_REGISTRATION", value: RegistrationOpen, usage: "who can sign up: open, invite, domains or closed"},
+	{field: "RegistrationDomains", env: "MAGNET_REGISTRATION_DOMAINS", value: "", usage: "email domains signing up without an invite"},
+	{field: "InviteExpire", env: "MAGNET_INVITE_EXPIRE", value: "604800", usage: "seconds an invite code lasts"},
+	{field: "UserInvites", env: "MAGNET_USER_INVITES", value: "false", usage: "let every user create invite codes"},
+}
+
+// settingFlag is the command line flag of a setting, remembering if it was
+// given
+type settingFlag struct {
+	value   string
+	set     bool
+	boolean bool
+}
+
+func (f *settingFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.value
+}
+
+func (f *settingFlag) Set(value string) error {
+	f.value = value
+	f.set = true
+	return nil
+}
+
+func (f *settingFlag) IsBoolFlag() bool {
+	return f.boolean
+}
+
+// ConfigFlags holds the command line flags of the config, parsed along with
+// the other flags of the program
+type ConfigFlags struct {
+	file     *string
+	settings map[string]*settingFlag
+}
+
+// NewConfigFlags defines -config and a flag for every setting
+func NewConfigFlags(fs *flag.FlagSet) *ConfigFlags {
+	flags := &ConfigFlags{
+		file:     fs.String("config", os.Getenv("MAGNET_CONFIG"), "JSON or TOML config `file`"),
+		settings: make(map[string]*settingFlag),
+	}
+
+	for _, setting := range configSettings {
+		value := &settingFlag{value: setting.value, boolean: configFieldKind(setting.field) == reflect.Bool}
+		flags.settings[setting.field] = value
+		fs.Var(value, setting.flagName(), setting.usage+" ("+setting.env+")")
+	}
+
+	return flags
 }
 
+func (s configSetting) flagName() string {
+	return strings.Replace(strings.ToLower(strings.TrimPrefix(s.env, "MAGNET_")), "_", "-", -1)
+}
+
+func configFieldKind(field string) reflect.Kind {
+	f, _ := reflect.TypeOf(Config{}).FieldByName(field)
+	return f.Type.Kind()
+}
+
+// EnvWithDefault reads a variable, using defaultVal if it is not set
 func EnvWithDefault(name string, defaultVal string) string {
 	value := os.Getenv(name)
 	if value == "" {
@@ -20,20 +239,252 @@ func EnvWithDefault(name string, defaultVal string) string {
 	return value
 }
 
-func Load() *Config {
+// Load builds the config from the defaults, then the config file, then the
+// environment and finally the command line flags, each overriding the last
+func Load(flags *ConfigFlags) (*Config, error) {
 	config := &Config{}
+	values := make(map[string]string)
+
+	for _, setting := range configSettings {
+		values[setting.field] = setting.value
+	}
+
+	if flags.file != nil && *flags.file != "" {
+		if err := loadConfigFile(*flags.file, values); err != nil {
+			return nil, err
+		}
+	}
+
+	// Docker links set the address of RethinkDB
+	if os.Getenv("RDB_PORT_28015_TCP_ADDR") != "" || os.Getenv("RDB_PORT_28015_TCP_PORT") != "" {
+		values["ConnectionString"] = EnvWithDefault("RDB_PORT_28015_TCP_ADDR", "localhost") + ":" +
+			EnvWithDefault("RDB_PORT_28015_TCP_PORT", "28015")
+	}
+
+	for _, setting := range configSettings {
+		if value, ok := os.LookupEnv(setting.env); ok {
+			values[setting.field] = value
+		}
+		if given := flags.settings[setting.field]; given != nil && given.set {
+			values[setting.field] = given.value
+		}
+	}
+
+	target := reflect.ValueOf(config).Elem()
+	for _, setting := range configSettings {
+		field := target.FieldByName(setting.field)
+		value := strings.TrimSpace(values[setting.field])
+
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(values[setting.field])
+		case reflect.Int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be a number, not %q", setting.env, value)
+			}
+			field.SetInt(int64(n))
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be true or false, not %q", setting.env, value)
+			}
+			field.SetBool(b)
+		}
+	}
+
+	return config, nil
+}
+
+// loadConfigFile reads the settings of a JSON or TOML file, keyed like the
+// fields of Config
+func loadConfigFile(path string, values map[string]string) error {
+	file := make(map[string]interface{})
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		if _, err := toml.DecodeFile(path, &file); err != nil {
+			return fmt.Errorf("config file %s: %s", path, err)
+		}
+	default:
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("config file %s: %s", path, err)
+		}
+		defer f.Close()
+
+		decoder := json.NewDecoder(f)
+		decoder.UseNumber()
+		if err := decoder.Decode(&file); err != nil {
+			return fmt.Errorf("config file %s: %s", path, err)
+		}
+	}
+
+	for key, value := range file {
+		if _, ok := values[key]; !ok {
+			return fmt.Errorf("config file %s: unknown setting %s", path, key)
+		}
+
+		switch value.(type) {
+		case string, bool, json.Number, int64, float64:
+			values[key] = fmt.Sprint(value)
+		default:
+			return fmt.Errorf("config file %s: %s must be a string, number or boolean", path, key)
+		}
+	}
+
+	return nil
+}
+
+// PasswordKey is the key salting the passwords. It falls back to SecretKey,
+// which salted them before MAGNET_PASSWORD_PEPPER existed.
+func (c *Config) PasswordKey() string {
+	if c.PasswordPepper != "" {
+		return c.PasswordPepper
+	}
+	return c.SecretKey
+}
+
+// TLSEnabled tells whether Magnet serves HTTPS itself
+func (c *Config) TLSEnabled() bool {
+	return c.TLSCert != "" && c.TLSKey != ""
+}
+
+// Validate checks the config makes sense, refusing insecure settings in
+// production
+func (c *Config) Validate() error {
+	var problems []string
+
+	if c.Production {
+		if c.SecretKey == DefaultSecretKey {
+			problems = append(problems, "MAGNET_SESSION_KEY must be changed from the default in production")
+		} else if len(c.SecretKey) < 32 {
+			problems = append(problems, "MAGNET_SESSION_KEY must be at least 32 characters long in production")
+		}
+		if c.CookieKey != "" && len(c.CookieKey) < 32 {
+			problems = append(problems, "MAGNET_COOKIE_KEY must be at least 32 characters long in production")
+		}
+		if c.LDAPInsecureSkipVerify {
+			problems = append(problems, "MAGNET_LDAP_INSECURE_SKIP_VERIFY cannot be used in production")
+		}
+		if c.MetricsToken == "" {
+			problems = append(problems, "MAGNET_METRICS_TOKEN must be set in production")
+		}
+	}
+
+	if _, ok := cookieSameSite[c.CookieSameSite]; !ok {
+		problems = append(problems, "MAGNET_COOKIE_SAMESITE must be lax, strict or none")
+	} else if c.CookieSameSite == "none" && !c.SecureCookies() {
+		problems = append(problems, "MAGNET_COOKIE_SAMESITE=none needs MAGNET_COOKIE_SECURE or MAGNET_TLS_CERT")
+	}
+
+	if _, err := ParseLevel(c.LogLevel); err != nil {
+		problems = append(problems, "MAGNET_LOG_LEVEL must be debug, info, warn or error")
+	}
+	if c.LogFormat != "logfmt" && c.LogFormat != "json" {
+		problems = append(problems, "MAGNET_LOG_FORMAT must be logfmt or json")
+	}
+
+	if c.Port == "" {
+		problems = append(problems, "MAGNET_PORT cannot be empty")
+	}
+
+	positive := map[string]int{
+		"MAGNET_SESSION_EXPIRE":      c.SessionExpires,
+		"MAGNET_READ_TIMEOUT":        c.ReadTimeout,
+		"MAGNET_READ_HEADER_TIMEOUT": c.ReadHeaderTimeout,
+		"MAGNET_IDLE_TIMEOUT":        c.IdleTimeout,
+		"MAGNET_MAX_HEADER_BYTES":    c.MaxHeaderBytes,
+		"MAGNET_SHUTDOWN_TIMEOUT":    c.ShutdownTimeout,
+		"MAGNET_WEBHOOK_WORKERS":     c.WebhookWorkers,
+		"MAGNET_THROTTLE_MAX_DELAY":  c.ThrottleMaxDelay,
+		"MAGNET_LOCKOUT_FAILURES":    c.LockoutFailures,
+		"MAGNET_IP_LOCKOUT_FAILURES": c.IPLockoutFailures,
+		"MAGNET_LOCKOUT_DURATION":    c.LockoutDuration,
+		"MAGNET_INVITE_EXPIRE":       c.InviteExpire,
+	}
+	for _, setting := range configSettings {
+		if value, ok := positive[setting.env]; ok && value <= 0 {
+			problems = append(problems, setting.env+" must be greater than zero")
+		}
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		problems = append(problems, "MAGNET_TLS_CERT and MAGNET_TLS_KEY must be set together")
+	}
+	if c.TLSRedirectPort != "" && !c.TLSEnabled() {
+		problems = append(problems, "MAGNET_TLS_REDIRECT_PORT needs MAGNET_TLS_CERT and MAGNET_TLS_KEY")
+	}
+	if c.HSTSMaxAge < 0 {
+		problems = append(problems, "MAGNET_HSTS_MAX_AGE cannot be negative")
+	}
+	if c.WriteTimeout < 0 {
+		problems = append(problems, "MAGNET_WRITE_TIMEOUT cannot be negative")
+	} else if c.WriteTimeout == 1 {
+		problems = append(problems, "MAGNET_WRITE_TIMEOUT must be 0 or more than one second")
+	}
+	if c.ThrottleDelay < 0 {
+		problems = append(problems, "MAGNET_THROTTLE_DELAY cannot be negative")
+	}
+	if _, err := ParseTrustedProxies(c.TrustedProxies); err != nil {
+		problems = append(problems, "MAGNET_TRUSTED_PROXIES "+err.Error())
+	}
+	if c.WebhookRetention < 0 {
+		problems = append(problems, "MAGNET_WEBHOOK_RETENTION cannot be negative")
+	}
+
+	if u, err := url.Parse(c.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		problems = append(problems, "MAGNET_BASE_URL must be an http or https URL")
+	}
+
+	switch strings.ToLower(c.Registration) {
+	case RegistrationOpen, RegistrationInvite, RegistrationClosed:
+	case RegistrationDomains:
+		if strings.TrimSpace(c.RegistrationDomains) == "" {
+			problems = append(problems, "MAGNET_REGISTRATION=domains needs MAGNET_REGISTRATION_DOMAINS")
+		}
+	default:
+		problems = append(problems, "MAGNET_REGISTRATION must be open, invite, domains or closed")
+	}
+
+	if c.OIDCIssuer != "" && c.OIDCClientID == "" {
+		problems = append(problems, "MAGNET_OIDC_CLIENT_ID is needed with MAGNET_OIDC_ISSUER")
+	}
+
+	if c.LDAPURL != "" {
+		if u, err := url.Parse(c.LDAPURL); err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") {
+			problems = append(problems, "MAGNET_LDAP_URL must be an ldap:// or ldaps:// URL")
+		}
+	}
+
+	if !c.PasswordLogin && c.OIDCIssuer == "" && c.LDAPURL == "" {
+		problems = append(problems, "MAGNET_PASSWORD_LOGIN=false needs single sign-on or LDAP, or nobody can log in")
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid config:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// Print writes the config as JSON, in the format of config files, with the
+// secrets masked
+func (c *Config) Print(w io.Writer) error {
+	source := reflect.ValueOf(c).Elem()
+	lines := make([]string, len(configSettings))
+
+	for i, setting := range configSettings {
+		value := source.FieldByName(setting.field).Interface()
+		if setting.secret && value != "" {
+			value = "********"
+		}
 
-	ConnectionPort := EnvWithDefault("RDB_PORT_28015_TCP_PORT", "28015")
-	ConnectionAddr := EnvWithDefault("RDB_PORT_28015_TCP_ADDR", "localhost")
-	config.ConnectionString = ConnectionAddr + ":" + ConnectionPort
-	config.SecretKey = EnvWithDefault("MAGNET_SESSION_KEY", "Here be dragons")
-	config.Port = EnvWithDefault("MAGNET_PORT", ":3000")
-	SessionExpires, err := strconv.Atoi(EnvWithDefault("MAGNET_SESSION_EXPIRE", "1296000"))
-	if err != nil {
-		config.SessionExpires = 1296000
-	} else {
-		config.SessionExpires = SessionExpires
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		lines[i] = fmt.Sprintf("    %q : %s", setting.field, encoded)
 	}
 
-	return config
+	_, err := fmt.Fprintf(w, "{\n%s\n}\n", strings.Join(lines, ",\n"))
+	return err
 }
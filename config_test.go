@@ -0,0 +1,151 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// loadTestConfig loads the config from a JSON file with the given content,
+// when not empty, and the command line args
+func loadTestConfig(t *testing.T, file string, args ...string) (*Config, error) {
+	fs := flag.NewFlagSet("magnet", flag.ContinueOnError)
+	flags := NewConfigFlags(fs)
+	if file != "" {
+		path := filepath.Join(t.TempDir(), "config.json")
+		if err := os.WriteFile(path, []byte(file), 0600); err != nil {
+			t.Fatal(err)
+		}
+		args = append([]string{"-config", path}, args...)
+	}
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return Load(flags)
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+		want string
+	}{
+		{"default", "", nil, nil, ":3000"},
+		{"file", `{"Port": ":4000"}`, nil, nil, ":4000"},
+		{"env over file", `{"Port": ":4000"}`, map[string]string{"MAGNET_PORT": ":5000"}, nil, ":5000"},
+		{"flag over env", `{"Port": ":4000"}`, map[string]string{"MAGNET_PORT": ":5000"}, []string{"-port", ":6000"}, ":6000"},
+		{"flag over file", `{"Port": ":4000"}`, nil, []string{"-port", ":6000"}, ":6000"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			os.Unsetenv("MAGNET_PORT")
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+
+			config, err := loadTestConfig(t, test.file, test.args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.Port != test.want {
+				t.Errorf("port %q, want %q", config.Port, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadEmptyEnvClearsSetting(t *testing.T) {
+	t.Setenv("MAGNET_CONTENT_SECURITY_POLICY", "")
+	t.Setenv("MAGNET_FRAME_OPTIONS", "")
+
+	config, err := loadTestConfig(t, `{"FrameOptions": "SAMEORIGIN"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ContentSecurityPolicy != "" || config.FrameOptions != "" {
+		t.Errorf("headers not cleared: %q, %q", config.ContentSecurityPolicy, config.FrameOptions)
+	}
+}
+
+func TestLoadRejectsInvalidValues(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		args []string
+		want string
+	}{
+		{"unknown setting", `{"Prot": ":4000"}`, nil, "unknown setting Prot"},
+		{"number", "", []string{"-session-expire", "soon"}, "MAGNET_SESSION_EXPIRE must be a number"},
+		{"boolean", `{"Production": "maybe"}`, nil, "MAGNET_PRODUCTION must be true or false"},
+	}
+
+	for _, test := range tests {
+		if _, err := loadTestConfig(t, test.file, test.args...); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: error %v, want %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestPasswordKeyFallsBackToSecretKey(t *testing.T) {
+	config := &Config{SecretKey: "old key"}
+	if config.PasswordKey() != "old key" {
+		t.Errorf("password key %q without a pepper", config.PasswordKey())
+	}
+
+	config.PasswordPepper = "old key"
+	config.SecretKey = "a new session key of at least 32 characters"
+	if config.PasswordKey() != "old key" {
+		t.Errorf("password key %q with a pepper", config.PasswordKey())
+	}
+}
+
+func TestValidate(t *testing.T) {
+	key := strings.Repeat("k", 32)
+	tests := []struct {
+		name   string
+		change func(*Config)
+		want   string
+	}{
+		{"defaults", func(c *Config) {}, ""},
+		{"production", func(c *Config) { c.Production, c.SecretKey, c.MetricsToken = true, key, "token" }, ""},
+		{"production with a short key and a pepper", func(c *Config) {
+			c.Production, c.SecretKey, c.PasswordPepper, c.MetricsToken = true, key, "short", "token"
+		}, ""},
+		{"default key in production", func(c *Config) { c.Production, c.MetricsToken = true, "token" }, "MAGNET_SESSION_KEY must be changed"},
+		{"short key in production", func(c *Config) { c.Production, c.SecretKey, c.MetricsToken = true, "short", "token" }, "MAGNET_SESSION_KEY must be at least 32"},
+		{"short cookie key in production", func(c *Config) { c.Production, c.SecretKey, c.CookieKey, c.MetricsToken = true, key, "short", "token" }, "MAGNET_COOKIE_KEY must be at least 32"},
+		{"no metrics token in production", func(c *Config) { c.Production, c.SecretKey = true, key }, "MAGNET_METRICS_TOKEN must be set"},
+		{"same site", func(c *Config) { c.CookieSameSite = "sometimes" }, "MAGNET_COOKIE_SAMESITE must be"},
+		{"same site none without https", func(c *Config) { c.CookieSameSite = "none" }, "MAGNET_COOKIE_SAMESITE=none needs"},
+		{"log level", func(c *Config) { c.LogLevel = "loud" }, "MAGNET_LOG_LEVEL must be"},
+		{"empty port", func(c *Config) { c.Port = "" }, "MAGNET_PORT cannot be empty"},
+		{"zero session expire", func(c *Config) { c.SessionExpires = 0 }, "MAGNET_SESSION_EXPIRE must be greater than zero"},
+		{"certificate without key", func(c *Config) { c.TLSCert = "cert.pem" }, "must be set together"},
+		{"one second write timeout", func(c *Config) { c.WriteTimeout = 1 }, "MAGNET_WRITE_TIMEOUT must be 0 or more"},
+		{"base URL", func(c *Config) { c.BaseURL = "magnet.example.com" }, "MAGNET_BASE_URL must be"},
+		{"registration domains", func(c *Config) { c.Registration = RegistrationDomains }, "needs MAGNET_REGISTRATION_DOMAINS"},
+		{"nobody can log in", func(c *Config) { c.PasswordLogin = false }, "nobody can log in"},
+		{"LDAP URL", func(c *Config) { c.LDAPURL = "http://ldap.example.com" }, "MAGNET_LDAP_URL must be"},
+	}
+
+	for _, test := range tests {
+		config, err := loadTestConfig(t, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.change(config)
+
+		err = config.Validate()
+		switch {
+		case test.want == "" && err != nil:
+			t.Errorf("%s: %v", test.name, err)
+		case test.want != "" && (err == nil || !strings.Contains(err.Error(), test.want)):
+			t.Errorf("%s: error %v, want %q", test.name, err, test.want)
+		}
+	}
+}
@@ -1,19 +1,71 @@
 package main
 
 import (
+	"errors"
 	"github.com/codegangsta/martini"
 	r "github.com/dancannon/gorethink"
-	"github.com/gorilla/sessions"
 	"log"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 type Connection struct {
-	session *r.Session
+	session     *r.Session
+	changefeeds bool
+	events      *Broadcaster
+	metrics     *Metrics
+	logger      *Logger
+}
+
+// StoreError is a failed query, with the Connection method it failed in
+type StoreError struct {
+	Op  string
+	Err error
+}
+
+func (e *StoreError) Error() string {
+	return e.Op + ": " + e.Err.Error()
+}
+
+// WithLogger returns a copy of the connection logging through logger, so
+// errors carry the request they happened in
+func (c *Connection) WithLogger(logger *Logger) *Connection {
+	connection := *c
+	connection.logger = logger
+	return &connection
+}
+
+// fail logs a failed query of a Connection method and wraps its error
+func (c *Connection) fail(op string, err error) error {
+	c.logger.Error("query failed", "op", op, "err", err)
+	return &StoreError{Op: op, Err: err}
+}
+
+// readAll decodes every row of a cursor into result and closes it
+func (c *Connection) readAll(op string, cursor *r.Cursor, result interface{}) error {
+	defer cursor.Close()
+
+	if err := cursor.All(result); err != nil {
+		return c.fail(op, err)
+	}
+	return nil
+}
+
+// readOne decodes the first row of a cursor into result and closes it
+func (c *Connection) readOne(op string, cursor *r.Cursor, result interface{}) error {
+	defer cursor.Close()
+
+	if err := cursor.One(result); err != nil {
+		return c.fail(op, err)
+	}
+	return nil
 }
 
 func (c *Connection) GetBookmarks(userID string, page int64) ([]Bookmark, error) {
+	defer c.metrics.ObserveQuery("GetBookmarks", time.Now())
+
 	var bookmarks []Bookmark
 
 	cursor, err := r.DB("magnet").
@@ -25,21 +77,28 @@ func (c *Connection) GetBookmarks(userID string, page int64) ([]Bookmark, error)
 		Run(c.session)
 
 	if err != nil {
-		log.Print(err)
+		err = c.fail("GetBookmarks", err)
 		return bookmarks, err
 	}
 
-	cursor.All(&bookmarks)
-	cursor.Close()
+	err = c.readAll("GetBookmarks", cursor, &bookmarks)
 	return bookmarks, err
 }
 
-func (c *Connection) initDatabase(connectionString string) {
+func (c *Connection) initDatabase(connectionString string) error {
 	c.SetSession(connectionString, "magnet")
 
-	c.InitDatabase()
+	err := Migrate(c)
+	c.metrics.JobRun("migrations", err)
+	if err != nil {
+		return err
+	}
 
-	c.WipeExpiredSessions()
+	_, err = c.WipeExpiredSessions()
+	c.metrics.JobRun("wipe_expired_sessions", err)
+	_, err = c.WipeExpiredTokens()
+	c.metrics.JobRun("wipe_expired_tokens", err)
+	return nil
 }
 
 func (c *Connection) SetSession(address, database string) {
@@ -56,57 +115,152 @@ func (c *Connection) SetSession(address, database string) {
 }
 
 func (c *Connection) NewBookmark(userID string, bookmark map[string]interface{}) (r.WriteResponse, error) {
+	defer c.metrics.ObserveQuery("NewBookmark", time.Now())
+
 	var response r.WriteResponse
 
+	// Updated is set by the database clock, the one sync tokens come from
+	document := make(map[string]interface{}, len(bookmark)+1)
+	for field, value := range bookmark {
+		document[field] = value
+	}
+	document["Updated"] = r.Now().ToEpochTime()
+
 	cursor, err := r.DB("magnet").
 		Table("bookmarks").
-		Insert(bookmark).
+		Insert(document).
 		Run(c.session)
 
 	if err != nil {
-		log.Print(err)
+		err = c.fail("NewBookmark", err)
+		return response, err
 	}
 
-	cursor.One(&response)
-	cursor.Close()
+	err = c.readOne("NewBookmark", cursor, &response)
+
+	if response.Inserted > 0 {
+		c.publish(EventCreated, userID, response.GeneratedKeys[0])
+	}
 	return response, err
 }
 
-func (c *Connection) DeleteBookmark(userID string, params martini.Params) (r.WriteResponse, error) {
+// DeleteBookmark deletes a bookmark of an user. With a version other than
+// AnyVersion it is only deleted if it still has that version, checked in the
+// same write so a concurrent edit can't slip in between.
+func (c *Connection) DeleteBookmark(userID string, params martini.Params, version int64) (r.WriteResponse, error) {
+	defer c.metrics.ObserveQuery("DeleteBookmark", time.Now())
+
 	var response r.WriteResponse
 
 	cursor, err := r.DB("magnet").
 		Table("bookmarks").
-		Filter(r.Row.Field("User").Eq(userID).
-		And(r.Row.Field("id").Eq(params["bookmark"]))).
-		Delete().
+		Get(params["bookmark"]).
+		Replace(func(row r.Term) interface{} {
+			// Replacing with null deletes, missing bookmarks and those of
+			// other users are left as they are
+			deleted := interface{}(nil)
+			if version != AnyVersion {
+				deleted = r.Branch(row.Field("Version").Default(0).Eq(version),
+					nil,
+					r.Error(ErrVersionConflict.Error()))
+			}
+
+			return r.Branch(row.Eq(nil),
+				nil,
+				r.Branch(row.Field("User").Eq(userID), deleted, row))
+		}, r.ReplaceOpts{ReturnChanges: true}).
 		Run(c.session)
 
-	cursor.One(&response)
-	cursor.Close()
+	if err != nil {
+		err = c.fail("DeleteBookmark", err)
+		return response, err
+	}
+
+	err = c.readOne("DeleteBookmark", cursor, &response)
+
+	if response.Errors > 0 {
+		if strings.Contains(response.FirstError, ErrVersionConflict.Error()) {
+			return response, ErrVersionConflict
+		}
+		return response, errors.New(response.FirstError)
+	}
+
+	if err == nil && response.Deleted > 0 {
+		c.publishDeleted(deletedBookmark(userID, params["bookmark"], response))
+		// Without its tombstone the delete never reaches the synced clients
+		err = c.newTombstone(userID, params["bookmark"])
+	}
+
 	return response, err
 }
 
-func (c *Connection) EditBookmark(userID string, params martini.Params, bookmark map[string]interface{}) (r.WriteResponse, error) {
+func (c *Connection) EditBookmark(userID string, params martini.Params, edit *BookmarkEdit) (r.WriteResponse, error) {
+	defer c.metrics.ObserveQuery("EditBookmark", time.Now())
+
 	var response r.WriteResponse
 
 	cursor, err := r.DB("magnet").
 		Table("bookmarks").
 		Filter(r.Row.Field("User").Eq(userID).
-		And(r.Row.Field("id").Eq(params["bookmark"]))).
-		Update(bookmark).
+			And(r.Row.Field("id").Eq(params["bookmark"]))).
+		Update(func(row r.Term) interface{} {
+			changes := make(map[string]interface{})
+			for field, value := range edit.Fields {
+				changes[field] = value
+			}
+
+			if len(edit.AddTags) > 0 || len(edit.RemoveTags) > 0 {
+				var tags r.Term
+				if newTags, ok := edit.Fields["Tags"]; ok {
+					tags = r.Expr(newTags)
+				} else {
+					tags = row.Field("Tags").Default([]string{})
+				}
+				changes["Tags"] = tags.SetUnion(edit.AddTags).SetDifference(edit.RemoveTags)
+			}
+
+			changes["Updated"] = r.Now().ToEpochTime()
+			changes["Version"] = row.Field("Version").Default(0).Add(1)
+
+			if edit.Version == AnyVersion {
+				return changes
+			}
+
+			return r.Branch(row.Field("Version").Default(0).Eq(edit.Version),
+				changes,
+				r.Error(ErrVersionConflict.Error()))
+		}).
 		Run(c.session)
 
 	if err != nil {
-		log.Print(err)
+		err = c.fail("EditBookmark", err)
+		return response, err
 	}
 
-	cursor.One(&response)
-	cursor.Close()
+	err = c.readOne("EditBookmark", cursor, &response)
+
+	if response.Errors > 0 {
+		if strings.Contains(response.FirstError, ErrVersionConflict.Error()) {
+			return response, ErrVersionConflict
+		}
+		return response, errors.New(response.FirstError)
+	}
+
+	if response.Replaced > 0 {
+		c.publish(EventUpdated, userID, params["bookmark"])
+	}
 	return response, err
 }
 
+// EditFound reports whether the response of EditBookmark matched a bookmark,
+// whether or not it changed it
+func EditFound(response r.WriteResponse) bool {
+	return response.Replaced+response.Unchanged+response.Updated > 0
+}
+
 func (c *Connection) Search(userID string, params martini.Params, query string) ([]interface{}, error) {
+	defer c.metrics.ObserveQuery("Search", time.Now())
+
 	var response []interface{}
 	page, _ := strconv.ParseInt(params["page"], 10, 16)
 
@@ -120,41 +274,42 @@ func (c *Connection) Search(userID string, params martini.Params, query string)
 		Run(c.session)
 
 	if err != nil {
-		log.Print(err)
+		err = c.fail("Search", err)
 		return nil, err
 	}
 
-	cursor.All(&response)
-	cursor.Close()
+	err = c.readAll("Search", cursor, &response)
 	return response, err
 }
 
 func (c *Connection) GetTag(userID string, params martini.Params) ([]interface{}, error) {
+	defer c.metrics.ObserveQuery("GetTag", time.Now())
+
 	var response []interface{}
 	page, _ := strconv.ParseInt(params["page"], 10, 16)
 
 	cursor, err := r.DB("magnet").
 		Table("bookmarks").
-		OrderBy(r.OrderByOpts{r.Desc("Created")}).
-		Filter(r.Row.Field("User").Eq(userID).
-		And(r.Row.Field("Tags").
-		Contains(params["tag"]))).
+		GetAllByIndex("Tags", params["tag"]).
+		Filter(r.Row.Field("User").Eq(userID)).
+		OrderBy(r.Desc("Created")).
 		Skip(50 * page).
 		Limit(50).
 		Run(c.session)
 
 	if err != nil {
-		log.Print(err)
+		err = c.fail("GetTag", err)
 		return nil, err
 	}
 
-	cursor.All(&response)
-	cursor.Close()
+	err = c.readAll("GetTag", cursor, &response)
 	return response, err
 }
 
-func (c *Connection) LoginPost(username, password string) ([]interface{}, error) {
-	var response []interface{}
+func (c *Connection) LoginPost(username, password string) (*User, error) {
+	defer c.metrics.ObserveQuery("LoginPost", time.Now())
+
+	var users []User
 
 	cursor, err := r.DB("magnet").
 		Table("users").
@@ -163,15 +318,21 @@ func (c *Connection) LoginPost(username, password string) ([]interface{}, error)
 		Run(c.session)
 
 	if err != nil {
+		err = c.fail("LoginPost", err)
 		return nil, err
 	}
 
-	cursor.All(&response)
-	cursor.Close()
-	return response, err
+	err = c.readAll("LoginPost", cursor, &users)
+
+	if err != nil || len(users) == 0 {
+		return nil, err
+	}
+	return &users[0], nil
 }
 
 func (c *Connection) LoginPostInsertSession(session Session) (r.WriteResponse, error) {
+	defer c.metrics.ObserveQuery("LoginPostInsertSession", time.Now())
+
 	var response r.WriteResponse
 
 	cursor, err := r.DB("magnet").
@@ -180,52 +341,57 @@ func (c *Connection) LoginPostInsertSession(session Session) (r.WriteResponse, e
 		Run(c.session)
 
 	if err != nil {
-		log.Print(err)
+		err = c.fail("LoginPostInsertSession", err)
+		return response, err
 	}
 
-	cursor.One(&response)
-	cursor.Close()
+	err = c.readOne("LoginPostInsertSession", cursor, &response)
 	return response, err
 }
 
-func (c *Connection) Logout(session *sessions.Session) (r.WriteResponse, error) {
+func (c *Connection) Logout(sessionID string) (r.WriteResponse, error) {
+	defer c.metrics.ObserveQuery("Logout", time.Now())
+
 	var response r.WriteResponse
 
 	cursor, err := r.DB("magnet").
 		Table("sessions").
-		Get(session.Values["session_id"]).
+		Get(sessionID).
 		Delete().
 		Run(c.session)
 
 	if err != nil {
-		log.Print(err)
+		err = c.fail("Logout", err)
+		return response, err
 	}
 
-	cursor.One(&response)
-	cursor.Close()
+	err = c.readOne("Logout", cursor, &response)
 	return response, err
 }
 
 func (c *Connection) SignUp(user *User) ([]interface{}, error) {
+	defer c.metrics.ObserveQuery("SignUp", time.Now())
+
 	var response []interface{}
 
 	cursor, err := r.DB("magnet").
 		Table("users").
 		Filter(r.Row.Field("Username").Eq(user.Username).
-		Or(r.Row.Field("Email").Eq(user.Email))).
+		Or(r.Row.Field("Email").Default("").Downcase().Eq(strings.ToLower(user.Email)))).
 		Run(c.session)
 
 	if err != nil {
-		log.Print(err)
+		err = c.fail("SignUp", err)
 		return nil, err
 	}
 
-	cursor.All(&response)
-	cursor.Close()
+	err = c.readAll("SignUp", cursor, &response)
 	return response, err
 }
 
 func (c *Connection) SignUpInsert(user *User) (r.WriteResponse, error) {
+	defer c.metrics.ObserveQuery("SignUpInsert", time.Now())
+
 	var response r.WriteResponse
 
 	cursor, err := r.DB("magnet").
@@ -234,26 +400,202 @@ func (c *Connection) SignUpInsert(user *User) (r.WriteResponse, error) {
 		Run(c.session)
 
 	if err != nil {
-		log.Print(err)
+		err = c.fail("SignUpInsert", err)
+		return response, err
+	}
+
+	err = c.readOne("SignUpInsert", cursor, &response)
+	return response, err
+}
+
+// Close closes the session, waiting for the queries being run
+func (c *Connection) Close() error {
+	return c.session.Close()
+}
+
+// Ping checks the store answers queries
+func (c *Connection) Ping() error {
+	return r.Expr(true).Exec(c.session)
+}
+
+// CreateDatabase creates the magnet database and the migrations table that
+// records the schema version, unless they exist
+func (c *Connection) CreateDatabase() error {
+	defer c.metrics.ObserveQuery("CreateDatabase", time.Now())
+
+	var databases []string
+
+	cursor, err := r.DBList().Run(c.session)
+	if err != nil {
+		return err
+	}
+	if err = c.readAll("CreateDatabase", cursor, &databases); err != nil {
+		return err
+	}
+
+	if !containsString(databases, "magnet") {
+		if err := r.DBCreate("magnet").Exec(c.session); err != nil {
+			return err
+		}
+	}
+
+	return c.CreateTable("migrations")
+}
+
+// CreateTable creates a table unless it exists
+func (c *Connection) CreateTable(name string) error {
+	defer c.metrics.ObserveQuery("CreateTable", time.Now())
+
+	var tables []string
+
+	cursor, err := r.DB("magnet").TableList().Run(c.session)
+	if err != nil {
+		return err
+	}
+	if err = c.readAll("CreateTable", cursor, &tables); err != nil {
+		return err
+	}
+
+	if containsString(tables, name) {
+		return nil
+	}
+	return r.DB("magnet").TableCreate(name).Exec(c.session)
+}
+
+// CreateIndex creates a secondary index on a field unless it exists, and
+// waits until it is ready
+func (c *Connection) CreateIndex(table, field string, multi bool) error {
+	defer c.metrics.ObserveQuery("CreateIndex", time.Now())
+
+	var indexes []string
+
+	cursor, err := r.DB("magnet").Table(table).IndexList().Run(c.session)
+	if err != nil {
+		return err
+	}
+	if err = c.readAll("CreateIndex", cursor, &indexes); err != nil {
+		return err
+	}
+
+	if !containsString(indexes, field) {
+		_, err := r.DB("magnet").
+			Table(table).
+			IndexCreate(field, r.IndexCreateOpts{Multi: multi}).
+			RunWrite(c.session)
+		if err != nil {
+			return err
+		}
+	}
+
+	return r.DB("magnet").Table(table).IndexWait(field).Exec(c.session)
+}
+
+// SchemaVersion returns the version of the last migration applied
+func (c *Connection) SchemaVersion() (int, error) {
+	defer c.metrics.ObserveQuery("SchemaVersion", time.Now())
+
+	var versions []int
+
+	cursor, err := r.DB("magnet").
+		Table("migrations").
+		Field("id").
+		Run(c.session)
+
+	if err != nil {
+		err = c.fail("SchemaVersion", err)
+		return 0, err
+	}
+
+	err = c.readAll("SchemaVersion", cursor, &versions)
+	if err != nil {
+		return 0, err
+	}
+
+	version := 0
+	for _, v := range versions {
+		if v > version {
+			version = v
+		}
+	}
+	return version, nil
+}
+
+// RecordMigration marks a migration as applied
+func (c *Connection) RecordMigration(migration Migration) (r.WriteResponse, error) {
+	defer c.metrics.ObserveQuery("RecordMigration", time.Now())
+
+	response, err := r.DB("magnet").
+		Table("migrations").
+		Insert(map[string]interface{}{
+			"id":          migration.Version,
+			"Description": migration.Description,
+			"Applied":     time.Now().Unix(),
+		}).
+		RunWrite(c.session)
+
+	if err != nil {
+		err = c.fail("RecordMigration", err)
 	}
 
-	cursor.One(&response)
-	cursor.Close()
 	return response, err
 }
 
-func (c *Connection) InitDatabase() {
-	r.DBCreate("magnet").Exec(c.session)
-	r.TableCreate("users").Exec(c.session)
-	r.TableCreate("bookmarks").Exec(c.session)
-	_, err := r.DB("magnet").Table("bookmarks").IndexCreate("Created").RunWrite(c.session)
+// RenameBookmarkField moves a field of every bookmark that has it to a new
+// name
+func (c *Connection) RenameBookmarkField(from, to string) (r.WriteResponse, error) {
+	defer c.metrics.ObserveQuery("RenameBookmarkField", time.Now())
+
+	response, err := r.DB("magnet").
+		Table("bookmarks").
+		Filter(r.Row.HasFields(from)).
+		Replace(func(bookmark r.Term) interface{} {
+			return bookmark.Without(from).Merge(map[string]interface{}{to: bookmark.Field(from)})
+		}).
+		RunWrite(c.session)
+
+	if err != nil {
+		err = c.fail("RenameBookmarkField", err)
+	}
+
+	return response, err
+}
+
+// DeleteAllSessions logs every user out
+func (c *Connection) DeleteAllSessions() (r.WriteResponse, error) {
+	defer c.metrics.ObserveQuery("DeleteAllSessions", time.Now())
+
+	response, err := r.DB("magnet").
+		Table("sessions").
+		Delete().
+		RunWrite(c.session)
+
 	if err != nil {
-		log.Printf("Error creating index: %s", err)
+		err = c.fail("DeleteAllSessions", err)
+	}
+
+	return response, err
+}
+
+// Reindex drops and creates again the secondary indexes, waiting until
+// they are ready
+func (c *Connection) Reindex() error {
+	defer c.metrics.ObserveQuery("Reindex", time.Now())
+
+	for _, index := range DatabaseIndexes {
+		r.DB("magnet").Table(index.Table).IndexDrop(index.Field).Exec(c.session)
+
+		if err := c.CreateIndex(index.Table, index.Field, index.Multi); err != nil {
+			return err
+		}
+		c.logger.Info("index rebuilt", "table", index.Table, "index", index.Field)
 	}
-	r.TableCreate("sessions").Exec(c.session)
+
+	return nil
 }
 
 func (c *Connection) WipeExpiredSessions() (r.WriteResponse, error) {
+	defer c.metrics.ObserveQuery("WipeExpiredSessions", time.Now())
+
 	var response r.WriteResponse
 
 	cursor, err := r.DB("magnet").
@@ -263,47 +605,1310 @@ func (c *Connection) WipeExpiredSessions() (r.WriteResponse, error) {
 		Run(c.session)
 
 	if err != nil {
-		log.Print(err)
+		err = c.fail("WipeExpiredSessions", err)
+		return response, err
 	}
 
-	cursor.One(&response)
-	cursor.Close()
+	err = c.readOne("WipeExpiredSessions", cursor, &response)
 	return response, err
 }
 
 func (c *Connection) GetTags(userID string) ([]interface{}, error) {
+	defer c.metrics.ObserveQuery("GetTags", time.Now())
+
 	var response []interface{}
 
 	cursor, err := r.DB("magnet").
 		Table("bookmarks").
-		Filter(r.Row.Field("User").Eq(userID)).
+		GetAllByIndex("User", userID).
 		WithFields("Tags").
 		Run(c.session)
 
 	if err != nil {
-		log.Print(err)
+		err = c.fail("GetTags", err)
+		return nil, err
+	}
+
+	err = c.readAll("GetTags", cursor, &response)
+	return response, err
+}
+
+func (c *Connection) GetUnexpiredSession(sessionID string) (*Session, error) {
+	defer c.metrics.ObserveQuery("GetUnexpiredSession", time.Now())
+
+	var response []Session
+
+	cursor, err := r.DB("magnet").
+		Table("sessions").
+		GetAll(sessionID).
+		Run(c.session)
+
+	if err != nil {
+		err = c.fail("GetUnexpiredSession", err)
+		return nil, err
+	}
+
+	err = c.readAll("GetUnexpiredSession", cursor, &response)
+
+	if err != nil || len(response) == 0 {
 		return nil, err
 	}
+	return &response[0], nil
+}
+
+// TouchSession records activity on a session and moves its expiry forward
+func (c *Connection) TouchSession(sessionID string, lastSeen, expires int64) (r.WriteResponse, error) {
+	defer c.metrics.ObserveQuery("TouchSession", time.Now())
+
+	response, err := r.DB("magnet").
+		Table("sessions").
+		Get(sessionID).
+		Update(map[string]interface{}{"LastSeen": lastSeen, "Expires": expires}).
+		RunWrite(c.session)
+
+	if err != nil {
+		err = c.fail("TouchSession", err)
+	}
 
-	cursor.All(&response)
-	cursor.Close()
 	return response, err
 }
 
-func (c *Connection) GetUnexpiredSession(session *sessions.Session) (map[string]interface{}, error) {
-	var response map[string]interface{}
+// GetUserSessions returns the unexpired sessions of an user, the most
+// recently used first
+func (c *Connection) GetUserSessions(userID string) ([]Session, error) {
+	defer c.metrics.ObserveQuery("GetUserSessions", time.Now())
+
+	var sessions []Session
 
 	cursor, err := r.DB("magnet").
 		Table("sessions").
-		Get(session.Values["session_id"]).
+		Filter(r.Row.Field("UserID").Eq(userID).
+			And(r.Row.Field("Expires").Gt(time.Now().Unix()))).
+		OrderBy(r.Desc("LastSeen")).
+		Run(c.session)
+
+	if err != nil {
+		err = c.fail("GetUserSessions", err)
+		return sessions, err
+	}
+
+	err = c.readAll("GetUserSessions", cursor, &sessions)
+	return sessions, err
+}
+
+func (c *Connection) RevokeSession(userID string, params martini.Params) (r.WriteResponse, error) {
+	defer c.metrics.ObserveQuery("RevokeSession", time.Now())
+
+	response, err := r.DB("magnet").
+		Table("sessions").
+		Filter(r.Row.Field("id").Eq(params["session"]).
+			And(r.Row.Field("UserID").Eq(userID))).
+		Delete().
+		RunWrite(c.session)
+
+	if err != nil {
+		err = c.fail("RevokeSession", err)
+	}
+
+	return response, err
+}
+
+// RevokeOtherSessions deletes every session of an user but the given one
+func (c *Connection) RevokeOtherSessions(userID, keepID string) (r.WriteResponse, error) {
+	defer c.metrics.ObserveQuery("RevokeOtherSessions", time.Now())
+
+	response, err := r.DB("magnet").
+		Table("sessions").
+		Filter(r.Row.Field("UserID").Eq(userID).
+			And(r.Row.Field("id").Ne(keepID))).
+		Delete().
+		RunWrite(c.session)
+
+	if err != nil {
+		err = c.fail("RevokeOtherSessions", err)
+	}
+
+	return response, err
+}
+
+func (c *Connection) GetSavedSearches(userID string) ([]SavedSearch, error) {
+	defer c.metrics.ObserveQuery("GetSavedSearches", time.Now())
+
+	var searches []SavedSearch
+
+	cursor, err := r.DB("magnet").
+		Table("saved_searches").
+		OrderBy(r.Asc("Name")).
+		Filter(r.Row.Field("User").Eq(userID)).
 		Run(c.session)
 
 	if err != nil {
-		log.Print(err)
+		err = c.fail("GetSavedSearches", err)
+		return searches, err
+	}
+
+	err = c.readAll("GetSavedSearches", cursor, &searches)
+	return searches, err
+}
+
+func (c *Connection) GetSavedSearch(userID string, params martini.Params) (*SavedSearch, error) {
+	defer c.metrics.ObserveQuery("GetSavedSearch", time.Now())
+
+	var searches []SavedSearch
+
+	cursor, err := r.DB("magnet").
+		Table("saved_searches").
+		Filter(r.Row.Field("User").Eq(userID).
+			And(r.Row.Field("id").Eq(params["search"]))).
+		Run(c.session)
+
+	if err != nil {
+		err = c.fail("GetSavedSearch", err)
+		return nil, err
+	}
+
+	err = c.readAll("GetSavedSearch", cursor, &searches)
+
+	if err != nil || len(searches) == 0 {
 		return nil, err
 	}
+	return &searches[0], nil
+}
+
+func (c *Connection) NewSavedSearch(search *SavedSearch) (r.WriteResponse, error) {
+	defer c.metrics.ObserveQuery("NewSavedSearch", time.Now())
+
+	var response r.WriteResponse
+
+	cursor, err := r.DB("magnet").
+		Table("saved_searches").
+		Insert(search).
+		Run(c.session)
+
+	if err != nil {
+		err = c.fail("NewSavedSearch", err)
+		return response, err
+	}
+
+	err = c.readOne("NewSavedSearch", cursor, &response)
+	return response, err
+}
+
+func (c *Connection) DeleteSavedSearch(userID string, params martini.Params) (r.WriteResponse, error) {
+	defer c.metrics.ObserveQuery("DeleteSavedSearch", time.Now())
+
+	var response r.WriteResponse
+
+	cursor, err := r.DB("magnet").
+		Table("saved_searches").
+		Filter(r.Row.Field("User").Eq(userID).
+			And(r.Row.Field("id").Eq(params["search"]))).
+		Delete().
+		Run(c.session)
+
+	if err != nil {
+		err = c.fail("DeleteSavedSearch", err)
+		return response, err
+	}
+
+	err = c.readOne("DeleteSavedSearch", cursor, &response)
+	return response, err
+}
+
+func (c *Connection) FilterBookmarks(search *SavedSearch, page int64) ([]Bookmark, error) {
+	defer c.metrics.ObserveQuery("FilterBookmarks", time.Now())
+
+	var bookmarks []Bookmark
+
+	cursor, err := r.DB("magnet").
+		Table("bookmarks").
+		OrderBy(r.OrderByOpts{r.Desc("Created")}).
+		Filter(savedSearchFilter(search)).
+		Skip(50 * page).
+		Limit(50).
+		Run(c.session)
+
+	if err != nil {
+		err = c.fail("FilterBookmarks", err)
+		return bookmarks, err
+	}
+
+	err = c.readAll("FilterBookmarks", cursor, &bookmarks)
+	return bookmarks, err
+}
+
+// savedSearchFilter builds the bookmarks filter matching a saved search
+func savedSearchFilter(search *SavedSearch) r.Term {
+	filter := r.Row.Field("User").Eq(search.User)
+
+	if search.Query != "" {
+		filter = filter.And(r.Row.Field("Title").Match("(?i)" + search.Query))
+	}
+
+	for _, tag := range search.Tags {
+		filter = filter.And(r.Row.Field("Tags").Default([]string{}).Contains(tag))
+	}
+
+	if search.From > 0 {
+		filter = filter.And(r.Row.Field("Created").Ge(search.From))
+	}
+
+	if search.To > 0 {
+		filter = filter.And(r.Row.Field("Created").Le(search.To))
+	}
+
+	if search.Unread != "" {
+		filter = filter.And(r.Row.Field("Unread").Default(false).Eq(search.Unread == "unread"))
+	}
+
+	if search.Visibility != "" {
+		filter = filter.And(r.Row.Field("Private").Default(false).Eq(search.Visibility == "private"))
+	}
+
+	return filter
+}
+
+func (c *Connection) GetBookmark(userID string, params martini.Params) (*Bookmark, error) {
+	defer c.metrics.ObserveQuery("GetBookmark", time.Now())
+
+	var bookmarks []Bookmark
+
+	cursor, err := r.DB("magnet").
+		Table("bookmarks").
+		Filter(r.Row.Field("User").Eq(userID).
+			And(r.Row.Field("id").Eq(params["bookmark"]))).
+		Run(c.session)
+
+	if err != nil {
+		err = c.fail("GetBookmark", err)
+		return nil, err
+	}
+
+	err = c.readAll("GetBookmark", cursor, &bookmarks)
+
+	if err != nil || len(bookmarks) == 0 {
+		return nil, err
+	}
+	return &bookmarks[0], nil
+}
+
+// Subscribe returns a channel receiving the bookmark events of an user, or
+// of every user if userID is empty, and a function to stop receiving them.
+// Events come from a changefeed unless they are disabled, in which case
+// the writes made through this connection are broadcast.
+func (c *Connection) Subscribe(userID string) (<-chan BookmarkEvent, func(), error) {
+	if !c.changefeeds {
+		events, cancel := c.events.Subscribe(userID)
+		return events, cancel, nil
+	}
+
+	query := r.DB("magnet").Table("bookmarks")
+	if userID != "" {
+		query = query.Filter(r.Row.Field("User").Eq(userID))
+	}
+
+	cursor, err := query.Changes().Run(c.session)
+
+	if err != nil {
+		err = c.fail("Subscribe", err)
+		return nil, nil, err
+	}
+
+	events := make(chan BookmarkEvent)
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(events)
+
+		var change bookmarkChange
+		for cursor.Next(&change) {
+			if event, ok := change.event(); ok {
+				select {
+				case events <- event:
+				case <-stop:
+					return
+				}
+			}
+			change = bookmarkChange{}
+		}
+
+		if err := cursor.Err(); err != nil {
+			c.logger.Error("changefeed failed", "err", err)
+		}
+	}()
+
+	var once sync.Once
+	return events, func() {
+		once.Do(func() {
+			close(stop)
+			cursor.Close()
+		})
+	}, nil
+}
+
+// publish broadcasts the creation or update of a bookmark when there are no
+// changefeeds to deliver it
+func (c *Connection) publish(eventType, userID, bookmarkID string) {
+	if c.changefeeds || c.events == nil {
+		return
+	}
+
+	bookmark, err := c.GetBookmark(userID, martini.Params{"bookmark": bookmarkID})
+	if err != nil || bookmark == nil {
+		return
+	}
+
+	c.events.Publish(BookmarkEvent{Type: eventType, ID: bookmarkID, User: userID, Bookmark: bookmark})
+}
+
+// publishDeleted broadcasts the deletion of a bookmark when there are no
+// changefeeds to deliver it
+func (c *Connection) publishDeleted(bookmark *Bookmark) {
+	if c.changefeeds || c.events == nil {
+		return
+	}
+
+	c.events.Publish(BookmarkEvent{Type: EventDeleted, ID: bookmark.ID, User: bookmark.User, Bookmark: bookmark})
+}
+
+// deletedBookmark returns the bookmark a delete returned as its old value,
+// with its tags so tag filtered webhooks still match
+func deletedBookmark(userID, bookmarkID string, response r.WriteResponse) *Bookmark {
+	bookmark := &Bookmark{ID: bookmarkID, User: userID}
+	if len(response.Changes) == 0 {
+		return bookmark
+	}
+
+	old, _ := response.Changes[0].OldValue.(map[string]interface{})
+	bookmark.Title, _ = old["Title"].(string)
+	bookmark.URL, _ = old["URL"].(string)
+	if tags, ok := old["Tags"].([]interface{}); ok {
+		for _, tag := range tags {
+			if tag, ok := tag.(string); ok {
+				bookmark.Tags = append(bookmark.Tags, tag)
+			}
+		}
+	}
+
+	return bookmark
+}
+
+func (c *Connection) GetWebhooks(userID string) ([]Webhook, error) {
+	defer c.metrics.ObserveQuery("GetWebhooks", time.Now())
+
+	var webhooks []Webhook
+
+	cursor, err := r.DB("magnet").
+		Table("webhooks").
+		OrderBy(r.Asc("Created")).
+		Filter(r.Row.Field("User").Eq(userID)).
+		Run(c.session)
+
+	if err != nil {
+		err = c.fail("GetWebhooks", err)
+		return webhooks, err
+	}
+
+	err = c.readAll("GetWebhooks", cursor, &webhooks)
+	return webhooks, err
+}
+
+func (c *Connection) GetWebhook(userID string, params martini.Params) (*Webhook, error) {
+	defer c.metrics.ObserveQuery("GetWebhook", time.Now())
+
+	var webhooks []Webhook
+
+	cursor, err := r.DB("magnet").
+		Table("webhooks").
+		Filter(r.Row.Field("User").Eq(userID).
+			And(r.Row.Field("id").Eq(params["webhook"]))).
+		Run(c.session)
+
+	if err != nil {
+		err = c.fail("GetWebhook", err)
+		return nil, err
+	}
+
+	err = c.readAll("GetWebhook", cursor, &webhooks)
+
+	if err != nil || len(webhooks) == 0 {
+		return nil, err
+	}
+	return &webhooks[0], nil
+}
+
+func (c *Connection) NewWebhook(webhook *Webhook) (r.WriteResponse, error) {
+	defer c.metrics.ObserveQuery("NewWebhook", time.Now())
+
+	var response r.WriteResponse
+
+	cursor, err := r.DB("magnet").
+		Table("webhooks").
+		Insert(webhook).
+		Run(c.session)
+
+	if err != nil {
+		err = c.fail("NewWebhook", err)
+		return response, err
+	}
+
+	err = c.readOne("NewWebhook", cursor, &response)
+	return response, err
+}
+
+func (c *Connection) DeleteWebhook(userID string, params martini.Params) (r.WriteResponse, error) {
+	defer c.metrics.ObserveQuery("DeleteWebhook", time.Now())
+
+	var response r.WriteResponse
+
+	cursor, err := r.DB("magnet").
+		Table("webhooks").
+		Filter(r.Row.Field("User").Eq(userID).
+			And(r.Row.Field("id").Eq(params["webhook"]))).
+		Delete().
+		Run(c.session)
+
+	if err != nil {
+		err = c.fail("DeleteWebhook", err)
+		return response, err
+	}
+
+	err = c.readOne("DeleteWebhook", cursor, &response)
+
+	if response.Deleted == 0 {
+		return response, err
+	}
+
+	for _, table := range []string{"webhook_deliveries", "webhook_retries"} {
+		_, err = r.DB("magnet").
+			Table(table).
+			Filter(r.Row.Field("Webhook").Eq(params["webhook"])).
+			Delete().
+			RunWrite(c.session)
+
+		if err != nil {
+			err = c.fail("DeleteWebhook", err)
+			return response, err
+		}
+	}
+
+	return response, err
+}
+
+func (c *Connection) NewWebhookDelivery(delivery *WebhookDelivery) (r.WriteResponse, error) {
+	defer c.metrics.ObserveQuery("NewWebhookDelivery", time.Now())
+
+	var response r.WriteResponse
+
+	cursor, err := r.DB("magnet").
+		Table("webhook_deliveries").
+		Insert(delivery).
+		Run(c.session)
+
+	if err != nil {
+		err = c.fail("NewWebhookDelivery", err)
+		return response, err
+	}
+
+	err = c.readOne("NewWebhookDelivery", cursor, &response)
+	return response, err
+}
+
+// ClaimWebhookDelivery inserts the claim of the first attempt of a delivery.
+// Claims have fixed ids, so when instances sharing the store receive the
+// same event only the one whose insert succeeded gets Inserted and may
+// attempt it.
+func (c *Connection) ClaimWebhookDelivery(claim *WebhookClaim) (r.WriteResponse, error) {
+	defer c.metrics.ObserveQuery("ClaimWebhookDelivery", time.Now())
+
+	var response r.WriteResponse
+
+	cursor, err := r.DB("magnet").
+		Table("webhook_claims").
+		Insert(claim).
+		Run(c.session)
+
+	if err != nil {
+		err = c.fail("ClaimWebhookDelivery", err)
+		return response, err
+	}
+
+	// A claim already inserted is a duplicate primary key error in the
+	// response, which is expected and not a failure of the store
+	err = c.readOne("ClaimWebhookDelivery", cursor, &response)
+	return response, err
+}
+
+// PruneWebhookClaims deletes the delivery claims made before a time
+func (c *Connection) PruneWebhookClaims(before float64) (r.WriteResponse, error) {
+	defer c.metrics.ObserveQuery("PruneWebhookClaims", time.Now())
+
+	response, err := r.DB("magnet").
+		Table("webhook_claims").
+		Filter(r.Row.Field("Created").Lt(before)).
+		Delete().
+		RunWrite(c.session)
+
+	if err != nil {
+		err = c.fail("PruneWebhookClaims", err)
+	}
+
+	return response, err
+}
+
+// PruneWebhookDeliveries deletes the delivery attempts made before a time
+func (c *Connection) PruneWebhookDeliveries(before float64) (r.WriteResponse, error) {
+	defer c.metrics.ObserveQuery("PruneWebhookDeliveries", time.Now())
+
+	response, err := r.DB("magnet").
+		Table("webhook_deliveries").
+		Filter(r.Row.Field("Created").Lt(before)).
+		Delete().
+		RunWrite(c.session)
+
+	if err != nil {
+		err = c.fail("PruneWebhookDeliveries", err)
+	}
+
+	return response, err
+}
+
+func (c *Connection) NewWebhookRetry(retry *WebhookRetry) (r.WriteResponse, error) {
+	defer c.metrics.ObserveQuery("NewWebhookRetry", time.Now())
+
+	response, err := r.DB("magnet").
+		Table("webhook_retries").
+		Insert(retry).
+		RunWrite(c.session)
+
+	if err != nil {
+		err = c.fail("NewWebhookRetry", err)
+	}
+
+	return response, err
+}
+
+// GetDueWebhookRetries returns the retries to attempt by a time
+func (c *Connection) GetDueWebhookRetries(now float64) ([]WebhookRetry, error) {
+	defer c.metrics.ObserveQuery("GetDueWebhookRetries", time.Now())
+
+	var retries []WebhookRetry
+
+	cursor, err := r.DB("magnet").
+		Table("webhook_retries").
+		Filter(r.Row.Field("Due").Le(now)).
+		Run(c.session)
+
+	if err != nil {
+		err = c.fail("GetDueWebhookRetries", err)
+		return retries, err
+	}
+
+	err = c.readAll("GetDueWebhookRetries", cursor, &retries)
+	return retries, err
+}
+
+// DeleteWebhookRetry deletes a retry. Only the caller that deleted it may
+// attempt it, so instances sharing the store don't deliver it twice.
+func (c *Connection) DeleteWebhookRetry(retryID string) (r.WriteResponse, error) {
+	defer c.metrics.ObserveQuery("DeleteWebhookRetry", time.Now())
+
+	response, err := r.DB("magnet").
+		Table("webhook_retries").
+		Get(retryID).
+		Delete().
+		RunWrite(c.session)
+
+	if err != nil {
+		err = c.fail("DeleteWebhookRetry", err)
+	}
+
+	return response, err
+}
+
+func (c *Connection) GetWebhookDeliveries(userID string, params martini.Params) ([]WebhookDelivery, error) {
+	defer c.metrics.ObserveQuery("GetWebhookDeliveries", time.Now())
+
+	var deliveries []WebhookDelivery
+
+	cursor, err := r.DB("magnet").
+		Table("webhook_deliveries").
+		OrderBy(r.Desc("Created")).
+		Filter(r.Row.Field("User").Eq(userID).
+			And(r.Row.Field("Webhook").Eq(params["webhook"]))).
+		Limit(50).
+		Run(c.session)
+
+	if err != nil {
+		err = c.fail("GetWebhookDeliveries", err)
+		return deliveries, err
+	}
+
+	err = c.readAll("GetWebhookDeliveries", cursor, &deliveries)
+	return deliveries, err
+}
+
+func (c *Connection) ChangedBookmarks(userID string, since float64) ([]Bookmark, error) {
+	defer c.metrics.ObserveQuery("ChangedBookmarks", time.Now())
+
+	var bookmarks []Bookmark
+
+	cursor, err := r.DB("magnet").
+		Table("bookmarks").
+		Filter(r.Row.Field("User").Eq(userID).
+			And(r.Row.Field("Updated").Default(0).Ge(since))).
+		Run(c.session)
+
+	if err != nil {
+		err = c.fail("ChangedBookmarks", err)
+		return bookmarks, err
+	}
+
+	err = c.readAll("ChangedBookmarks", cursor, &bookmarks)
+	return bookmarks, err
+}
+
+// SyncBookmarks returns up to limit bookmarks of an user changed at or after
+// since, ordered by when they changed and then by id. With after, those
+// changed exactly at since are only returned if their id is greater, so a
+// page starts where the one before ended.
+func (c *Connection) SyncBookmarks(userID string, since float64, after string, limit int) ([]Bookmark, error) {
+	defer c.metrics.ObserveQuery("SyncBookmarks", time.Now())
+
+	var bookmarks []Bookmark
+
+	updated := r.Row.Field("Updated").Default(0)
+	changed := updated.Ge(since)
+	if after != "" {
+		changed = updated.Gt(since).Or(updated.Eq(since).And(r.Row.Field("id").Gt(after)))
+	}
+
+	cursor, err := r.DB("magnet").
+		Table("bookmarks").
+		Filter(r.Row.Field("User").Eq(userID).And(changed)).
+		OrderBy(func(row r.Term) interface{} {
+			return row.Field("Updated").Default(0)
+		}, "id").
+		Limit(limit).
+		Run(c.session)
+
+	if err != nil {
+		err = c.fail("SyncBookmarks", err)
+		return bookmarks, err
+	}
+
+	err = c.readAll("SyncBookmarks", cursor, &bookmarks)
+	return bookmarks, err
+}
+
+// SyncTime returns the time of the database clock, which sets Updated and
+// Deleted, in fractional unix seconds
+func (c *Connection) SyncTime() (float64, error) {
+	defer c.metrics.ObserveQuery("SyncTime", time.Now())
+
+	var now float64
+
+	cursor, err := r.Now().ToEpochTime().Run(c.session)
+
+	if err != nil {
+		err = c.fail("SyncTime", err)
+		return now, err
+	}
+
+	err = c.readOne("SyncTime", cursor, &now)
+	return now, err
+}
+
+func (c *Connection) GetTombstones(userID string, since float64) ([]Tombstone, error) {
+	defer c.metrics.ObserveQuery("GetTombstones", time.Now())
+
+	var tombstones []Tombstone
+
+	cursor, err := r.DB("magnet").
+		Table("tombstones").
+		Filter(r.Row.Field("User").Eq(userID).
+			And(r.Row.Field("Deleted").Ge(since))).
+		Run(c.session)
+
+	if err != nil {
+		err = c.fail("GetTombstones", err)
+		return tombstones, err
+	}
+
+	err = c.readAll("GetTombstones", cursor, &tombstones)
+	return tombstones, err
+}
+
+// newTombstone records a deleted bookmark for clients that sync later
+func (c *Connection) newTombstone(userID, bookmarkID string) error {
+	_, err := r.DB("magnet").
+		Table("tombstones").
+		Insert(map[string]interface{}{"id": bookmarkID, "User": userID, "Deleted": r.Now().ToEpochTime()}, r.InsertOpts{Conflict: "replace"}).
+		RunWrite(c.session)
+
+	if err != nil {
+		err = c.fail("newTombstone", err)
+	}
+	return err
+}
+
+func (c *Connection) GetUser(userID string) (*User, error) {
+	defer c.metrics.ObserveQuery("GetUser", time.Now())
+
+	var users []User
+
+	cursor, err := r.DB("magnet").
+		Table("users").
+		Filter(r.Row.Field("id").Eq(userID)).
+		Run(c.session)
+
+	if err != nil {
+		err = c.fail("GetUser", err)
+		return nil, err
+	}
+
+	err = c.readAll("GetUser", cursor, &users)
+
+	if err != nil || len(users) == 0 {
+		return nil, err
+	}
+	return &users[0], nil
+}
+
+// GetUserByEmail returns the user with an email address, compared ignoring
+// case as addresses are, or nil if there is none
+func (c *Connection) GetUserByEmail(email string) (*User, error) {
+	defer c.metrics.ObserveQuery("GetUserByEmail", time.Now())
+
+	var users []User
+
+	cursor, err := r.DB("magnet").
+		Table("users").
+		Filter(r.Row.Field("Email").Default("").Downcase().Eq(strings.ToLower(email))).
+		Run(c.session)
+
+	if err != nil {
+		err = c.fail("GetUserByEmail", err)
+		return nil, err
+	}
+
+	err = c.readAll("GetUserByEmail", cursor, &users)
+
+	if err != nil || len(users) == 0 {
+		return nil, err
+	}
+	return &users[0], nil
+}
+
+// SetPassword changes the password of an user and closes all their
+// sessions, so whoever knew the old one is logged out
+func (c *Connection) SetPassword(userID, password string) (r.WriteResponse, error) {
+	defer c.metrics.ObserveQuery("SetPassword", time.Now())
+
+	response, err := r.DB("magnet").
+		Table("users").
+		Get(userID).
+		Update(map[string]interface{}{"Password": password}).
+		RunWrite(c.session)
+
+	if err != nil {
+		err = c.fail("SetPassword", err)
+		return response, err
+	}
+
+	_, err = c.DeleteUserSessions(userID)
+	return response, err
+}
+
+// VerifyEmail marks the email of an user as verified if it is still the
+// one the verification was sent to
+func (c *Connection) VerifyEmail(userID, email string) (r.WriteResponse, error) {
+	defer c.metrics.ObserveQuery("VerifyEmail", time.Now())
+
+	response, err := r.DB("magnet").
+		Table("users").
+		Filter(r.Row.Field("id").Eq(userID).
+			And(r.Row.Field("Email").Eq(email))).
+		Update(map[string]interface{}{"EmailVerified": true}).
+		RunWrite(c.session)
+
+	if err != nil {
+		err = c.fail("VerifyEmail", err)
+	}
+
+	return response, err
+}
+
+// DeleteUserSessions logs an user out everywhere
+func (c *Connection) DeleteUserSessions(userID string) (r.WriteResponse, error) {
+	defer c.metrics.ObserveQuery("DeleteUserSessions", time.Now())
+
+	response, err := r.DB("magnet").
+		Table("sessions").
+		Filter(r.Row.Field("UserID").Eq(userID)).
+		Delete().
+		RunWrite(c.session)
+
+	if err != nil {
+		err = c.fail("DeleteUserSessions", err)
+	}
+
+	return response, err
+}
+
+func (c *Connection) NewToken(token *Token) (r.WriteResponse, error) {
+	defer c.metrics.ObserveQuery("NewToken", time.Now())
+
+	response, err := r.DB("magnet").
+		Table("tokens").
+		Insert(token).
+		RunWrite(c.session)
+
+	if err != nil {
+		err = c.fail("NewToken", err)
+	}
+
+	return response, err
+}
+
+// UseToken deletes an unexpired token of the given kind and returns it, so
+// every token works only once. It returns nil if there is no such token.
+func (c *Connection) UseToken(kind, secret string) (*Token, error) {
+	defer c.metrics.ObserveQuery("UseToken", time.Now())
+
+	response, err := r.DB("magnet").
+		Table("tokens").
+		Filter(r.Row.Field("id").Eq(HashToken(secret)).
+			And(r.Row.Field("Kind").Eq(kind)).
+			And(r.Row.Field("Expires").Gt(time.Now().Unix()))).
+		Delete(r.DeleteOpts{ReturnChanges: true}).
+		RunWrite(c.session)
+
+	if err != nil {
+		err = c.fail("UseToken", err)
+		return nil, err
+	}
+
+	if response.Deleted < 1 || len(response.Changes) == 0 {
+		return nil, nil
+	}
+
+	old, _ := response.Changes[0].OldValue.(map[string]interface{})
+	token := &Token{ID: HashToken(secret), Kind: kind}
+	token.User, _ = old["User"].(string)
+	token.Email, _ = old["Email"].(string)
+	if expires, ok := old["Expires"].(float64); ok {
+		token.Expires = int64(expires)
+	}
+
+	return token, nil
+}
+
+// GetUserInvites returns the unexpired invite codes an user created
+func (c *Connection) GetUserInvites(userID string) ([]Token, error) {
+	defer c.metrics.ObserveQuery("GetUserInvites", time.Now())
+
+	var tokens []Token
+
+	cursor, err := r.DB("magnet").
+		Table("tokens").
+		Filter(r.Row.Field("User").Eq(userID).
+			And(r.Row.Field("Kind").Eq(TokenInvite)).
+			And(r.Row.Field("Expires").Gt(time.Now().Unix()))).
+		OrderBy(r.Desc("Expires")).
+		Run(c.session)
+
+	if err != nil {
+		err = c.fail("GetUserInvites", err)
+		return tokens, err
+	}
+
+	err = c.readAll("GetUserInvites", cursor, &tokens)
+	return tokens, err
+}
+
+func (c *Connection) DeleteInvite(userID, inviteID string) (r.WriteResponse, error) {
+	defer c.metrics.ObserveQuery("DeleteInvite", time.Now())
+
+	response, err := r.DB("magnet").
+		Table("tokens").
+		Filter(r.Row.Field("id").Eq(inviteID).
+			And(r.Row.Field("User").Eq(userID)).
+			And(r.Row.Field("Kind").Eq(TokenInvite))).
+		Delete().
+		RunWrite(c.session)
+
+	if err != nil {
+		err = c.fail("DeleteInvite", err)
+	}
+
+	return response, err
+}
+
+func (c *Connection) WipeExpiredTokens() (r.WriteResponse, error) {
+	defer c.metrics.ObserveQuery("WipeExpiredTokens", time.Now())
+
+	response, err := r.DB("magnet").
+		Table("tokens").
+		Filter(r.Row.Field("Expires").Lt(time.Now().Unix())).
+		Delete().
+		RunWrite(c.session)
+
+	if err != nil {
+		err = c.fail("WipeExpiredTokens", err)
+	}
+
+	return response, err
+}
+
+func (c *Connection) GetUserByUsername(username string) (*User, error) {
+	defer c.metrics.ObserveQuery("GetUserByUsername", time.Now())
+
+	var users []User
+
+	cursor, err := r.DB("magnet").
+		Table("users").
+		Filter(r.Row.Field("Username").Eq(username)).
+		Run(c.session)
+
+	if err != nil {
+		err = c.fail("GetUserByUsername", err)
+		return nil, err
+	}
+
+	err = c.readAll("GetUserByUsername", cursor, &users)
+
+	if err != nil || len(users) == 0 {
+		return nil, err
+	}
+	return &users[0], nil
+}
+
+func (c *Connection) updateUser(userID string, fields map[string]interface{}) (r.WriteResponse, error) {
+	response, err := r.DB("magnet").
+		Table("users").
+		Get(userID).
+		Update(fields).
+		RunWrite(c.session)
+
+	if err != nil {
+		err = c.fail("updateUser", err)
+	}
+
+	return response, err
+}
+
+// SetTOTPPending stores the secret being enrolled until a code confirms it
+func (c *Connection) SetTOTPPending(userID, secret string) (r.WriteResponse, error) {
+	defer c.metrics.ObserveQuery("SetTOTPPending", time.Now())
+
+	return c.updateUser(userID, map[string]interface{}{"TOTPPending": secret})
+}
+
+// EnableTOTP turns on two-factor authentication with the given secret and
+// recovery code hashes
+func (c *Connection) EnableTOTP(userID, secret string, step int64, recoveryCodes []string) (r.WriteResponse, error) {
+	defer c.metrics.ObserveQuery("EnableTOTP", time.Now())
+
+	return c.updateUser(userID, map[string]interface{}{
+		"TOTPEnabled":   true,
+		"TOTPSecret":    secret,
+		"TOTPPending":   "",
+		"TOTPLastStep":  step,
+		"RecoveryCodes": recoveryCodes,
+	})
+}
+
+// DisableTOTP turns off two-factor authentication and forgets the secret
+// and recovery codes
+func (c *Connection) DisableTOTP(userID string) (r.WriteResponse, error) {
+	defer c.metrics.ObserveQuery("DisableTOTP", time.Now())
+
+	return c.updateUser(userID, map[string]interface{}{
+		"TOTPEnabled":   false,
+		"TOTPSecret":    "",
+		"TOTPPending":   "",
+		"TOTPLastStep":  0,
+		"RecoveryCodes": []string{},
+	})
+}
+
+func (c *Connection) SetRecoveryCodes(userID string, recoveryCodes []string) (r.WriteResponse, error) {
+	defer c.metrics.ObserveQuery("SetRecoveryCodes", time.Now())
+
+	return c.updateUser(userID, map[string]interface{}{"RecoveryCodes": recoveryCodes})
+}
+
+// UseTOTPStep records the time step of an accepted code. It only succeeds
+// if the step is later than the last one used, so concurrent logins cannot
+// replay a code.
+func (c *Connection) UseTOTPStep(userID string, step int64) (bool, error) {
+	defer c.metrics.ObserveQuery("UseTOTPStep", time.Now())
+
+	response, err := r.DB("magnet").
+		Table("users").
+		Get(userID).
+		Update(func(user r.Term) interface{} {
+			return r.Branch(user.Field("TOTPLastStep").Default(0).Lt(step),
+				map[string]interface{}{"TOTPLastStep": step},
+				map[string]interface{}{})
+		}).
+		RunWrite(c.session)
+
+	if err != nil {
+		err = c.fail("UseTOTPStep", err)
+		return false, err
+	}
+
+	return response.Replaced > 0, nil
+}
+
+// UseRecoveryCode removes a recovery code, returning false if the user does
+// not have it
+func (c *Connection) UseRecoveryCode(userID, hash string) (bool, error) {
+	defer c.metrics.ObserveQuery("UseRecoveryCode", time.Now())
+
+	response, err := r.DB("magnet").
+		Table("users").
+		Get(userID).
+		Update(func(user r.Term) interface{} {
+			return r.Branch(user.Field("RecoveryCodes").Default([]string{}).Contains(hash),
+				map[string]interface{}{"RecoveryCodes": user.Field("RecoveryCodes").SetDifference([]string{hash})},
+				map[string]interface{}{})
+		}).
+		RunWrite(c.session)
+
+	if err != nil {
+		err = c.fail("UseRecoveryCode", err)
+		return false, err
+	}
+
+	return response.Replaced > 0, nil
+}
+
+func (c *Connection) NewAuditEntry(entry *AuditEntry) (r.WriteResponse, error) {
+	defer c.metrics.ObserveQuery("NewAuditEntry", time.Now())
+
+	response, err := r.DB("magnet").
+		Table("audit_log").
+		Insert(entry).
+		RunWrite(c.session)
+
+	if err != nil {
+		err = c.fail("NewAuditEntry", err)
+	}
+
+	return response, err
+}
+
+func (c *Connection) GetUserByOIDCSubject(subject string) (*User, error) {
+	defer c.metrics.ObserveQuery("GetUserByOIDCSubject", time.Now())
+
+	var users []User
+
+	cursor, err := r.DB("magnet").
+		Table("users").
+		Filter(r.Row.Field("OIDCSubject").Eq(subject)).
+		Run(c.session)
+
+	if err != nil {
+		err = c.fail("GetUserByOIDCSubject", err)
+		return nil, err
+	}
+
+	err = c.readAll("GetUserByOIDCSubject", cursor, &users)
+
+	if err != nil || len(users) == 0 {
+		return nil, err
+	}
+	return &users[0], nil
+}
+
+func (c *Connection) LinkOIDCSubject(userID, subject string) (r.WriteResponse, error) {
+	defer c.metrics.ObserveQuery("LinkOIDCSubject", time.Now())
+
+	return c.updateUser(userID, map[string]interface{}{"OIDCSubject": subject})
+}
+
+// GetUserByLDAPDN returns the user created from a directory entry
+func (c *Connection) GetUserByLDAPDN(dn string) (*User, error) {
+	defer c.metrics.ObserveQuery("GetUserByLDAPDN", time.Now())
+
+	var users []User
+
+	cursor, err := r.DB("magnet").
+		Table("users").
+		Filter(r.Row.Field("LDAPDN").Eq(dn)).
+		Run(c.session)
+
+	if err != nil {
+		err = c.fail("GetUserByLDAPDN", err)
+		return nil, err
+	}
+
+	err = c.readAll("GetUserByLDAPDN", cursor, &users)
+
+	if err != nil || len(users) == 0 {
+		return nil, err
+	}
+	return &users[0], nil
+}
+
+func (c *Connection) GetUsers() ([]User, error) {
+	defer c.metrics.ObserveQuery("GetUsers", time.Now())
+
+	var users []User
+
+	cursor, err := r.DB("magnet").
+		Table("users").
+		OrderBy(r.Asc("Username")).
+		Run(c.session)
+
+	if err != nil {
+		err = c.fail("GetUsers", err)
+		return users, err
+	}
+
+	err = c.readAll("GetUsers", cursor, &users)
+	return users, err
+}
+
+// CountUserBookmarks returns the number of bookmarks of every user
+func (c *Connection) CountUserBookmarks() (map[string]int64, error) {
+	defer c.metrics.ObserveQuery("CountUserBookmarks", time.Now())
+
+	var groups []struct {
+		Group     string `gorethink:"group"`
+		Reduction int64  `gorethink:"reduction"`
+	}
+
+	cursor, err := r.DB("magnet").
+		Table("bookmarks").
+		Group("User").
+		Count().
+		Ungroup().
+		Run(c.session)
+
+	if err != nil {
+		err = c.fail("CountUserBookmarks", err)
+		return nil, err
+	}
+
+	err = c.readAll("CountUserBookmarks", cursor, &groups)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int64)
+	for _, group := range groups {
+		counts[group.Group] = group.Reduction
+	}
+	return counts, nil
+}
+
+func (c *Connection) count(term r.Term) (int64, error) {
+	var count int64
+
+	cursor, err := term.Count().Run(c.session)
+	if err != nil {
+		err = c.fail("count", err)
+		return 0, err
+	}
+
+	err = c.readOne("count", cursor, &count)
+	return count, err
+}
+
+// GetInstanceStats counts the users, bookmarks and other records of every
+// user
+func (c *Connection) GetInstanceStats() (*InstanceStats, error) {
+	defer c.metrics.ObserveQuery("GetInstanceStats", time.Now())
+
+	stats := new(InstanceStats)
+	users := r.DB("magnet").Table("users")
+
+	counts := []struct {
+		value *int64
+		term  r.Term
+	}{
+		{&stats.Users, users},
+		{&stats.DisabledUsers, users.Filter(r.Row.Field("Disabled").Default(false).Eq(true))},
+		{&stats.Admins, users.Filter(r.Row.Field("Admin").Default(false).Eq(true))},
+		{&stats.Bookmarks, r.DB("magnet").Table("bookmarks")},
+		{&stats.Tags, r.DB("magnet").Table("bookmarks").ConcatMap(func(bookmark r.Term) interface{} {
+			return bookmark.Field("Tags").Default([]string{})
+		}).Distinct()},
+		{&stats.ActiveSessions, r.DB("magnet").Table("sessions").Filter(r.Row.Field("Expires").Gt(time.Now().Unix()))},
+		{&stats.Webhooks, r.DB("magnet").Table("webhooks")},
+	}
+
+	for _, count := range counts {
+		value, err := c.count(count.term)
+		if err != nil {
+			return nil, err
+		}
+		*count.value = value
+	}
+
+	return stats, nil
+}
+
+func (c *Connection) SetUserAdmin(userID string, admin bool) (r.WriteResponse, error) {
+	defer c.metrics.ObserveQuery("SetUserAdmin", time.Now())
+
+	return c.updateUser(userID, map[string]interface{}{"Admin": admin})
+}
+
+// SetUserDisabled disables or enables an user. Disabling also closes their
+// sessions.
+func (c *Connection) SetUserDisabled(userID string, disabled bool) (r.WriteResponse, error) {
+	defer c.metrics.ObserveQuery("SetUserDisabled", time.Now())
+
+	response, err := c.updateUser(userID, map[string]interface{}{"Disabled": disabled})
+	if err == nil && disabled {
+		_, err = c.DeleteUserSessions(userID)
+	}
+
+	return response, err
+}
+
+// DeleteUser deletes an user along with everything they own
+func (c *Connection) DeleteUser(userID string) (r.WriteResponse, error) {
+	defer c.metrics.ObserveQuery("DeleteUser", time.Now())
+
+	owned := map[string]string{
+		"bookmarks":          "User",
+		"sessions":           "UserID",
+		"saved_searches":     "User",
+		"webhooks":           "User",
+		"webhook_deliveries": "User",
+		"webhook_retries":    "User",
+		"tombstones":         "User",
+		"tokens":             "User",
+	}
+
+	for table, field := range owned {
+		_, err := r.DB("magnet").
+			Table(table).
+			Filter(r.Row.Field(field).Eq(userID)).
+			Delete().
+			RunWrite(c.session)
+
+		if err != nil {
+			err = c.fail("DeleteUser", err)
+			return r.WriteResponse{}, err
+		}
+	}
+
+	response, err := r.DB("magnet").
+		Table("users").
+		Get(userID).
+		Delete().
+		RunWrite(c.session)
+
+	if err != nil {
+		err = c.fail("DeleteUser", err)
+	}
 
-	cursor.One(&response)
-	cursor.Close()
 	return response, err
 }
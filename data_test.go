@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// testConnection connects to the RethinkDB server of MAGNET_TEST_RETHINKDB,
+// skipping the test without it. The server must be a throwaway one, as the
+// magnet database is migrated and written to.
+func testConnection(t *testing.T) *Connection {
+	address := os.Getenv("MAGNET_TEST_RETHINKDB")
+	if address == "" {
+		t.Skip("MAGNET_TEST_RETHINKDB is not set")
+	}
+
+	connection := &Connection{events: NewBroadcaster(), metrics: NewMetrics()}
+	if err := connection.initDatabase(address); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { connection.Close() })
+
+	return connection
+}
+
+func testUser(t *testing.T, connection *Connection, username string) string {
+	response, err := connection.SignUpInsert(&User{Username: username + RandomToken(4), Email: username + RandomToken(4) + "@example.com"})
+	if err != nil || response.Inserted < 1 {
+		t.Fatalf("user not inserted: %v", err)
+	}
+
+	userID := response.GeneratedKeys[0]
+	t.Cleanup(func() { connection.DeleteUser(userID) })
+	return userID
+}
+
+func testSession(t *testing.T, connection *Connection, userID string) {
+	_, session := NewSession(userID, httptest.NewRequest("GET", "/", nil), time.Hour, nil)
+	if response, err := connection.LoginPostInsertSession(session); err != nil || response.Inserted < 1 {
+		t.Fatalf("session not inserted: %v", err)
+	}
+}
+
+func TestSetPasswordClosesSessions(t *testing.T) {
+	connection := testConnection(t)
+	ana, luis := testUser(t, connection, "ana"), testUser(t, connection, "luis")
+	testSession(t, connection, ana)
+	testSession(t, connection, ana)
+	testSession(t, connection, luis)
+
+	if _, err := connection.SetPassword(ana, cryptPassword("new", "secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	if sessions, err := connection.GetUserSessions(ana); err != nil || len(sessions) != 0 {
+		t.Errorf("sessions left after changing the password: %d, %v", len(sessions), err)
+	}
+	if sessions, err := connection.GetUserSessions(luis); err != nil || len(sessions) != 1 {
+		t.Errorf("sessions of another user: %d, %v", len(sessions), err)
+	}
+}
+
+func TestDeleteUserDeletesSessions(t *testing.T) {
+	connection := testConnection(t)
+	ana := testUser(t, connection, "ana")
+	testSession(t, connection, ana)
+
+	if _, err := connection.DeleteUser(ana); err != nil {
+		t.Fatal(err)
+	}
+
+	if sessions, err := connection.GetUserSessions(ana); err != nil || len(sessions) != 0 {
+		t.Errorf("sessions left after deleting the user: %d, %v", len(sessions), err)
+	}
+}
+
+func TestCheckTwoFactorCodeUsesCodesOnce(t *testing.T) {
+	connection := testConnection(t)
+	ana := testUser(t, connection, "ana")
+
+	codes, hashes := NewRecoveryCodes()
+	if _, err := connection.EnableTOTP(ana, rfc6238Secret, 0, hashes); err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := connection.GetUser(ana)
+	if err != nil || user == nil {
+		t.Fatalf("user not found: %v", err)
+	}
+
+	code, _ := TOTPCode(rfc6238Secret, time.Now().Unix()/totpPeriod)
+	if !CheckTwoFactorCode(connection, user, code) {
+		t.Error("TOTP code rejected")
+	}
+	user, _ = connection.GetUser(ana)
+	if CheckTwoFactorCode(connection, user, code) {
+		t.Error("TOTP code accepted twice")
+	}
+
+	if !CheckTwoFactorCode(connection, user, codes[0]) {
+		t.Error("recovery code rejected")
+	}
+	if CheckTwoFactorCode(connection, user, codes[0]) {
+		t.Error("recovery code accepted twice")
+	}
+	if !CheckTwoFactorCode(connection, user, codes[1]) {
+		t.Error("another recovery code rejected")
+	}
+}
+
+func TestOIDCUserLinksOnlyVerifiedEmails(t *testing.T) {
+	connection := testConnection(t)
+	cfg := &Config{OIDCLinkEmail: true}
+	ana := testUser(t, connection, "ana")
+
+	user, err := connection.GetUser(ana)
+	if err != nil || user == nil {
+		t.Fatalf("user not found: %v", err)
+	}
+	claims := &OIDCClaims{Issuer: "https://id.example.com", Subject: RandomToken(8), Email: user.Email, EmailVerified: true}
+
+	if _, err := OIDCUser(connection, cfg, nil, claims); err != ErrOIDCEmailTaken {
+		t.Errorf("linked to an unverified email: %v", err)
+	}
+
+	if _, err := connection.VerifyEmail(ana, user.Email); err != nil {
+		t.Fatal(err)
+	}
+	if linked, err := OIDCUser(connection, cfg, nil, claims); err != nil || linked.ID != ana {
+		t.Errorf("verified email not linked: %+v, %v", linked, err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"sync"
+)
+
+// Bookmark event types
+const (
+	EventCreated = "created"
+	EventUpdated = "updated"
+	EventDeleted = "deleted"
+)
+
+// BookmarkEvent for JSON schema. For deleted bookmarks Bookmark holds the
+// last known value, which may only have its id and user.
+type BookmarkEvent struct {
+	Type     string    `json:"type"`
+	ID       string    `json:"id"`
+	User     string    `json:"-"`
+	Bookmark *Bookmark `json:"bookmark"`
+}
+
+// bookmarkChange is a changefeed entry of the bookmarks table
+type bookmarkChange struct {
+	NewValue *Bookmark `gorethink:"new_val"`
+	OldValue *Bookmark `gorethink:"old_val"`
+}
+
+// event converts a change into an event, returning false for entries that
+// do not describe a change such as the feed state
+func (c bookmarkChange) event() (BookmarkEvent, bool) {
+	switch {
+	case c.NewValue != nil && c.OldValue == nil:
+		return BookmarkEvent{Type: EventCreated, ID: c.NewValue.ID, User: c.NewValue.User, Bookmark: c.NewValue}, true
+	case c.NewValue != nil:
+		return BookmarkEvent{Type: EventUpdated, ID: c.NewValue.ID, User: c.NewValue.User, Bookmark: c.NewValue}, true
+	case c.OldValue != nil:
+		return BookmarkEvent{Type: EventDeleted, ID: c.OldValue.ID, User: c.OldValue.User, Bookmark: c.OldValue}, true
+	}
+
+	return BookmarkEvent{}, false
+}
+
+// Broadcaster delivers bookmark events to in-process subscribers. It is
+// used when the store cannot provide a changefeed.
+type Broadcaster struct {
+	mu          sync.Mutex
+	subscribers map[chan BookmarkEvent]string
+}
+
+// NewBroadcaster creates a broadcaster without subscribers
+func NewBroadcaster() *Broadcaster {
+	return &Broadcaster{subscribers: make(map[chan BookmarkEvent]string)}
+}
+
+// Subscribe returns a channel receiving the events of an user, or of every
+// user if userID is empty, and a function to stop receiving them
+func (b *Broadcaster) Subscribe(userID string) (<-chan BookmarkEvent, func()) {
+	events := make(chan BookmarkEvent, 64)
+
+	b.mu.Lock()
+	b.subscribers[events] = userID
+	b.mu.Unlock()
+
+	var once sync.Once
+	return events, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subscribers, events)
+			b.mu.Unlock()
+			close(events)
+		})
+	}
+}
+
+// Publish sends an event to the interested subscribers. Subscribers that
+// are not keeping up miss the event instead of blocking the publisher.
+func (b *Broadcaster) Publish(event BookmarkEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for events, userID := range b.subscribers {
+		if userID != "" && userID != event.User {
+			continue
+		}
+
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
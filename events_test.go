@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBookmarkChangeEvents(t *testing.T) {
+	old, updated := &Bookmark{ID: "b1", User: "ana", Version: 1}, &Bookmark{ID: "b1", User: "ana", Version: 2}
+
+	tests := []struct {
+		change bookmarkChange
+		kind   string
+		ok     bool
+	}{
+		{bookmarkChange{NewValue: updated}, EventCreated, true},
+		{bookmarkChange{NewValue: updated, OldValue: old}, EventUpdated, true},
+		{bookmarkChange{OldValue: old}, EventDeleted, true},
+		{bookmarkChange{}, "", false},
+	}
+
+	for _, test := range tests {
+		event, ok := test.change.event()
+		if ok != test.ok || event.Type != test.kind {
+			t.Errorf("%+v: %q, %v", test.change, event.Type, ok)
+		}
+		if ok && (event.ID != "b1" || event.User != "ana") {
+			t.Errorf("%s event of %q by %q", event.Type, event.ID, event.User)
+		}
+	}
+}
+
+func TestBroadcasterDeliversToTheUser(t *testing.T) {
+	broadcaster := NewBroadcaster()
+	ana, cancelAna := broadcaster.Subscribe("ana")
+	everyone, cancelEveryone := broadcaster.Subscribe("")
+	defer cancelEveryone()
+
+	broadcaster.Publish(BookmarkEvent{Type: EventCreated, ID: "b1", User: "luis"})
+	broadcaster.Publish(BookmarkEvent{Type: EventCreated, ID: "b2", User: "ana"})
+
+	if event := <-ana; event.ID != "b2" {
+		t.Errorf("ana got the event of %s", event.User)
+	}
+	if first, second := <-everyone, <-everyone; first.ID != "b1" || second.ID != "b2" {
+		t.Errorf("events %s and %s to every user", first.ID, second.ID)
+	}
+
+	cancelAna()
+	cancelAna()
+	if _, open := <-ana; open {
+		t.Error("channel open after cancelling")
+	}
+	broadcaster.Publish(BookmarkEvent{Type: EventCreated, ID: "b3", User: "ana"})
+}
+
+func TestBroadcasterSkipsSlowSubscribers(t *testing.T) {
+	broadcaster := NewBroadcaster()
+	events, cancel := broadcaster.Subscribe("ana")
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			broadcaster.Publish(BookmarkEvent{Type: EventUpdated, ID: "b1", User: "ana"})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publishing blocked on a subscriber not reading")
+	}
+	if len(events) != cap(events) {
+		t.Errorf("%d events buffered, want %d", len(events), cap(events))
+	}
+}
+
+// streamEvents starts APIEventsHandler and returns the stream once the
+// handler subscribed
+func streamEvents(t *testing.T, connection *Connection, cfg *Config, shutdown Shutdown) *bufio.Reader {
+	_, cs := testCookieStore()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		APIEventsHandler(req, w, cs, connection, cfg, shutdown)
+	}))
+	t.Cleanup(server.Close)
+
+	response, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { response.Body.Close() })
+
+	if response.StatusCode != 200 || response.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status %d, content type %q", response.StatusCode, response.Header.Get("Content-Type"))
+	}
+
+	stream := bufio.NewReader(response.Body)
+	if line, err := stream.ReadString('\n'); err != nil || line != "retry: 5000\n" {
+		t.Fatalf("first line %q, %v", line, err)
+	}
+	stream.ReadString('\n')
+	return stream
+}
+
+func TestAPIEventsHandlerStreamsEvents(t *testing.T) {
+	connection := &Connection{events: NewBroadcaster()}
+	shutdown := make(Shutdown)
+	stream := streamEvents(t, connection, &Config{}, shutdown)
+
+	connection.events.Publish(BookmarkEvent{Type: EventCreated, ID: "b1", User: "ana", Bookmark: &Bookmark{ID: "b1", Title: "Magnet"}})
+
+	if line, _ := stream.ReadString('\n'); line != "event: created\n" {
+		t.Errorf("event line %q", line)
+	}
+	line, _ := stream.ReadString('\n')
+	var event struct {
+		Type     string   `json:"type"`
+		ID       string   `json:"id"`
+		User     string   `json:"User"`
+		Bookmark Bookmark `json:"bookmark"`
+	}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event); err != nil {
+		t.Fatalf("data line %q: %v", line, err)
+	}
+	if event.Type != EventCreated || event.ID != "b1" || event.Bookmark.Title != "Magnet" || event.User != "" {
+		t.Errorf("event %+v", event)
+	}
+
+	close(shutdown)
+	if rest, err := io.ReadAll(stream); err != nil || strings.Contains(string(rest), "event:") {
+		t.Errorf("stream after shutting down: %q, %v", rest, err)
+	}
+}
+
+func TestAPIEventsHandlerEndsBeforeWriteTimeout(t *testing.T) {
+	connection := &Connection{events: NewBroadcaster()}
+	stream := streamEvents(t, connection, &Config{WriteTimeout: 2}, make(Shutdown))
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(stream)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream still open after the write timeout")
+	}
+}
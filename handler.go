@@ -1,23 +1,39 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"github.com/codegangsta/martini"
 	"github.com/gorilla/sessions"
 	"github.com/hoisie/mustache"
 	"github.com/justinas/nosurf"
+	"log"
 	"net/http"
 	"net/url"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
 )
 
-func Start(DB *Connection, config *Config) {
+// Start serves Magnet until the process is told to stop, then finishes
+// the running requests and the emails being sent
+func Start(DB *Connection, config *Config) error {
 	// Create a new cookie store
-	store := sessions.NewCookieStore([]byte(config.SecretKey))
+	store := NewCookieStore(config)
 
-	m := martini.Classic()
+	// Like martini.Classic, logging requests with their ids
+	router := martini.NewRouter()
+	m := &martini.ClassicMartini{Martini: martini.New(), Router: router}
+	m.Logger(log.New(defaultLogger.Writer(LevelError), "", 0))
+	m.Use(RequestLogger)
+
+	// It will be available to all handlers as *Metrics. It comes before the
+	// recovery so requests that panic are counted as 500s.
+	m.Map(DB.metrics)
+	m.Use(MetricsMiddleware)
+	m.Use(martini.Recovery())
+	m.MapTo(router, (*martini.Routes)(nil))
+	m.Action(router.Handle)
 
 	// It will be available to all handlers as *sessions.CookieStore
 	m.Map(store)
@@ -28,8 +44,93 @@ func Start(DB *Connection, config *Config) {
 	// It will be available to all handlers as *Config
 	m.Map(config)
 
+	// It will be available to all handlers as *Mailer
+	mailer := NewMailer(config)
+	m.Map(mailer)
+
+	// It will be available to all handlers as Shutdown
+	shutdown := make(Shutdown)
+	m.Map(shutdown)
+
+	// Instance wide counts for /metrics, refreshed in the background
+	go WatchInstanceStats(DB, instanceStatsInterval, shutdown)
+
+	// It will be available to all handlers as *LoginThrottle
+	m.Map(NewLoginThrottle(config))
+
+	// It will be available to all handlers as *LDAPDirectory, nil unless
+	// logins are checked against a directory
+	m.Map(NewLDAPDirectory(config))
+	m.Map(NewRegistration(config))
+
+	// Single sign-on, if an OpenID Connect provider is configured
+	provider := NewOIDCProvider(config)
+	if provider != nil {
+		m.Map(provider)
+	}
+
 	// public folder will serve the static content
-	m.Use(martini.Static("public"))
+	m.Use(martini.Static("public", martini.StaticOptions{SkipLogging: true}))
+
+	RegisterRoutes(m, provider != nil)
+
+	// Check the routes against the OpenAPI document
+	spec, err := LoadOpenAPISpec(OpenAPISpecPath)
+	if err != nil {
+		defaultLogger.Error("OpenAPI document not loaded", "err", err)
+	} else {
+		for _, problem := range spec.CheckRoutes(m.All()) {
+			defaultLogger.Warn("route does not match the OpenAPI document", "problem", problem)
+		}
+
+		if config.ValidateAPI {
+			m.Use(OpenAPIValidator(spec))
+		}
+	}
+
+	csrfHandler := nosurf.New(m)
+	csrfHandler.SetFailureHandler(http.HandlerFunc(CsrfFailHandler))
+	csrfHandler.SetBaseCookie(http.Cookie{
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   config.SecureCookies(),
+		SameSite: cookieSameSite[config.CookieSameSite],
+		MaxAge:   nosurf.MaxAge,
+	})
+
+	proxies, err := ParseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		return err
+	}
+
+	server := NewHTTPServer(TrustedProxies(proxies, HSTS(config.HSTSMaxAge, SecurityHeaders(config, csrfHandler))), config)
+	servers := []*http.Server{server}
+
+	// Serve HTTPS, with the certificate reloaded when renewed
+	if config.TLSEnabled() {
+		reloader, err := NewCertReloader(config.TLSCert, config.TLSKey)
+		if err != nil {
+			return err
+		}
+		server.TLSConfig = reloader.TLSConfig()
+
+		if config.TLSRedirectPort != "" {
+			servers = append(servers, NewRedirectServer(config))
+		}
+	}
+
+	err = Serve(shutdown, time.Duration(config.ShutdownTimeout)*time.Second, servers...)
+	mailer.Wait()
+	return err
+}
+
+// RegisterRoutes adds every route of Magnet to m. The single sign-on routes
+// are only added with an OpenID Connect provider.
+func RegisterRoutes(m martini.Router, oidc bool) {
+	if oidc {
+		m.Get("/login/oidc", OIDCLoginHandler)
+		m.Get("/login/oidc/callback", OIDCCallbackHandler)
+	}
 
 	// Tag-related routes
 	m.Get("/tag/:tag/:page", AuthRequired, GetTagHandler)
@@ -43,46 +144,137 @@ func Start(DB *Connection, config *Config) {
 	// Search
 	m.Post("/search/:page", AuthRequired, SearchHandler)
 
+	// Saved searches
+	m.Get("/saved_searches", AuthRequired, GetSavedSearchesHandler)
+	m.Post("/saved_search/new", AuthRequired, NewSavedSearchHandler)
+	m.Delete("/saved_search/delete/:search", AuthRequired, DeleteSavedSearchHandler)
+	m.Get("/saved_search/:search/:page", AuthRequired, SavedSearchHandler)
+
+	// JSON REST API
+	m.Get("/api/v2/csrf", APICSRFTokenHandler)
+	m.Group("/api/v2", func(api martini.Router) {
+		api.Get("/bookmarks", APIListBookmarksHandler)
+		api.Post("/bookmarks", APICreateBookmarkHandler)
+		api.Get("/bookmarks/:bookmark", APIGetBookmarkHandler)
+		api.Patch("/bookmarks/:bookmark", APIUpdateBookmarkHandler)
+		api.Delete("/bookmarks/:bookmark", APIDeleteBookmarkHandler)
+		api.Get("/tags", APIListTagsHandler)
+		api.Get("/events", APIEventsHandler)
+		api.Get("/sync", APISyncHandler)
+		api.Post("/sync", APISyncPushHandler)
+		api.Get("/webhooks", APIListWebhooksHandler)
+		api.Post("/webhooks", APICreateWebhookHandler)
+		api.Delete("/webhooks/:webhook", APIDeleteWebhookHandler)
+		api.Get("/webhooks/:webhook/deliveries", APIWebhookDeliveriesHandler)
+		api.Get("/saved_searches", APIListSavedSearchesHandler)
+		api.Get("/saved_searches/:search/bookmarks", APISavedSearchBookmarksHandler)
+		api.Get("/sessions", APIListSessionsHandler)
+		api.Delete("/sessions", APIRevokeOtherSessionsHandler)
+		api.Delete("/sessions/:session", APIRevokeSessionHandler)
+		api.Get("/account", APIAccountHandler)
+		api.Patch("/account", APIUpdateAccountHandler)
+		api.Delete("/account", APIDeleteAccountHandler)
+		api.Post("/account/password", APIChangePasswordHandler)
+		api.Post("/account/email", APIChangeEmailHandler)
+		api.Get("/account/export", APIExportHandler)
+		api.Get("/invites", APIListInvitesHandler)
+		api.Post("/invites", APINewInviteHandler)
+		api.Delete("/invites/:invite", APIDeleteInviteHandler)
+		api.Get("/admin/stats", APIAdminRequired, APIAdminStatsHandler)
+		api.Get("/admin/users", APIAdminRequired, APIAdminListUsersHandler)
+		api.Patch("/admin/users/:user", APIAdminRequired, APIAdminUpdateUserHandler)
+		api.Delete("/admin/users/:user", APIAdminRequired, APIAdminDeleteUserHandler)
+		api.Post("/admin/users/:user/password", APIAdminRequired, APIAdminResetPasswordHandler)
+	}, APIAuthRequired)
+
 	// User-related routes
 	m.Post("/login", LoginPostHandler)
+	m.Post("/login/2fa", LoginTwoFactorHandler)
 	m.Get("/logout", AuthRequired, LogoutHandler)
 	m.Post("/signup", SignUpHandler)
 	m.Post("/new_token", AuthRequired, RequestNewToken)
 
+	// Sessions
+	m.Get("/account", AuthRequired, AccountHandler)
+	m.Post("/account/username", AuthRequired, ChangeUsernameHandler)
+	m.Post("/account/password", AuthRequired, ChangePasswordHandler)
+	m.Post("/account/email", AuthRequired, ChangeEmailHandler)
+	m.Get("/account/email/confirm/:token", ConfirmEmailHandler)
+	m.Get("/account/export", AuthRequired, ExportHandler)
+	m.Post("/account/delete", AuthRequired, DeleteAccountHandler)
+	m.Get("/account/invites", AuthRequired, InvitesHandler)
+	m.Post("/account/invites", AuthRequired, NewInviteHandler)
+	m.Delete("/account/invites/:invite", AuthRequired, DeleteInviteHandler)
+	m.Get("/account/sessions", AuthRequired, SessionsHandler)
+	m.Delete("/account/sessions", AuthRequired, RevokeOtherSessionsHandler)
+	m.Delete("/account/sessions/:session", AuthRequired, RevokeSessionHandler)
+
+	// Administration
+	m.Get("/admin", AdminRequired, AdminHandler)
+	m.Post("/admin/users/:user/disable", AdminRequired, AdminDisableUserHandler)
+	m.Post("/admin/users/:user/enable", AdminRequired, AdminEnableUserHandler)
+	m.Post("/admin/users/:user/admin", AdminRequired, AdminSetAdminHandler)
+	m.Post("/admin/users/:user/password", AdminRequired, AdminResetPasswordHandler)
+	m.Delete("/admin/users/:user", AdminRequired, AdminDeleteUserHandler)
+
+	// Two-factor authentication
+	m.Get("/account/2fa", AuthRequired, TwoFactorHandler)
+	m.Post("/account/2fa/enable", AuthRequired, EnableTwoFactorHandler)
+	m.Post("/account/2fa/disable", AuthRequired, DisableTwoFactorHandler)
+	m.Post("/account/2fa/recovery_codes", AuthRequired, RecoveryCodesHandler)
+
+	// Email verification and password reset
+	m.Get("/verify/:token", VerifyEmailHandler)
+	m.Post("/verify/resend", AuthRequired, ResendVerificationHandler)
+	m.Get("/password/forgot", ForgotPasswordHandler)
+	m.Post("/password/forgot", ForgotPasswordPostHandler)
+	m.Get("/password/reset/:token", ResetPasswordHandler)
+	m.Post("/password/reset/:token", ResetPasswordPostHandler)
+
+	// Probes and monitoring
+	m.Get("/healthz", HealthHandler)
+	m.Get("/readyz", ReadyHandler)
+	m.Get("/metrics", MetricsHandler)
+
 	// Test
 	m.Get("/test", TestHandler)
 
 	// Home
-	m.Get("/", func(cs *sessions.CookieStore, req *http.Request, w http.ResponseWriter, connection *Connection) {
-		if GetUserID(cs, req, connection) == "" {
-			LoginHandler(req, w)
+	m.Get("/", func(cs *sessions.CookieStore, req *http.Request, w http.ResponseWriter, connection *Connection, cfg *Config, directory *LDAPDirectory, registration *Registration) {
+		if GetUserID(cs, req, connection, cfg) == "" {
+			LoginHandler(req, w, cfg, directory, registration)
 		}
 	}, IndexHandler)
-
-	csrfHandler := nosurf.New(m)
-	csrfHandler.SetFailureHandler(http.HandlerFunc(CsrfFailHandler))
-
-	http.ListenAndServe(config.Port, csrfHandler)
 }
 
 // CsrfFailHandler writes invalid token response
 func CsrfFailHandler(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		WriteAPIError(NewAPIError(403, APIErrCsrf, "Provided token is not valid."), w)
+		return
+	}
 	WriteJSONResponse(200, true, "Provided token is not valid.", r, w)
 }
 
 // GetBookmarksHandler writes bookmarks to JSON data
 func GetBookmarksHandler(params martini.Params, req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection) {
-	_, userID := GetUserData(cs, req)
+	userID := SessionUserID(cs, req, connection)
 	page, _ := strconv.ParseInt(params["page"], 10, 16)
-	bookmarks := GetBookmarks(page, connection, userID)
+	bookmarks, err := GetBookmarks(page, connection, userID)
+	if err != nil {
+		WriteJSONResponse(200, true, "Error getting bookmarks.", req, w)
+		return
+	}
 	JSONDataResponse(200, false, bookmarks, req, w)
 }
 
 // IndexHandler writes out templates
-func IndexHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection) {
-	username, userID := GetUserData(cs, req)
+func IndexHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection, registration *Registration) {
+	username, userID := GetUserData(cs, req, connection)
+	user, _ := connection.GetUser(userID)
 
-	var bookmarks = GetBookmarks(0, connection, userID)
+	// A failed query is logged by the store, the page shows no bookmarks
+	bookmarks, _ := GetBookmarks(0, connection, userID)
 	for i, bookmark := range bookmarks {
 		if len(bookmark.URL) > 50 {
 			bookmarks[i].URL = bookmark.URL[:50] + "..."
@@ -94,7 +286,10 @@ func IndexHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieS
 		"csrf_token": nosurf.Token(req),
 		"bookmarks":  bookmarks,
 		"tags":       GetTags(connection, userID),
+		"searches":   GetSavedSearches(connection, userID),
 		"username":   username,
+		"admin":      user != nil && user.Admin,
+		"can_invite": user != nil && registration.CanInvite(user),
 	}
 
 	context["load_more"] = len(context["bookmarks"].([]Bookmark)) == 50
@@ -109,24 +304,16 @@ func TestHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieSt
 
 // NewBookmarkHandler writes out new bookmark JSON response
 func NewBookmarkHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection) {
-	// We use a map instead of Bookmark because id would be ""
-	bookmark := make(map[string]interface{})
-	bookmark["Title"], _ = url.QueryUnescape(req.PostFormValue("title"))
-	bookmark["Url"], _ = url.QueryUnescape(req.PostFormValue("url"))
-	if !IsValidURL(bookmark["Url"].(string)) || len(bookmark["Title"].(string)) < 1 {
+	title, _ := url.QueryUnescape(req.PostFormValue("title"))
+	bookmarkURL, _ := url.QueryUnescape(req.PostFormValue("url"))
+	if !IsValidURL(bookmarkURL) || len(title) < 1 {
 		WriteJSONResponse(200, true, "The url is not valid or the title is empty.", req, w)
 	} else {
-		_, userID := GetUserData(cs, req)
+		userID := SessionUserID(cs, req, connection)
 		tags, _ := url.QueryUnescape(req.PostFormValue("tags"))
-		if tags != "" {
-			bookmark["Tags"] = strings.Split(tags, ",")
-			for i, v := range bookmark["Tags"].([]string) {
-				bookmark["Tags"].([]string)[i] = strings.ToLower(strings.TrimSpace(v))
-			}
-		}
-		bookmark["Created"] = float64(time.Now().Unix())
-		bookmark["Date"] = time.Unix(int64(bookmark["Created"].(float64)), 0).Format("Jan 2, 2006 at 3:04pm")
-		bookmark["User"] = userID
+		bookmark := NewBookmarkDocument(userID, title, bookmarkURL, ParseTags(tags))
+		bookmark["Unread"] = req.PostFormValue("unread") == "true"
+		bookmark["Private"] = req.PostFormValue("private") == "true"
 
 		response, _ := connection.NewBookmark(userID, bookmark)
 
@@ -138,46 +325,77 @@ func NewBookmarkHandler(req *http.Request, w http.ResponseWriter, cs *sessions.C
 	}
 }
 
-// EditBookmarkHandler writes out response to editing a URL
+// EditBookmarkHandler writes out response to editing a bookmark. Only the
+// supplied fields change.
 func EditBookmarkHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection, params martini.Params) {
-	// We use a map instead of Bookmark because id would be ""
-	bookmark := make(map[string]interface{})
-	bookmark["Title"], _ = url.QueryUnescape(req.PostFormValue("title"))
-	bookmark["Url"], _ = url.QueryUnescape(req.PostFormValue("url"))
+	req.ParseForm()
+	edit := &BookmarkEdit{Fields: make(map[string]interface{})}
+	valid := true
+
+	if _, ok := req.PostForm["title"]; ok {
+		title, _ := url.QueryUnescape(req.PostFormValue("title"))
+		valid = valid && len(title) > 0
+		edit.Fields["Title"] = title
+	}
 
-	if !IsValidURL(bookmark["Url"].(string)) || len(bookmark["Title"].(string)) < 1 {
+	if _, ok := req.PostForm["url"]; ok {
+		bookmarkURL, _ := url.QueryUnescape(req.PostFormValue("url"))
+		valid = valid && IsValidURL(bookmarkURL)
+		edit.Fields["URL"] = bookmarkURL
+	}
+
+	if _, ok := req.PostForm["tags"]; ok {
+		tags, _ := url.QueryUnescape(req.PostFormValue("tags"))
+		edit.Fields["Tags"] = ParseTags(tags)
+	}
+
+	addTags, _ := url.QueryUnescape(req.PostFormValue("add_tags"))
+	edit.AddTags = ParseTags(addTags)
+	removeTags, _ := url.QueryUnescape(req.PostFormValue("remove_tags"))
+	edit.RemoveTags = ParseTags(removeTags)
+
+	version, versionOk := RequestVersion(req)
+	edit.Version = version
+
+	if !valid {
 		WriteJSONResponse(200, true, "The url is not valid or the title is empty.", req, w)
+	} else if !versionOk {
+		WriteJSONResponse(200, true, "The bookmark version is not valid.", req, w)
 	} else {
-		_, userID := GetUserData(cs, req)
-		tags, _ := url.QueryUnescape(req.PostFormValue("tags"))
-		if tags != "" {
-			bookmark["Tags"] = strings.Split(tags, ",")
-			for i, v := range bookmark["Tags"].([]string) {
-				bookmark["Tags"].([]string)[i] = strings.ToLower(strings.TrimSpace(v))
-			}
-		}
+		userID := SessionUserID(cs, req, connection)
 
-		response, err := connection.EditBookmark(userID, params, bookmark)
+		response, err := connection.EditBookmark(userID, params, edit)
 
-		if err != nil {
-			WriteJSONResponse(200, true, "Error deleting bookmark.", req, w)
-		} else {
-			if response.Updated > 0 || response.Unchanged > 0 || response.Replaced > 0 {
-				WriteJSONResponse(200, false, "Bookmark updated successfully.", req, w)
-			} else {
-				WriteJSONResponse(200, true, "Error updating bookmark.", req, w)
+		if err == ErrVersionConflict {
+			WriteJSONResponse(200, true, "The bookmark was changed somewhere else, reload to get the latest version.", req, w)
+		} else if err != nil {
+			WriteJSONResponse(200, true, "Error updating bookmark.", req, w)
+		} else if response.Replaced > 0 || response.Unchanged > 0 || response.Updated > 0 {
+			if bookmark, err := connection.GetBookmark(userID, params); err == nil && bookmark != nil {
+				w.Header().Set("ETag", BookmarkETag(bookmark.Version))
 			}
+			WriteJSONResponse(200, false, "Bookmark updated successfully.", req, w)
+		} else {
+			WriteJSONResponse(200, true, "Error updating bookmark.", req, w)
 		}
 	}
 }
 
 // DeleteBookmarkHandler writes out response to deleting a bookmark
 func DeleteBookmarkHandler(params martini.Params, req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection) {
-	_, userID := GetUserData(cs, req)
+	userID := SessionUserID(cs, req, connection)
+	version, versionOk := RequestVersion(req)
+
+	if !versionOk {
+		WriteJSONResponse(200, true, "The bookmark version is not valid.", req, w)
+		return
+	}
 
-	response, err := connection.DeleteBookmark(userID, params)
+	response, err := connection.DeleteBookmark(userID, params, version)
 
-	if err != nil {
+	if err == ErrVersionConflict {
+		WriteJSONResponse(200, true, "The bookmark was changed somewhere else, reload to get the latest version.", req, w)
+	} else if err != nil {
 		WriteJSONResponse(200, true, "Error deleting bookmark.", req, w)
 	} else {
 		if response.Deleted > 0 {
@@ -190,7 +408,7 @@ func DeleteBookmarkHandler(params martini.Params, req *http.Request, w http.Resp
 
 // SearchHandler writes out response when searching for a URL
 func SearchHandler(params martini.Params, req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection) {
-	_, userID := GetUserData(cs, req)
+	userID := SessionUserID(cs, req, connection)
 	query, _ := url.QueryUnescape(req.PostFormValue("query"))
 
 	response, err := connection.Search(userID, params, query)
@@ -204,7 +422,7 @@ func SearchHandler(params martini.Params, req *http.Request, w http.ResponseWrit
 
 // GetTagHandler fetches books for a given tag
 func GetTagHandler(params martini.Params, req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection) {
-	_, userID := GetUserData(cs, req)
+	userID := SessionUserID(cs, req, connection)
 
 	response, err := connection.GetTag(userID, params)
 
@@ -215,96 +433,976 @@ func GetTagHandler(params martini.Params, req *http.Request, w http.ResponseWrit
 	}
 }
 
+// GetSavedSearchesHandler writes out the saved searches of the user
+func GetSavedSearchesHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection) {
+	userID := SessionUserID(cs, req, connection)
+
+	response, err := connection.GetSavedSearches(userID)
+
+	if err != nil {
+		WriteJSONResponse(200, true, "Error retrieving saved searches.", req, w)
+	} else {
+		JSONDataResponse(200, false, response, req, w)
+	}
+}
+
+// NewSavedSearchHandler writes out new saved search JSON response
+func NewSavedSearchHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection) {
+	search := SavedSearchFromForm(req)
+
+	if errors := search.Validate(); errors != "" {
+		WriteJSONResponse(200, true, errors, req, w)
+	} else {
+		search.User = SessionUserID(cs, req, connection)
+		search.Created = float64(time.Now().Unix())
+
+		response, _ := connection.NewSavedSearch(search)
+
+		if response.Inserted > 0 {
+			WriteJSONResponse(200, false, response.GeneratedKeys[0], req, w)
+		} else {
+			WriteJSONResponse(200, true, "Error saving search.", req, w)
+		}
+	}
+}
+
+// DeleteSavedSearchHandler writes out response to deleting a saved search
+func DeleteSavedSearchHandler(params martini.Params, req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection) {
+	userID := SessionUserID(cs, req, connection)
+
+	response, err := connection.DeleteSavedSearch(userID, params)
+
+	if err != nil || response.Deleted < 1 {
+		WriteJSONResponse(200, true, "Error deleting saved search.", req, w)
+	} else {
+		WriteJSONResponse(200, false, "Saved search deleted successfully.", req, w)
+	}
+}
+
+// SavedSearchHandler writes out the bookmarks matching a saved search
+func SavedSearchHandler(params martini.Params, req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection) {
+	userID := SessionUserID(cs, req, connection)
+
+	search, err := connection.GetSavedSearch(userID, params)
+
+	if err != nil {
+		WriteJSONResponse(200, true, "Error retrieving saved search.", req, w)
+	} else if search == nil {
+		WriteJSONResponse(200, true, "Saved search not found.", req, w)
+	} else {
+		page, _ := strconv.ParseInt(params["page"], 10, 16)
+		response, err := connection.FilterBookmarks(search, page)
+
+		if err != nil {
+			WriteJSONResponse(200, true, "Error retrieving bookmarks", req, w)
+		} else {
+			JSONDataResponse(200, false, response, req, w)
+		}
+	}
+}
+
 // LoginHandler writes out login template
-func LoginHandler(r *http.Request, w http.ResponseWriter) {
+func LoginHandler(r *http.Request, w http.ResponseWriter, cfg *Config, directory *LDAPDirectory, registration *Registration) {
 	context := map[string]interface{}{
-		"title":      "Access magnet",
-		"csrf_token": nosurf.Token(r),
+		"title":          "Access magnet",
+		"csrf_token":     nosurf.Token(r),
+		"password_login": cfg.PasswordLogin || directory != nil,
+		"sign_up":        directory == nil && !registration.Closed(),
+		"invite":         r.URL.Query().Get("invite"),
+		"two_factor":     r.URL.Query().Get("two_factor") == "1",
+		"oidc":           cfg.OIDCIssuer != "",
+		"oidc_button":    cfg.OIDCButton,
 	}
 	w.Write([]byte(mustache.RenderFileInLayout("templates/login.mustache", "templates/base.mustache", context)))
 }
 
-// LoginPostHandler writes out login response
-func LoginPostHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, cfg *Config, connection *Connection) {
+// LoginPostHandler writes out login response. Users with two-factor
+// authentication get a pending login to finish with LoginTwoFactorHandler.
+func LoginPostHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, cfg *Config, connection *Connection, throttle *LoginThrottle, directory *LDAPDirectory, logger *Logger) {
 	username := req.PostFormValue("username")
-	password := cryptPassword(req.PostFormValue("password"), cfg.SecretKey)
+	ipKey := IPThrottleKey("login", req)
+	userKey := UserThrottleKey("login", username)
 
-	var response []interface{}
+	// Directory logins are not local password logins
+	if !cfg.PasswordLogin && directory == nil {
+		WriteJSONResponse(200, true, "Password login is disabled.", req, w)
+		return
+	}
 
-	response, err := connection.LoginPost(username, password)
+	if wait := throttle.Wait(ipKey, userKey); wait > 0 {
+		WriteThrottledResponse(wait, req, w)
+		return
+	}
+
+	var user *User
+	var entry *LDAPEntry
+	var err error
 
-	if err != nil || len(response) == 0 {
+	if directory != nil {
+		entry, err = directory.Authenticate(username, req.PostFormValue("password"))
+		if err == nil {
+			user, err = LDAPUser(connection, entry)
+		} else if err != ErrLDAPInvalidCredentials && err != ErrLDAPNotAllowed {
+			logger.Error("directory login failed", "username", username, "err", err)
+		}
+	} else {
+		user, err = connection.LoginPost(username, cryptPassword(req.PostFormValue("password"), cfg.PasswordKey()))
+	}
+
+	if err == ErrLDAPNotAllowed || (err == nil && user != nil && user.Disabled) {
+		WriteJSONResponse(200, true, "Your account is not allowed to use magnet.", req, w)
+	} else if err == ErrLDAPUsernameTaken {
+		logger.Warn("directory user not linked, the username is taken", "username", username, "dn", entry.DN)
+		WriteJSONResponse(200, true, "Your username belongs to another account, ask an administrator.", req, w)
+	} else if err != nil || user == nil {
+		if throttle.Fail(ipKey, cfg.IPLockoutFailures) {
+			Audit(connection, AuditLoginLockout, "", ClientIP(req), "too many failed logins from this address")
+		}
+		if throttle.Fail(userKey, cfg.LockoutFailures) {
+			Audit(connection, AuditLoginLockout, username, ClientIP(req), "too many failed logins for this username")
+		}
 		WriteJSONResponse(200, true, "Invalid username or password.", req, w)
+	} else if user.DomainSignUp && !user.EmailVerified {
+		WriteJSONResponse(200, true, "Verify your email address before logging in.", req, w)
 	} else {
-		// Store session
-		userID := response[0].(map[string]interface{})["id"].(string)
-		session := Session{UserID: userID,
-			Expires: time.Now().Unix() + int64(cfg.SessionExpires)}
+		throttle.Reset(ipKey)
+		throttle.Reset(userKey)
+
+		if user.TOTPEnabled {
+			pending := map[string]string{"user_id": user.ID, "username": user.Username}
+			if err := StartFlow(cs, req, w, connection, pending, TwoFactorExpires); err != nil {
+				WriteJSONResponse(200, true, "Error creating the user session.", req, w)
+				return
+			}
+			JSONDataResponse(200, false, map[string]interface{}{"two_factor": true}, req, w)
+			return
+		}
 
-		response, err := connection.LoginPostInsertSession(session)
+		StartSession(user.ID, req, w, cs, cfg, connection)
+	}
+}
 
-		if err != nil || response.Inserted < 1 {
-			WriteJSONResponse(200, true, "Error creating the user session.", req, w)
-		} else {
-			session, _ := cs.Get(req, "magnet_session")
-			session.Values["session_id"] = response.GeneratedKeys[0]
-			session.Values["username"] = username
-			session.Values["user_id"] = userID
-			session.Save(req, w)
-			WriteJSONResponse(200, false, "User correctly logged in.", req, w)
+// LoginTwoFactorHandler finishes a pending login with a TOTP or recovery code
+func LoginTwoFactorHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, cfg *Config, connection *Connection, throttle *LoginThrottle) {
+	pending := FlowData(cs, req, connection)
+	userID, username := pending["user_id"], pending["username"]
+
+	if userID == "" {
+		WriteJSONResponse(200, true, "The login has expired, enter your password again.", req, w)
+		return
+	}
+
+	// Codes are short, so they are throttled on their own
+	userKey := UserThrottleKey("2fa", username)
+	if wait := throttle.Wait(userKey); wait > 0 {
+		WriteThrottledResponse(wait, req, w)
+		return
+	}
+
+	user, err := connection.GetUser(userID)
+
+	if err != nil || user == nil || !user.TOTPEnabled || user.Disabled {
+		WriteJSONResponse(200, true, "The login has expired, enter your password again.", req, w)
+	} else if !CheckTwoFactorCode(connection, user, req.PostFormValue("code")) {
+		if throttle.Fail(userKey, cfg.LockoutFailures) {
+			Audit(connection, AuditLoginLockout, username, ClientIP(req), "too many invalid two-factor codes")
 		}
+		WriteJSONResponse(200, true, "Invalid authentication code.", req, w)
+	} else {
+		throttle.Reset(userKey)
+		StartSession(userID, req, w, cs, cfg, connection)
 	}
 }
 
-// LogoutHandler writes out logout response
-func LogoutHandler(cs *sessions.CookieStore, req *http.Request, connection *Connection, w http.ResponseWriter) {
-	session, _ := cs.Get(req, "magnet_session")
+// StartSession stores a new session for an user who has logged in
+func StartSession(userID string, req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, cfg *Config, connection *Connection) {
+	if err := createSession(userID, req, w, cs, cfg, connection); err != nil {
+		WriteJSONResponse(200, true, "Error creating the user session.", req, w)
+	} else {
+		WriteJSONResponse(200, false, "User correctly logged in.", req, w)
+	}
+}
+
+// createSession stores a new session and points the session cookie to it,
+// deleting the session the request had, such as that of a login flow
+func createSession(userID string, req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, cfg *Config, connection *Connection) error {
+	if sessionID := CurrentSessionID(cs, req); sessionID != "" {
+		connection.Logout(sessionID)
+	}
+
+	token, session := NewSession(userID, req, time.Duration(cfg.SessionExpires)*time.Second, nil)
+	response, err := connection.LoginPostInsertSession(session)
+
+	if err != nil {
+		return err
+	}
+	if response.Inserted < 1 {
+		return errors.New("session not inserted")
+	}
+
+	return SetSessionCookie(cs, req, w, token)
+}
 
-	_, _ = connection.Logout(session)
+// renewSession gives a new session to a client whose sessions were closed,
+// as changing the password does. Requests without a session cookie get
+// none, so a client that wasn't logged in by the cookie stays that way.
+func renewSession(userID string, req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, cfg *Config, connection *Connection) error {
+	if CurrentSessionID(cs, req) == "" {
+		return nil
+	}
+
+	return createSession(userID, req, w, cs, cfg, connection)
+}
+
+// OIDCLoginHandler sends the user to the OpenID Connect provider
+func OIDCLoginHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection, provider *OIDCProvider, logger *Logger) {
+	state, nonce, verifier := RandomToken(16), RandomToken(16), RandomToken(32)
+
+	authURL, err := provider.AuthURL(state, nonce, verifier)
+	if err != nil {
+		logger.Error("single sign-on failed", "err", err)
+		MessageHandler("Single sign-on", "The identity provider is not available, try again later.", w)
+		return
+	}
 
-	session.Values["user_id"] = ""
-	session.Values["session_id"] = ""
-	session.Values["username"] = ""
-	session.Save(req, w)
+	flow := map[string]string{"oidc_state": state, "oidc_nonce": nonce, "oidc_verifier": verifier}
+	if err := StartFlow(cs, req, w, connection, flow, flowExpires); err != nil {
+		MessageHandler("Single sign-on", "Error creating the user session.", w)
+		return
+	}
+
+	http.Redirect(w, req, authURL, http.StatusFound)
+}
+
+// OIDCCallbackHandler logs in the user the provider sends back, finding or
+// creating the matching user
+func OIDCCallbackHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, cfg *Config, connection *Connection, provider *OIDCProvider, registration *Registration, logger *Logger) {
+	flow := FlowData(cs, req, connection)
+	state, nonce, verifier := flow["oidc_state"], flow["oidc_nonce"], flow["oidc_verifier"]
+	EndSession(cs, req, w, connection)
+
+	query := req.URL.Query()
+	if query.Get("error") != "" {
+		MessageHandler("Single sign-on", "The identity provider did not log you in: "+query.Get("error")+".", w)
+		return
+	}
+
+	if state == "" || query.Get("state") != state {
+		MessageHandler("Single sign-on", "The login has expired, try again.", w)
+		return
+	}
+
+	claims, err := provider.Exchange(query.Get("code"), verifier, nonce)
+	if err != nil {
+		logger.Error("single sign-on failed", "err", err)
+		MessageHandler("Single sign-on", "The login could not be verified, try again.", w)
+		return
+	}
+
+	user, err := OIDCUser(connection, cfg, registration, claims)
+	switch {
+	case err == ErrOIDCUnknownUser:
+		MessageHandler("Single sign-on", "There is no Magnet account for you, ask an administrator to create one.", w)
+	case err == ErrOIDCEmailTaken:
+		MessageHandler("Single sign-on", "Your email belongs to another Magnet account, log in with its password.", w)
+	case err != nil:
+		MessageHandler("Single sign-on", "Error retrieving the user.", w)
+	case user.Disabled:
+		MessageHandler("Single sign-on", "Your account is not allowed to use magnet.", w)
+	case user.TOTPEnabled:
+		// The provider vouches for the password, not for the second factor
+		pending := map[string]string{"user_id": user.ID, "username": user.Username}
+		if err := StartFlow(cs, req, w, connection, pending, TwoFactorExpires); err != nil {
+			MessageHandler("Single sign-on", "Error creating the user session.", w)
+			return
+		}
+		http.Redirect(w, req, "/?two_factor=1", http.StatusFound)
+	default:
+		if err := createSession(user.ID, req, w, cs, cfg, connection); err != nil {
+			MessageHandler("Single sign-on", "Error creating the user session.", w)
+			return
+		}
+		http.Redirect(w, req, "/", http.StatusFound)
+	}
+}
+
+// LogoutHandler writes out logout response
+func LogoutHandler(cs *sessions.CookieStore, req *http.Request, connection *Connection, w http.ResponseWriter) {
+	EndSession(cs, req, w, connection)
 
 	http.Redirect(w, req, "/", 301)
 }
 
-// SignUpHandler writes out response to singing up
-func SignUpHandler(req *http.Request, w http.ResponseWriter, connection *Connection, cs *sessions.CookieStore, cfg *Config) {
+// SignUpHandler writes out response to singing up. Failed attempts count
+// towards the throttle of the address.
+func SignUpHandler(req *http.Request, w http.ResponseWriter, connection *Connection, cs *sessions.CookieStore, cfg *Config, mailer *Mailer, throttle *LoginThrottle, directory *LDAPDirectory, registration *Registration, logger *Logger) {
+	if directory != nil {
+		WriteJSONResponse(200, true, "Sign up is disabled, log in with your directory account.", req, w)
+		return
+	}
+
+	if !cfg.PasswordLogin {
+		WriteJSONResponse(200, true, "Sign up is disabled, log in with single sign-on.", req, w)
+		return
+	}
+
+	if registration.Closed() {
+		WriteJSONResponse(403, true, "Sign up is closed, ask an administrator for an account.", req, w)
+		return
+	}
+
+	// Taken usernames or emails and wrong invite codes are throttled, so
+	// neither accounts nor codes can be guessed quickly
+	ipKey := IPThrottleKey("signup", req)
+	if wait := throttle.Wait(ipKey); wait > 0 {
+		WriteThrottledResponse(wait, req, w)
+		return
+	}
+	fail := func(status int, message string) {
+		if throttle.Fail(ipKey, cfg.LockoutFailures) {
+			Audit(connection, AuditSignupLockout, "", ClientIP(req), "too many failed sign ups from this address")
+		}
+		WriteJSONResponse(status, true, message, req, w)
+	}
+
 	user := new(User)
 
 	req.ParseForm()
-	user.Username = req.PostFormValue("username")
-	user.Email = req.PostFormValue("email")
-	user.Password = cryptPassword(req.PostFormValue("password"), cfg.SecretKey)
+	user.Username = strings.TrimSpace(req.PostFormValue("username"))
+	user.Email = strings.TrimSpace(req.PostFormValue("email"))
+	password := req.PostFormValue("password")
+	user.Password = cryptPassword(password, cfg.PasswordKey())
+	invite := strings.TrimSpace(req.PostFormValue("invite"))
 	errors := ""
 
-	if len(user.Username) == 0 || len(user.Email) == 0 {
+	if len(user.Username) == 0 || len(user.Email) == 0 || len(password) == 0 {
 		errors += "Empty fields. "
+	} else if !usernameRegexp.MatchString(user.Username) {
+		errors += "Usernames have up to 40 letters, numbers, dots, dashes or underscores. "
 	}
 
-	exp, _ := regexp.Compile(`[a-zA-Z0-9._%+-]+@([a-zA-Z0-9-]+\.)+[A-Za-z]{2,6}`)
-
-	if !exp.MatchString(user.Email) {
+	if !emailRegexp.MatchString(user.Email) {
 		errors += "Invalid email address. "
 	}
 
+	if errors != "" {
+		WriteJSONResponse(200, true, errors, req, w)
+		return
+	}
+
+	inviteRequired := registration.InviteRequired(user.Email)
+	if inviteRequired && invite == "" {
+		WriteJSONResponse(403, true, registration.RequirementMessage(), req, w)
+		return
+	}
+
 	response, err := connection.SignUp(user)
 
-	if err != nil || len(response) != 0 {
-		errors += "Username or email taken."
-	} else {
-		_, err = connection.SignUpInsert(user)
+	if err != nil {
+		WriteJSONResponse(200, true, "There was an error creating the user.", req, w)
+		return
+	}
+	if len(response) != 0 {
+		fail(200, "Username or email taken.")
+		return
+	}
 
+	// The invite is used up before the user is created so it cannot be
+	// shared by concurrent sign ups, and put back if the user is not created
+	var token *Token
+	if inviteRequired {
+		token, err = connection.UseToken(TokenInvite, invite)
 		if err != nil {
-			errors += "There was an error creating the user."
+			WriteJSONResponse(200, true, "There was an error creating the user.", req, w)
+			return
+		}
+		if token == nil {
+			fail(403, "The invite code is not valid or has expired.")
+			return
+		}
+		user.InvitedBy = token.User
+	} else {
+		user.DomainSignUp = registration.VerificationRequired(user.Email)
+	}
+
+	inserted, err := connection.SignUpInsert(user)
+
+	if err != nil || inserted.Inserted < 1 {
+		if token != nil {
+			connection.NewToken(token)
+		}
+		WriteJSONResponse(200, true, "There was an error creating the user.", req, w)
+		return
+	}
+
+	if err := SendVerification(connection, mailer, inserted.GeneratedKeys[0], user.Username, user.Email); err != nil {
+		logger.Error("verification email failed", "username", user.Username, "err", err)
+	}
+	if user.DomainSignUp {
+		WriteJSONResponse(201, false, "New user created, verify your email address to log in.", req, w)
+		return
+	}
+	WriteJSONResponse(201, false, "New user created.", req, w)
+}
+
+// MessageHandler writes out a page with a message for the user
+func MessageHandler(title, message string, w http.ResponseWriter) {
+	context := map[string]interface{}{
+		"title":   title,
+		"message": message,
+	}
+	w.Write([]byte(mustache.RenderFileInLayout("templates/message.mustache", "templates/base.mustache", context)))
+}
+
+// VerifyEmailHandler verifies the email address of an user with the token
+// sent to it
+func VerifyEmailHandler(params martini.Params, w http.ResponseWriter, connection *Connection) {
+	token, err := connection.UseToken(TokenVerifyEmail, params["token"])
+
+	if err != nil {
+		MessageHandler("Email verification", "There was an error verifying your email, try again later.", w)
+	} else if token == nil {
+		MessageHandler("Email verification", "The verification link is not valid or has expired.", w)
+	} else if response, err := connection.VerifyEmail(token.User, token.Email); err != nil || response.Replaced+response.Unchanged < 1 {
+		MessageHandler("Email verification", "The verification link is not valid for your current email address.", w)
+	} else {
+		MessageHandler("Email verification", "Your email address has been verified.", w)
+	}
+}
+
+// ResendVerificationHandler writes out response to sending the verification
+// email again
+func ResendVerificationHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection, mailer *Mailer) {
+	userID := SessionUserID(cs, req, connection)
+
+	user, err := connection.GetUser(userID)
+
+	if err != nil || user == nil {
+		WriteJSONResponse(200, true, "Error retrieving the user.", req, w)
+	} else if user.EmailVerified {
+		WriteJSONResponse(200, true, "Your email address is already verified.", req, w)
+	} else if err := SendVerification(connection, mailer, userID, user.Username, user.Email); err != nil {
+		WriteJSONResponse(200, true, "Error sending the verification email.", req, w)
+	} else {
+		WriteJSONResponse(200, false, "Verification email sent.", req, w)
+	}
+}
+
+// ForgotPasswordHandler writes out forgot password template
+func ForgotPasswordHandler(req *http.Request, w http.ResponseWriter) {
+	context := map[string]interface{}{
+		"title":      "Forgot your password?",
+		"csrf_token": nosurf.Token(req),
+	}
+	w.Write([]byte(mustache.RenderFileInLayout("templates/forgot.mustache", "templates/base.mustache", context)))
+}
+
+// ForgotPasswordPostHandler emails a password reset link. The response is the
+// same whether the email belongs to an user or not.
+func ForgotPasswordPostHandler(req *http.Request, w http.ResponseWriter, connection *Connection, mailer *Mailer, directory *LDAPDirectory) {
+	if directory != nil {
+		WriteJSONResponse(200, true, "Passwords are managed by your directory.", req, w)
+		return
+	}
+
+	email := strings.TrimSpace(req.PostFormValue("email"))
+
+	if email == "" {
+		WriteJSONResponse(200, true, "The email cannot be empty.", req, w)
+		return
+	}
+
+	user, err := connection.GetUserByEmail(email)
+
+	if err == nil && user != nil {
+		secret, token := NewToken(TokenResetPassword, user.ID, user.Email, ResetPasswordExpires)
+
+		if _, err := connection.NewToken(token); err == nil {
+			mailer.SendTemplate(user.Email, "Reset your Magnet password", "email_reset", map[string]interface{}{
+				"username": user.Username,
+				"token":    secret,
+			})
+		}
+	}
+
+	WriteJSONResponse(200, false, "If the email belongs to an account a reset link has been sent to it.", req, w)
+}
+
+// ResetPasswordHandler writes out reset password template
+func ResetPasswordHandler(params martini.Params, req *http.Request, w http.ResponseWriter) {
+	context := map[string]interface{}{
+		"title":      "Choose a new password",
+		"csrf_token": nosurf.Token(req),
+		"token":      params["token"],
+	}
+	w.Write([]byte(mustache.RenderFileInLayout("templates/reset.mustache", "templates/base.mustache", context)))
+}
+
+// ResetPasswordPostHandler writes out response to resetting the password. The
+// sessions of the user are closed.
+func ResetPasswordPostHandler(params martini.Params, req *http.Request, w http.ResponseWriter, cfg *Config, connection *Connection) {
+	password := req.PostFormValue("password")
+
+	if len(password) == 0 {
+		WriteJSONResponse(200, true, "The password cannot be empty.", req, w)
+		return
+	}
+
+	token, err := connection.UseToken(TokenResetPassword, params["token"])
+
+	if err != nil {
+		WriteJSONResponse(200, true, "Error resetting the password.", req, w)
+	} else if token == nil {
+		WriteJSONResponse(200, true, "The reset link is not valid or has expired.", req, w)
+	} else if _, err := connection.SetPassword(token.User, cryptPassword(password, cfg.PasswordKey())); err != nil {
+		WriteJSONResponse(200, true, "Error resetting the password.", req, w)
+	} else {
+		WriteJSONResponse(200, false, "Your password has been changed, you can now log in.", req, w)
+	}
+}
+
+// TwoFactorHandler writes out the two-factor authentication page. While it
+// is disabled a new secret is generated to enroll with.
+func TwoFactorHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection) {
+	username, userID := GetUserData(cs, req, connection)
+
+	user, err := connection.GetUser(userID)
+	if err != nil || user == nil {
+		MessageHandler("Two-factor authentication", "Error retrieving the user.", w)
+		return
+	}
+
+	context := map[string]interface{}{
+		"title":          "Two-factor authentication",
+		"csrf_token":     nosurf.Token(req),
+		"enabled":        user.TOTPEnabled,
+		"recovery_count": len(user.RecoveryCodes),
+	}
+
+	if !user.TOTPEnabled {
+		// The pending secret is kept until the enrollment is confirmed, so
+		// reloading the page doesn't invalidate an app already set up
+		secret := user.TOTPPending
+		if secret == "" {
+			secret = NewTOTPSecret()
+			if _, err := connection.SetTOTPPending(userID, secret); err != nil {
+				MessageHandler("Two-factor authentication", "Error starting the enrollment.", w)
+				return
+			}
+		}
+		context["secret"] = secret
+		context["uri"] = TOTPURI("Magnet", username, secret)
+	}
+
+	w.Write([]byte(mustache.RenderFileInLayout("templates/twofactor.mustache", "templates/base.mustache", context)))
+}
+
+// EnableTwoFactorHandler confirms the enrollment with a code from the
+// authenticator and writes out the recovery codes
+func EnableTwoFactorHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection) {
+	userID := SessionUserID(cs, req, connection)
+
+	user, err := connection.GetUser(userID)
+
+	if err != nil || user == nil {
+		WriteJSONResponse(200, true, "Error retrieving the user.", req, w)
+	} else if user.TOTPEnabled {
+		WriteJSONResponse(200, true, "Two-factor authentication is already enabled.", req, w)
+	} else if user.TOTPPending == "" {
+		WriteJSONResponse(200, true, "Reload the page to start the enrollment.", req, w)
+	} else if step, ok := ValidateTOTP(user.TOTPPending, req.PostFormValue("code"), time.Now(), 0); !ok {
+		WriteJSONResponse(200, true, "Invalid authentication code.", req, w)
+	} else {
+		codes, hashes := NewRecoveryCodes()
+
+		if _, err := connection.EnableTOTP(userID, user.TOTPPending, step, hashes); err != nil {
+			WriteJSONResponse(200, true, "Error enabling two-factor authentication.", req, w)
 		} else {
-			WriteJSONResponse(201, false, "New user created.", req, w)
+			JSONDataResponse(200, false, map[string]interface{}{"recovery_codes": codes}, req, w)
 		}
 	}
+}
 
-	if errors != "" {
-		WriteJSONResponse(200, true, errors, req, w)
+// DisableTwoFactorHandler turns off two-factor authentication after checking
+// the password and a code
+func DisableTwoFactorHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, cfg *Config, connection *Connection, directory *LDAPDirectory) {
+	userID := SessionUserID(cs, req, connection)
+
+	user, err := connection.GetUser(userID)
+
+	if err != nil || user == nil {
+		WriteJSONResponse(200, true, "Error retrieving the user.", req, w)
+	} else if !user.TOTPEnabled {
+		WriteJSONResponse(200, true, "Two-factor authentication is not enabled.", req, w)
+	} else if !CheckPassword(cfg, directory, user, req.PostFormValue("password")) {
+		WriteJSONResponse(200, true, "Invalid password.", req, w)
+	} else if !CheckTwoFactorCode(connection, user, req.PostFormValue("code")) {
+		WriteJSONResponse(200, true, "Invalid authentication code.", req, w)
+	} else if _, err := connection.DisableTOTP(userID); err != nil {
+		WriteJSONResponse(200, true, "Error disabling two-factor authentication.", req, w)
+	} else {
+		WriteJSONResponse(200, false, "Two-factor authentication disabled.", req, w)
 	}
 }
+
+// RecoveryCodesHandler replaces the recovery codes of the user after
+// checking a code
+func RecoveryCodesHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection) {
+	userID := SessionUserID(cs, req, connection)
+
+	user, err := connection.GetUser(userID)
+
+	if err != nil || user == nil {
+		WriteJSONResponse(200, true, "Error retrieving the user.", req, w)
+	} else if !user.TOTPEnabled {
+		WriteJSONResponse(200, true, "Two-factor authentication is not enabled.", req, w)
+	} else if !CheckTwoFactorCode(connection, user, req.PostFormValue("code")) {
+		WriteJSONResponse(200, true, "Invalid authentication code.", req, w)
+	} else {
+		codes, hashes := NewRecoveryCodes()
+
+		if _, err := connection.SetRecoveryCodes(userID, hashes); err != nil {
+			WriteJSONResponse(200, true, "Error creating recovery codes.", req, w)
+		} else {
+			JSONDataResponse(200, false, map[string]interface{}{"recovery_codes": codes}, req, w)
+		}
+	}
+}
+
+// SessionsHandler writes out the page listing the active sessions of the
+// user
+func SessionsHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection) {
+	userID := SessionUserID(cs, req, connection)
+
+	response, err := connection.GetUserSessions(userID)
+	if err != nil {
+		MessageHandler("Sessions", "Error retrieving your sessions.", w)
+		return
+	}
+
+	var list []map[string]interface{}
+	for _, info := range SessionInfos(response, CurrentSessionID(cs, req)) {
+		if info.UserAgent == "" {
+			info.UserAgent = "Unknown browser"
+		}
+
+		list = append(list, map[string]interface{}{
+			"id":         info.ID,
+			"user_agent": info.UserAgent,
+			"ip":         info.IP,
+			"created":    time.Unix(info.Created, 0).Format("Jan 2, 2006 15:04"),
+			"last_seen":  time.Unix(info.LastSeen, 0).Format("Jan 2, 2006 15:04"),
+			"current":    info.Current,
+		})
+	}
+
+	context := map[string]interface{}{
+		"title":      "Sessions",
+		"csrf_token": nosurf.Token(req),
+		"sessions":   list,
+	}
+	w.Write([]byte(mustache.RenderFileInLayout("templates/sessions.mustache", "templates/base.mustache", context)))
+}
+
+// RevokeSessionHandler writes out response to revoking a session
+func RevokeSessionHandler(params martini.Params, req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection) {
+	userID := SessionUserID(cs, req, connection)
+
+	response, err := connection.RevokeSession(userID, params)
+
+	if err != nil || response.Deleted < 1 {
+		WriteJSONResponse(200, true, "Error revoking session.", req, w)
+	} else {
+		WriteJSONResponse(200, false, "Session revoked successfully.", req, w)
+	}
+}
+
+// RevokeOtherSessionsHandler writes out response to revoking every session
+// of the user but the current one
+func RevokeOtherSessionsHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection) {
+	userID := SessionUserID(cs, req, connection)
+
+	_, err := connection.RevokeOtherSessions(userID, CurrentSessionID(cs, req))
+
+	if err != nil {
+		WriteJSONResponse(200, true, "Error revoking sessions.", req, w)
+	} else {
+		WriteJSONResponse(200, false, "Other sessions revoked successfully.", req, w)
+	}
+}
+
+// AdminHandler writes out the administration page
+func AdminHandler(req *http.Request, w http.ResponseWriter, connection *Connection) {
+	stats, err := connection.GetInstanceStats()
+	if err != nil {
+		MessageHandler("Administration", "Error retrieving the instance stats.", w)
+		return
+	}
+
+	users, err := connection.GetUsers()
+	if err != nil {
+		MessageHandler("Administration", "Error retrieving the users.", w)
+		return
+	}
+
+	bookmarks, _ := connection.CountUserBookmarks()
+
+	context := map[string]interface{}{
+		"title":      "Administration",
+		"csrf_token": nosurf.Token(req),
+		"stats":      stats,
+		"users":      UserInfos(users, bookmarks),
+	}
+	w.Write([]byte(mustache.RenderFileInLayout("templates/admin.mustache", "templates/base.mustache", context)))
+}
+
+// adminChange applies a change to an user and writes out the response
+func adminChange(change AdminUserChange, message string, params martini.Params, req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, cfg *Config, connection *Connection) {
+	admin, _ := CurrentAdmin(cs, req, connection, cfg)
+
+	if _, err := ApplyAdminChange(connection, admin, params["user"], change); err != nil {
+		WriteJSONResponse(200, true, err.Message, req, w)
+	} else {
+		WriteJSONResponse(200, false, message, req, w)
+	}
+}
+
+// AdminDisableUserHandler writes out response to disabling an user
+func AdminDisableUserHandler(params martini.Params, req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, cfg *Config, connection *Connection) {
+	disabled := true
+	adminChange(AdminUserChange{Disabled: &disabled}, "User disabled.", params, req, w, cs, cfg, connection)
+}
+
+// AdminEnableUserHandler writes out response to enabling an user
+func AdminEnableUserHandler(params martini.Params, req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, cfg *Config, connection *Connection) {
+	disabled := false
+	adminChange(AdminUserChange{Disabled: &disabled}, "User enabled.", params, req, w, cs, cfg, connection)
+}
+
+// AdminSetAdminHandler writes out response to granting or revoking
+// administrator access
+func AdminSetAdminHandler(params martini.Params, req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, cfg *Config, connection *Connection) {
+	admin := req.PostFormValue("admin") == "true"
+	message := "Administrator access revoked."
+	if admin {
+		message = "Administrator access granted."
+	}
+	adminChange(AdminUserChange{Admin: &admin}, message, params, req, w, cs, cfg, connection)
+}
+
+// AdminResetPasswordHandler writes out response to sending an user a link
+// to choose a new password
+func AdminResetPasswordHandler(params martini.Params, req *http.Request, w http.ResponseWriter, cfg *Config, connection *Connection, directory *LDAPDirectory, mailer *Mailer) {
+	email, err := AdminResetPassword(connection, cfg, directory, mailer, params["user"])
+
+	if err != nil {
+		WriteJSONResponse(200, true, err.Message, req, w)
+	} else {
+		WriteJSONResponse(200, false, "A reset link has been sent to "+email+".", req, w)
+	}
+}
+
+// AdminDeleteUserHandler writes out response to deleting an user with their
+// bookmarks and sessions
+func AdminDeleteUserHandler(params martini.Params, req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, cfg *Config, connection *Connection) {
+	admin, _ := CurrentAdmin(cs, req, connection, cfg)
+
+	if err := AdminDeleteUser(connection, admin, params["user"]); err != nil {
+		WriteJSONResponse(200, true, err.Message, req, w)
+	} else {
+		WriteJSONResponse(200, false, "User deleted.", req, w)
+	}
+}
+
+// InvitesHandler writes out the invite codes of the user
+func InvitesHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection, registration *Registration) {
+	userID := SessionUserID(cs, req, connection)
+
+	user, err := connection.GetUser(userID)
+	if err != nil || user == nil {
+		MessageHandler("Invites", "Error retrieving your account.", w)
+		return
+	}
+
+	if !registration.CanInvite(user) {
+		MessageHandler("Invites", "You cannot invite users.", w)
+		return
+	}
+
+	tokens, err := connection.GetUserInvites(userID)
+	if err != nil {
+		MessageHandler("Invites", "Error retrieving your invites.", w)
+		return
+	}
+
+	var list []map[string]interface{}
+	for _, invite := range Invites(tokens) {
+		list = append(list, map[string]interface{}{
+			"id":      invite.ID,
+			"expires": time.Unix(invite.Expires, 0).Format("Jan 2, 2006 15:04"),
+		})
+	}
+
+	context := map[string]interface{}{
+		"title":      "Invites",
+		"csrf_token": nosurf.Token(req),
+		"invites":    list,
+	}
+	w.Write([]byte(mustache.RenderFileInLayout("templates/invites.mustache", "templates/base.mustache", context)))
+}
+
+// NewInviteHandler writes out a new invite code
+func NewInviteHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection, registration *Registration) {
+	userID := SessionUserID(cs, req, connection)
+
+	user, err := connection.GetUser(userID)
+	if err != nil || user == nil {
+		WriteJSONResponse(200, true, "Error retrieving your account.", req, w)
+		return
+	}
+
+	invite, apiErr := CreateInvite(connection, registration, user)
+	if apiErr != nil {
+		WriteJSONResponse(200, true, apiErr.Message, req, w)
+	} else {
+		JSONDataResponse(200, false, invite, req, w)
+	}
+}
+
+// DeleteInviteHandler writes out response to revoking an invite code
+func DeleteInviteHandler(params martini.Params, req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection) {
+	userID := SessionUserID(cs, req, connection)
+
+	response, err := connection.DeleteInvite(userID, params["invite"])
+	if err != nil {
+		WriteJSONResponse(200, true, "Error revoking the invite.", req, w)
+	} else if response.Deleted < 1 {
+		WriteJSONResponse(200, true, "Invite not found.", req, w)
+	} else {
+		WriteJSONResponse(200, false, "Invite revoked.", req, w)
+	}
+}
+
+// AccountHandler writes out the account page
+func AccountHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection, directory *LDAPDirectory) {
+	user := CurrentUser(cs, req, connection)
+	if user == nil {
+		MessageHandler("Account", "Error retrieving your account.", w)
+		return
+	}
+
+	context := map[string]interface{}{
+		"title":          "Account",
+		"csrf_token":     nosurf.Token(req),
+		"username":       user.Username,
+		"email":          user.Email,
+		"email_verified": user.EmailVerified,
+		"directory":      directory != nil,
+		"sso_only":       SSOOnly(directory, user),
+	}
+	w.Write([]byte(mustache.RenderFileInLayout("templates/account.mustache", "templates/base.mustache", context)))
+}
+
+// ChangeUsernameHandler writes out response to changing the username
+func ChangeUsernameHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection, directory *LDAPDirectory) {
+	user := CurrentUser(cs, req, connection)
+	if user == nil {
+		WriteJSONResponse(200, true, "Error retrieving your account.", req, w)
+		return
+	}
+
+	if err := ChangeUsername(connection, directory, user, req.PostFormValue("username")); err != nil {
+		WriteJSONResponse(200, true, err.Message, req, w)
+		return
+	}
+
+	WriteJSONResponse(200, false, "Your username has been changed.", req, w)
+}
+
+// ChangePasswordHandler writes out response to changing the password
+func ChangePasswordHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, cfg *Config, connection *Connection, directory *LDAPDirectory, throttle *LoginThrottle) {
+	user := CurrentUser(cs, req, connection)
+	if user == nil {
+		WriteJSONResponse(200, true, "Error retrieving your account.", req, w)
+		return
+	}
+
+	err := ChangePassword(connection, cfg, directory, throttle, user, CurrentSession(cs, req, connection), req.PostFormValue("current_password"), req.PostFormValue("password"))
+	if err != nil {
+		WriteJSONResponse(200, true, err.Message, req, w)
+	} else if err := renewSession(user.ID, req, w, cs, cfg, connection); err != nil {
+		WriteJSONResponse(200, true, "Your password has been changed, log in again.", req, w)
+	} else {
+		WriteJSONResponse(200, false, "Your password has been changed and your other sessions closed.", req, w)
+	}
+}
+
+// ChangeEmailHandler writes out response to changing the email address
+func ChangeEmailHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, cfg *Config, connection *Connection, directory *LDAPDirectory, throttle *LoginThrottle, mailer *Mailer) {
+	user := CurrentUser(cs, req, connection)
+	if user == nil {
+		WriteJSONResponse(200, true, "Error retrieving your account.", req, w)
+		return
+	}
+
+	err := RequestEmailChange(connection, cfg, directory, throttle, mailer, user, CurrentSession(cs, req, connection), req.PostFormValue("password"), req.PostFormValue("email"))
+	if err != nil {
+		WriteJSONResponse(200, true, err.Message, req, w)
+	} else {
+		WriteJSONResponse(200, false, "Open the link sent to your new address to confirm it.", req, w)
+	}
+}
+
+// ConfirmEmailHandler changes the email address of an user with the token
+// sent to the new address
+func ConfirmEmailHandler(params martini.Params, w http.ResponseWriter, connection *Connection) {
+	switch err := ConfirmEmailChange(connection, params["token"]); err {
+	case nil:
+		MessageHandler("Email change", "Your email address has been changed.", w)
+	case ErrInvalidToken:
+		MessageHandler("Email change", "The confirmation link is not valid or has expired.", w)
+	case ErrEmailTaken:
+		MessageHandler("Email change", "The email address belongs to another account.", w)
+	default:
+		MessageHandler("Email change", "There was an error changing your email, try again later.", w)
+	}
+}
+
+// ExportHandler sends the export archive of the user
+func ExportHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, connection *Connection, logger *Logger) {
+	user := CurrentUser(cs, req, connection)
+	if user == nil {
+		MessageHandler("Export", "Error retrieving your account.", w)
+		return
+	}
+
+	var archive bytes.Buffer
+	if err := WriteExport(connection, user, &archive); err != nil {
+		logger.Error("export failed", "username", user.Username, "err", err)
+		MessageHandler("Export", "Error exporting your data, try again later.", w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+ExportFilename(user)+"\"")
+	w.Write(archive.Bytes())
+}
+
+// DeleteAccountHandler writes out response to deleting the account of the
+// user, logging them out
+func DeleteAccountHandler(req *http.Request, w http.ResponseWriter, cs *sessions.CookieStore, cfg *Config, connection *Connection, directory *LDAPDirectory, throttle *LoginThrottle) {
+	user := CurrentUser(cs, req, connection)
+	if user == nil {
+		WriteJSONResponse(200, true, "Error retrieving your account.", req, w)
+		return
+	}
+
+	if err := DeleteAccount(connection, cfg, directory, throttle, user, CurrentSession(cs, req, connection), req.PostFormValue("password")); err != nil {
+		WriteJSONResponse(200, true, err.Message, req, w)
+		return
+	}
+
+	SetSessionCookie(cs, req, w, "")
+
+	WriteJSONResponse(200, false, "Your account has been deleted.", req, w)
+}
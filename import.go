@@ -0,0 +1,177 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"html"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ImportedBookmark is a bookmark read from a file to import
+type ImportedBookmark struct {
+	Title   string
+	URL     string
+	Tags    []string
+	Created float64
+}
+
+var (
+	netscapeLinkRegexp = regexp.MustCompile(`(?is)<a\s([^>]*)>(.*?)</a>`)
+	netscapeAttrRegexp = regexp.MustCompile(`(?is)([a-z_]+)\s*=\s*"([^"]*)"`)
+	htmlTagRegexp      = regexp.MustCompile(`(?s)<[^>]*>`)
+)
+
+// ParseBookmarkFile reads the bookmarks of a browser export (Netscape
+// HTML), a bookmarks.json or the zip archive of a Magnet export
+func ParseBookmarkFile(name string, r io.Reader) ([]ImportedBookmark, error) {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".zip":
+		return parseExportArchive(content)
+	case ".json":
+		return parseBookmarksJSON(content)
+	case ".html", ".htm":
+		return parseNetscapeBookmarks(content), nil
+	}
+
+	return nil, errors.New("unknown format, use a .html, .json or .zip file")
+}
+
+func parseExportArchive(content []byte) ([]ImportedBookmark, error) {
+	archive, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range archive.File {
+		if file.Name != "bookmarks.json" {
+			continue
+		}
+
+		f, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			return nil, err
+		}
+		return parseBookmarksJSON(data)
+	}
+
+	return nil, errors.New("the archive has no bookmarks.json")
+}
+
+func parseBookmarksJSON(content []byte) ([]ImportedBookmark, error) {
+	var items []struct {
+		Title     string   `json:"Title"`
+		URL       string   `json:"URL"`
+		LegacyURL string   `json:"Url"`
+		Tags      []string `json:"Tags"`
+		Created   float64  `json:"Created"`
+	}
+
+	if err := json.Unmarshal(content, &items); err != nil {
+		return nil, err
+	}
+
+	bookmarks := make([]ImportedBookmark, len(items))
+	for i, item := range items {
+		if item.URL == "" {
+			item.URL = item.LegacyURL
+		}
+		bookmarks[i] = ImportedBookmark{Title: item.Title, URL: item.URL, Tags: item.Tags, Created: item.Created}
+	}
+
+	return bookmarks, nil
+}
+
+// parseNetscapeBookmarks reads the links of the bookmark files browsers
+// export, with their ADD_DATE and TAGS attributes
+func parseNetscapeBookmarks(content []byte) []ImportedBookmark {
+	var bookmarks []ImportedBookmark
+
+	for _, link := range netscapeLinkRegexp.FindAllSubmatch(content, -1) {
+		bookmark := ImportedBookmark{
+			Title: strings.TrimSpace(html.UnescapeString(htmlTagRegexp.ReplaceAllString(string(link[2]), ""))),
+		}
+
+		for _, attr := range netscapeAttrRegexp.FindAllSubmatch(link[1], -1) {
+			value := html.UnescapeString(string(attr[2]))
+
+			switch strings.ToUpper(string(attr[1])) {
+			case "HREF":
+				bookmark.URL = value
+			case "ADD_DATE":
+				if created, err := strconv.ParseInt(value, 10, 64); err == nil {
+					bookmark.Created = float64(created)
+				}
+			case "TAGS":
+				bookmark.Tags = ParseTags(value)
+			}
+		}
+
+		bookmarks = append(bookmarks, bookmark)
+	}
+
+	return bookmarks
+}
+
+// ImportBookmarks adds bookmarks to an user, skipping the URLs they
+// already have. It returns how many were imported and skipped.
+func ImportBookmarks(connection *Connection, userID string, bookmarks []ImportedBookmark) (int, int, error) {
+	existing, err := connection.ChangedBookmarks(userID, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	urls := make(map[string]bool)
+	for _, bookmark := range existing {
+		urls[bookmark.URL] = true
+	}
+
+	imported, skipped := 0, 0
+	for _, bookmark := range bookmarks {
+		bookmark.URL = strings.TrimSpace(bookmark.URL)
+		if !IsValidURL(bookmark.URL) || urls[bookmark.URL] {
+			skipped++
+			continue
+		}
+		urls[bookmark.URL] = true
+
+		title := bookmark.Title
+		if title == "" {
+			title = bookmark.URL
+		}
+
+		document := NewBookmarkDocument(userID, title, bookmark.URL, bookmark.Tags)
+		if bookmark.Created > 0 {
+			document["Created"] = bookmark.Created
+			document["Date"] = time.Unix(int64(bookmark.Created), 0).Format("Jan 2, 2006 at 3:04pm")
+		}
+
+		response, err := connection.NewBookmark(userID, document)
+		if err != nil {
+			return imported, skipped, err
+		}
+		if response.Inserted > 0 {
+			imported++
+		}
+	}
+
+	return imported, skipped, nil
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"gopkg.in/ldap.v2"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const ldapTimeout = 10 * time.Second
+
+// ErrLDAPInvalidCredentials is returned for unknown users and wrong
+// passwords alike
+var ErrLDAPInvalidCredentials = errors.New("invalid username or password")
+
+// ErrLDAPNotAllowed is returned for users outside of the allowed group
+var ErrLDAPNotAllowed = errors.New("the user is not allowed to use magnet")
+
+// ErrLDAPUsernameTaken is returned when the username of a directory user
+// belongs to a local user not created from that directory entry
+var ErrLDAPUsernameTaken = errors.New("the username belongs to another user")
+
+// LDAPEntry is a directory user who logged in. Admin is only known, and
+// SyncAdmin set, when there is an admin group.
+type LDAPEntry struct {
+	DN        string
+	Username  string
+	Email     string
+	Admin     bool
+	SyncAdmin bool
+}
+
+// ldapConn is the part of an LDAP connection the directory uses, so tests
+// can stand in for the server
+type ldapConn interface {
+	Bind(username, password string) error
+	Search(request *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close()
+}
+
+// LDAPDirectory authenticates users against an LDAP directory. Users are
+// found with a search, optionally bound as a service account, and then
+// authenticated by binding with their DN and password.
+type LDAPDirectory struct {
+	address      string
+	useTLS       bool
+	startTLS     bool
+	tlsConfig    *tls.Config
+	bindDN       string
+	bindPassword string
+	baseDN       string
+	userFilter   string
+	usernameAttr string
+	emailAttr    string
+	allowedGroup string
+	adminGroup   string
+	connect      func() (ldapConn, error)
+}
+
+// NewLDAPDirectory creates a directory from the config, or returns nil if
+// LDAP is not configured
+func NewLDAPDirectory(config *Config) *LDAPDirectory {
+	if config.LDAPURL == "" {
+		return nil
+	}
+
+	parsedURL, err := url.Parse(config.LDAPURL)
+	if err != nil {
+		panic(fmt.Sprintf("invalid MAGNET_LDAP_URL: %s", err))
+	}
+
+	useTLS := parsedURL.Scheme == "ldaps"
+	address := parsedURL.Host
+	if parsedURL.Port() == "" {
+		port := "389"
+		if useTLS {
+			port = "636"
+		}
+		address = net.JoinHostPort(parsedURL.Hostname(), port)
+	}
+
+	directory := &LDAPDirectory{
+		address:  address,
+		useTLS:   useTLS,
+		startTLS: config.LDAPStartTLS,
+		tlsConfig: &tls.Config{
+			ServerName:         parsedURL.Hostname(),
+			InsecureSkipVerify: config.LDAPInsecureSkipVerify,
+		},
+		bindDN:       config.LDAPBindDN,
+		bindPassword: config.LDAPBindPassword,
+		baseDN:       config.LDAPBaseDN,
+		userFilter:   config.LDAPUserFilter,
+		usernameAttr: config.LDAPUsernameAttribute,
+		emailAttr:    config.LDAPEmailAttribute,
+		allowedGroup: config.LDAPAllowedGroup,
+		adminGroup:   config.LDAPAdminGroup,
+	}
+	directory.connect = directory.dial
+
+	return directory
+}
+
+// Authenticate checks the password of an user and their group membership
+func (d *LDAPDirectory) Authenticate(username, password string) (*LDAPEntry, error) {
+	// An empty password would be an unauthenticated bind, which succeeds
+	if username == "" || password == "" {
+		return nil, ErrLDAPInvalidCredentials
+	}
+
+	conn, err := d.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := d.bindService(conn); err != nil {
+		return nil, err
+	}
+
+	result, err := conn.Search(ldap.NewSearchRequest(
+		d.baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(ldapTimeout/time.Second), false,
+		strings.Replace(d.userFilter, "%s", ldap.EscapeFilter(username), -1),
+		[]string{d.usernameAttr, d.emailAttr}, nil))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, fmt.Errorf("ldap search: %s", err)
+	}
+
+	if result == nil || len(result.Entries) != 1 {
+		return nil, ErrLDAPInvalidCredentials
+	}
+	found := result.Entries[0]
+
+	if err := conn.Bind(found.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrLDAPInvalidCredentials
+		}
+		return nil, fmt.Errorf("ldap bind: %s", err)
+	}
+
+	entry := &LDAPEntry{
+		DN:       found.DN,
+		Username: found.GetAttributeValue(d.usernameAttr),
+		Email:    found.GetAttributeValue(d.emailAttr),
+	}
+	if entry.Username == "" {
+		entry.Username = username
+	}
+
+	// Group lookups may need the rights of the service account
+	if err := d.bindService(conn); err != nil {
+		return nil, err
+	}
+
+	if d.allowedGroup != "" {
+		member, err := d.isMember(conn, d.allowedGroup, entry)
+		if err != nil {
+			return nil, err
+		}
+		if !member {
+			return nil, ErrLDAPNotAllowed
+		}
+	}
+
+	if d.adminGroup != "" {
+		if entry.Admin, err = d.isMember(conn, d.adminGroup, entry); err != nil {
+			return nil, err
+		}
+		entry.SyncAdmin = true
+	}
+
+	return entry, nil
+}
+
+// dial connects to the server, upgrading the connection with StartTLS if
+// configured
+func (d *LDAPDirectory) dial() (ldapConn, error) {
+	var conn *ldap.Conn
+	var err error
+
+	if d.useTLS {
+		conn, err = ldap.DialTLS("tcp", d.address, d.tlsConfig)
+	} else {
+		conn, err = ldap.Dial("tcp", d.address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ldap dial: %s", err)
+	}
+	conn.SetTimeout(ldapTimeout)
+
+	if d.startTLS && !d.useTLS {
+		if err := conn.StartTLS(d.tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("ldap starttls: %s", err)
+		}
+	}
+
+	return conn, nil
+}
+
+// bindService binds as the service account, if there is one
+func (d *LDAPDirectory) bindService(conn ldapConn) error {
+	if d.bindDN == "" {
+		return nil
+	}
+
+	if err := conn.Bind(d.bindDN, d.bindPassword); err != nil {
+		return fmt.Errorf("ldap service bind: %s", err)
+	}
+	return nil
+}
+
+// isMember tells if an user belongs to a group, either a groupOfNames,
+// a groupOfUniqueNames or a posixGroup
+func (d *LDAPDirectory) isMember(conn ldapConn, groupDN string, entry *LDAPEntry) (bool, error) {
+	filter := fmt.Sprintf("(|(member=%s)(uniqueMember=%s)(memberUid=%s))",
+		ldap.EscapeFilter(entry.DN), ldap.EscapeFilter(entry.DN), ldap.EscapeFilter(entry.Username))
+
+	result, err := conn.Search(ldap.NewSearchRequest(
+		groupDN, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, int(ldapTimeout/time.Second), false,
+		filter, []string{"dn"}, nil))
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			return false, nil
+		}
+		return false, fmt.Errorf("ldap group search: %s", err)
+	}
+
+	return len(result.Entries) > 0, nil
+}
+
+// LDAPUser returns the local user of a directory entry, creating it on the
+// first login. Users are only ever matched by DN, so a directory user can't
+// take over a local account with the same username. With an admin group
+// the admin flag follows it on every login, otherwise it is managed in
+// Magnet.
+func LDAPUser(connection *Connection, entry *LDAPEntry) (*User, error) {
+	user, err := connection.GetUserByLDAPDN(entry.DN)
+	if err != nil {
+		return nil, err
+	}
+
+	if user != nil {
+		if entry.SyncAdmin && user.Admin != entry.Admin {
+			if _, err := connection.SetUserAdmin(user.ID, entry.Admin); err != nil {
+				return nil, err
+			}
+			user.Admin = entry.Admin
+		}
+		return user, nil
+	}
+
+	existing, err := connection.GetUserByUsername(entry.Username)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, ErrLDAPUsernameTaken
+	}
+
+	// The password stays empty, the directory checks it
+	user = &User{
+		Username:      entry.Username,
+		Email:         entry.Email,
+		EmailVerified: entry.Email != "",
+		LDAPDN:        entry.DN,
+		Admin:         entry.Admin,
+	}
+
+	response, err := connection.SignUpInsert(user)
+	if err != nil {
+		return nil, err
+	}
+	if response.Inserted < 1 {
+		return nil, errors.New("error creating the user")
+	}
+
+	user.ID = response.GeneratedKeys[0]
+	return user, nil
+}
+
+// CheckPassword checks the password of a logged in user. Directory users
+// are checked against the directory, and the entry found must be theirs as
+// the username may now belong to someone else there. Users not linked to
+// the directory are checked against their local password.
+func CheckPassword(cfg *Config, directory *LDAPDirectory, user *User, password string) bool {
+	if directory != nil && user.LDAPDN != "" {
+		entry, err := directory.Authenticate(user.Username, password)
+		return err == nil && strings.EqualFold(entry.DN, user.LDAPDN)
+	}
+
+	return password != "" && user.Password == cryptPassword(password, cfg.PasswordKey())
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/ldap.v2"
+	"strings"
+	"testing"
+)
+
+// fakeDirectory stands in for an LDAP server holding users and groups
+type fakeDirectory struct {
+	passwords map[string]string
+	users     map[string]map[string][]string
+	groups    map[string][]string
+	binds     []string
+}
+
+func newFakeDirectory() *fakeDirectory {
+	return &fakeDirectory{
+		passwords: map[string]string{
+			"cn=service,dc=example,dc=com":         "service-secret",
+			"uid=ana,ou=people,dc=example,dc=com":  "ana-secret",
+			"uid=luis,ou=people,dc=example,dc=com": "luis-secret",
+		},
+		users: map[string]map[string][]string{
+			"uid=ana,ou=people,dc=example,dc=com":  {"uid": {"ana"}, "mail": {"ana@example.com"}},
+			"uid=luis,ou=people,dc=example,dc=com": {"uid": {"luis"}},
+		},
+		groups: map[string][]string{
+			"cn=magnet,ou=groups,dc=example,dc=com": {"uid=ana,ou=people,dc=example,dc=com", "uid=luis,ou=people,dc=example,dc=com"},
+			"cn=admins,ou=groups,dc=example,dc=com": {"uid=ana,ou=people,dc=example,dc=com"},
+		},
+	}
+}
+
+func (f *fakeDirectory) Bind(dn, password string) error {
+	f.binds = append(f.binds, dn)
+	if expected, ok := f.passwords[dn]; !ok || expected != password {
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+	}
+	return nil
+}
+
+// Search understands the user filter of the tests and the group filter of
+// the directory
+func (f *fakeDirectory) Search(request *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	result := &ldap.SearchResult{}
+
+	if request.Scope == ldap.ScopeBaseObject {
+		members, ok := f.groups[request.BaseDN]
+		if !ok {
+			return nil, ldap.NewError(ldap.LDAPResultNoSuchObject, errors.New("no such object"))
+		}
+		for _, member := range members {
+			if strings.Contains(request.Filter, "(member="+ldap.EscapeFilter(member)+")") {
+				result.Entries = append(result.Entries, ldap.NewEntry(request.BaseDN, nil))
+			}
+		}
+		return result, nil
+	}
+
+	for dn, attributes := range f.users {
+		if request.Filter == fmt.Sprintf("(uid=%s)", ldap.EscapeFilter(attributes["uid"][0])) {
+			result.Entries = append(result.Entries, ldap.NewEntry(dn, attributes))
+		}
+	}
+	return result, nil
+}
+
+func (f *fakeDirectory) Close() {}
+
+func testDirectory(fake *fakeDirectory, allowedGroup, adminGroup string) *LDAPDirectory {
+	directory := NewLDAPDirectory(&Config{
+		LDAPURL:               "ldap://ldap.example.com",
+		LDAPBindDN:            "cn=service,dc=example,dc=com",
+		LDAPBindPassword:      "service-secret",
+		LDAPBaseDN:            "ou=people,dc=example,dc=com",
+		LDAPUserFilter:        "(uid=%s)",
+		LDAPUsernameAttribute: "uid",
+		LDAPEmailAttribute:    "mail",
+		LDAPAllowedGroup:      allowedGroup,
+		LDAPAdminGroup:        adminGroup,
+	})
+	directory.connect = func() (ldapConn, error) { return fake, nil }
+
+	return directory
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	fake := newFakeDirectory()
+	directory := testDirectory(fake, "cn=magnet,ou=groups,dc=example,dc=com", "cn=admins,ou=groups,dc=example,dc=com")
+
+	entry, err := directory.Authenticate("ana", "ana-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := LDAPEntry{DN: "uid=ana,ou=people,dc=example,dc=com", Username: "ana", Email: "ana@example.com", Admin: true, SyncAdmin: true}
+	if *entry != want {
+		t.Errorf("entry %+v, want %+v", *entry, want)
+	}
+
+	if entry, err := directory.Authenticate("luis", "luis-secret"); err != nil || entry.Admin {
+		t.Errorf("luis: %+v, %v", entry, err)
+	}
+}
+
+func TestLDAPAuthenticateRejects(t *testing.T) {
+	tests := []struct {
+		name         string
+		username     string
+		password     string
+		allowedGroup string
+		want         error
+	}{
+		{"wrong password", "ana", "wrong", "", ErrLDAPInvalidCredentials},
+		{"unknown user", "eva", "ana-secret", "", ErrLDAPInvalidCredentials},
+		{"empty password", "ana", "", "", ErrLDAPInvalidCredentials},
+		{"filter injection", "*", "ana-secret", "", ErrLDAPInvalidCredentials},
+		{"outside the allowed group", "luis", "luis-secret", "cn=admins,ou=groups,dc=example,dc=com", ErrLDAPNotAllowed},
+		{"missing allowed group", "ana", "ana-secret", "cn=missing,ou=groups,dc=example,dc=com", ErrLDAPNotAllowed},
+	}
+
+	for _, test := range tests {
+		directory := testDirectory(newFakeDirectory(), test.allowedGroup, "")
+
+		if _, err := directory.Authenticate(test.username, test.password); err != test.want {
+			t.Errorf("%s: error %v, want %v", test.name, err, test.want)
+		}
+	}
+}
+
+func TestLDAPAdminOnlyKnownWithAdminGroup(t *testing.T) {
+	directory := testDirectory(newFakeDirectory(), "", "")
+
+	entry, err := directory.Authenticate("ana", "ana-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.SyncAdmin || entry.Admin {
+		t.Errorf("admin set without an admin group: %+v", entry)
+	}
+}
+
+func TestLDAPBindsAsUserThenService(t *testing.T) {
+	fake := newFakeDirectory()
+	directory := testDirectory(fake, "cn=magnet,ou=groups,dc=example,dc=com", "")
+
+	if _, err := directory.Authenticate("ana", "ana-secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"cn=service,dc=example,dc=com", "uid=ana,ou=people,dc=example,dc=com", "cn=service,dc=example,dc=com"}
+	if strings.Join(fake.binds, "|") != strings.Join(want, "|") {
+		t.Errorf("binds %q, want %q", fake.binds, want)
+	}
+}
+
+func TestCheckPasswordWithDirectory(t *testing.T) {
+	cfg := &Config{SecretKey: "secret"}
+	directory := testDirectory(newFakeDirectory(), "", "")
+
+	tests := []struct {
+		name     string
+		user     *User
+		password string
+		ok       bool
+	}{
+		{"directory password", &User{Username: "ana", LDAPDN: "uid=ana,ou=people,dc=example,dc=com"}, "ana-secret", true},
+		{"wrong directory password", &User{Username: "ana", LDAPDN: "uid=ana,ou=people,dc=example,dc=com"}, "wrong", false},
+		{"username now of another entry", &User{Username: "ana", LDAPDN: "uid=old-ana,ou=people,dc=example,dc=com"}, "ana-secret", false},
+		{"local user", &User{Username: "luis", Password: cryptPassword("local", cfg.PasswordKey())}, "local", true},
+		{"local user with the directory password", &User{Username: "luis", Password: cryptPassword("local", cfg.PasswordKey())}, "luis-secret", false},
+		{"local user without a password", &User{Username: "luis"}, "", false},
+	}
+
+	for _, test := range tests {
+		if ok := CheckPassword(cfg, directory, test.user, test.password); ok != test.ok {
+			t.Errorf("%s: %v, want %v", test.name, ok, test.ok)
+		}
+	}
+}
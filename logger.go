@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/codegangsta/martini"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log entry
+type Level int
+
+// Log levels, from the most verbose
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// ParseLevel returns the level with the given name
+func ParseLevel(name string) (Level, error) {
+	for i, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, errors.New("unknown log level " + name)
+}
+
+// requestIDRegexp matches the request ids accepted from clients, others
+// are replaced so they can't forge log lines
+var requestIDRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// logOutput is shared by a logger and the loggers derived from it
+type logOutput struct {
+	mu     sync.Mutex
+	w      io.Writer
+	level  Level
+	format string
+}
+
+// Logger writes leveled entries made of a message and key value pairs, as
+// logfmt or JSON lines. A nil *Logger writes through defaultLogger.
+type Logger struct {
+	out    *logOutput
+	fields []interface{}
+}
+
+// defaultLogger is used outside of requests, SetupLogging configures it
+var defaultLogger = NewLogger(os.Stderr, LevelInfo, "logfmt")
+
+// NewLogger returns a logger writing entries of at least level to w, format
+// is logfmt or json
+func NewLogger(w io.Writer, level Level, format string) *Logger {
+	return &Logger{out: &logOutput{w: w, level: level, format: format}}
+}
+
+// SetupLogging configures defaultLogger from the config, and sends the
+// standard logger through it
+func SetupLogging(config *Config) error {
+	level, err := ParseLevel(config.LogLevel)
+	if err != nil {
+		return err
+	}
+
+	defaultLogger.out.mu.Lock()
+	defaultLogger.out.level = level
+	defaultLogger.out.format = config.LogFormat
+	defaultLogger.out.mu.Unlock()
+
+	log.SetFlags(0)
+	log.SetOutput(defaultLogger.Writer(LevelInfo))
+	return nil
+}
+
+// With returns a logger adding key value pairs to every entry
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	if l == nil {
+		l = defaultLogger
+	}
+
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvals...)
+	return &Logger{out: l.out, fields: fields}
+}
+
+// Debug logs details only useful while debugging
+func (l *Logger) Debug(msg string, keyvals ...interface{}) {
+	l.write(LevelDebug, msg, keyvals)
+}
+
+// Info logs the normal operation of Magnet
+func (l *Logger) Info(msg string, keyvals ...interface{}) {
+	l.write(LevelInfo, msg, keyvals)
+}
+
+// Warn logs problems Magnet recovers from
+func (l *Logger) Warn(msg string, keyvals ...interface{}) {
+	l.write(LevelWarn, msg, keyvals)
+}
+
+// Error logs failures
+func (l *Logger) Error(msg string, keyvals ...interface{}) {
+	l.write(LevelError, msg, keyvals)
+}
+
+func (l *Logger) write(level Level, msg string, keyvals []interface{}) {
+	if l == nil {
+		l = defaultLogger
+	}
+
+	out := l.out
+	out.mu.Lock()
+	defer out.mu.Unlock()
+
+	if level < out.level {
+		return
+	}
+
+	entry := []interface{}{
+		"time", time.Now().UTC().Format(time.RFC3339),
+		"level", level.String(),
+		"msg", msg,
+	}
+	entry = append(entry, l.fields...)
+	entry = append(entry, keyvals...)
+	if len(entry)%2 != 0 {
+		entry = append(entry, "(missing)")
+	}
+
+	if out.format == "json" {
+		out.w.Write(formatJSON(entry))
+	} else {
+		out.w.Write(formatLogfmt(entry))
+	}
+}
+
+func formatJSON(keyvals []interface{}) []byte {
+	var buf bytes.Buffer
+
+	buf.WriteByte('{')
+	for i := 0; i < len(keyvals); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(fmt.Sprint(keyvals[i]))
+		value, err := json.Marshal(logValue(keyvals[i+1]))
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprint(keyvals[i+1]))
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteString("}\n")
+
+	return buf.Bytes()
+}
+
+func formatLogfmt(keyvals []interface{}) []byte {
+	var buf bytes.Buffer
+
+	for i := 0; i < len(keyvals); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(fmt.Sprint(keyvals[i]))
+		buf.WriteByte('=')
+
+		value := fmt.Sprint(logValue(keyvals[i+1]))
+		if value == "" || strings.ContainsAny(value, " =\"\n\t") {
+			value = strconv.Quote(value)
+		}
+		buf.WriteString(value)
+	}
+	buf.WriteByte('\n')
+
+	return buf.Bytes()
+}
+
+// logValue turns errors into their message, so they are not encoded as
+// empty JSON objects
+func logValue(value interface{}) interface{} {
+	if err, ok := value.(error); ok {
+		return err.Error()
+	}
+	return value
+}
+
+// logWriter logs every write as an entry, for loggers of other packages
+type logWriter struct {
+	logger *Logger
+	level  Level
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	w.logger.write(w.level, strings.TrimSuffix(string(p), "\n"), nil)
+	return len(p), nil
+}
+
+// Writer returns an io.Writer logging each write as an entry of level
+func (l *Logger) Writer(level Level) io.Writer {
+	return logWriter{logger: l, level: level}
+}
+
+// responseStatus returns the status code written to w
+func responseStatus(w http.ResponseWriter) int {
+	if rw, ok := w.(martini.ResponseWriter); ok && rw.Status() != 0 {
+		return rw.Status()
+	}
+	return http.StatusOK
+}
+
+// RequestLogger tags the request with an id, taken from the X-Request-ID
+// header when valid, and logs it once served. Handlers get a *Logger and a
+// *Connection carrying the id, so store errors can be traced to requests.
+func RequestLogger(c martini.Context, req *http.Request, w http.ResponseWriter, connection *Connection) {
+	requestID := req.Header.Get("X-Request-ID")
+	if !requestIDRegexp.MatchString(requestID) {
+		requestID = RandomToken(8)
+	}
+	w.Header().Set("X-Request-ID", requestID)
+
+	logger := defaultLogger.With("request_id", requestID)
+	c.Map(logger)
+	c.Map(connection.WithLogger(logger))
+
+	start := time.Now()
+	c.Next()
+
+	logger.Info("request",
+		"method", req.Method,
+		"path", loggedPath(c, req),
+		"status", responseStatus(w),
+		"duration_ms", time.Since(start).Nanoseconds()/int64(time.Millisecond),
+		"ip", ClientIP(req))
+}
+
+// loggedPath is the path of a request as logged. Routes taking a secret
+// token in the path, such as password reset links, log their pattern so the
+// token does not end up in the logs.
+func loggedPath(c martini.Context, req *http.Request) string {
+	if value := c.Get(routeType); value.IsValid() {
+		if pattern := value.Interface().(martini.Route).Pattern(); strings.Contains(pattern, ":token") {
+			return pattern
+		}
+	}
+
+	return req.URL.Path
+}
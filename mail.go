@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/hoisie/mustache"
+	"log"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Token kinds
+const (
+	TokenVerifyEmail   = "verify_email"
+	TokenResetPassword = "reset_password"
+	TokenInvite        = "invite"
+	TokenChangeEmail   = "change_email"
+)
+
+// How long emailed tokens can be used
+const (
+	VerifyEmailExpires   = 48 * time.Hour
+	ResetPasswordExpires = time.Hour
+)
+
+// Token for JSON schema. Only the hash of the token is stored, the token
+// itself is only sent by email.
+type Token struct {
+	ID      string `gorethink:"id" json:"id"`
+	Kind    string
+	User    string
+	Email   string
+	Expires int64
+}
+
+// NewToken creates a token of the given kind for an user, returning the
+// secret to email along with the document to store
+func NewToken(kind, userID, email string, expires time.Duration) (string, *Token) {
+	secret := RandomToken(32)
+	return secret, &Token{
+		ID:      HashToken(secret),
+		Kind:    kind,
+		User:    userID,
+		Email:   email,
+		Expires: time.Now().Add(expires).Unix(),
+	}
+}
+
+// HashToken returns the stored form of an emailed token
+func HashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Mailer sends emails through the configured SMTP relay. Without a relay
+// the emails are logged instead.
+type Mailer struct {
+	host     string
+	port     string
+	username string
+	password string
+	from     string
+	baseURL  string
+	sending  sync.WaitGroup
+}
+
+// NewMailer creates a mailer from the SMTP settings of the config
+func NewMailer(config *Config) *Mailer {
+	return &Mailer{
+		host:     config.SMTPHost,
+		port:     config.SMTPPort,
+		username: config.SMTPUsername,
+		password: config.SMTPPassword,
+		from:     config.MailFrom,
+		baseURL:  strings.TrimSuffix(config.BaseURL, "/"),
+	}
+}
+
+// Send sends a plain text email
+func (m *Mailer) Send(to, subject, body string) error {
+	if m.host == "" {
+		log.Printf("Mail to %s: %s\n%s", to, subject, body)
+		return nil
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", m.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	msg.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+
+	var auth smtp.Auth
+	if m.username != "" {
+		auth = smtp.PlainAuth("", m.username, m.password, m.host)
+	}
+
+	return smtp.SendMail(net.JoinHostPort(m.host, m.port), auth, m.from, []string{to}, msg.Bytes())
+}
+
+// SendTemplate renders an email template with the base URL in its context
+// and sends it in the background, logging failures
+func (m *Mailer) SendTemplate(to, subject, template string, context map[string]interface{}) {
+	context["base_url"] = m.baseURL
+	body := mustache.RenderFile("templates/"+template+".mustache", context)
+
+	m.sending.Add(1)
+	go func() {
+		defer m.sending.Done()
+		if err := m.Send(to, subject, body); err != nil {
+			defaultLogger.Error("mail failed", "template", template, "to", to, "err", err)
+		}
+	}()
+}
+
+// Wait waits for the emails being sent in the background
+func (m *Mailer) Wait() {
+	m.sending.Wait()
+}
+
+// SendVerification emails an user the link to verify their address
+func SendVerification(connection *Connection, mailer *Mailer, userID, username, email string) error {
+	secret, token := NewToken(TokenVerifyEmail, userID, email, VerifyEmailExpires)
+
+	if _, err := connection.NewToken(token); err != nil {
+		return err
+	}
+
+	mailer.SendTemplate(email, "Verify your Magnet email address", "email_verify", map[string]interface{}{
+		"username": username,
+		"token":    secret,
+	})
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+)
+
+// smtpMessage is an email received by the fake SMTP server
+type smtpMessage struct {
+	auth string
+	from string
+	to   []string
+	data string
+}
+
+// fakeSMTPServer accepts emails on 127.0.0.1, sending each one it receives
+// to the returned channel. With auth it advertises AUTH PLAIN.
+func fakeSMTPServer(t *testing.T, auth bool) (string, string, <-chan smtpMessage) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	messages := make(chan smtpMessage, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTP(conn, auth, messages)
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	return host, port, messages
+}
+
+func serveSMTP(conn net.Conn, auth bool, messages chan<- smtpMessage) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+	var message smtpMessage
+
+	reply("220 localhost ESMTP")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+		switch verb {
+		case "EHLO", "HELO":
+			if auth {
+				reply("250-localhost")
+				reply("250 AUTH PLAIN")
+			} else {
+				reply("250 localhost")
+			}
+		case "AUTH":
+			parts := strings.Fields(line)
+			decoded, _ := base64.StdEncoding.DecodeString(parts[len(parts)-1])
+			message.auth = string(decoded)
+			reply("235 Authenticated")
+		case "MAIL":
+			message.from = line[len("MAIL FROM:"):]
+			reply("250 OK")
+		case "RCPT":
+			message.to = append(message.to, line[len("RCPT TO:"):])
+			reply("250 OK")
+		case "DATA":
+			reply("354 Go ahead")
+			var data strings.Builder
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			message.data = data.String()
+			messages <- message
+			reply("250 OK")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func TestMailerSend(t *testing.T) {
+	host, port, messages := fakeSMTPServer(t, false)
+	mailer := NewMailer(&Config{SMTPHost: host, SMTPPort: port, MailFrom: "magnet@example.com"})
+
+	if err := mailer.Send("ana@example.com", "Hello", "first line\nsecond line"); err != nil {
+		t.Fatal(err)
+	}
+
+	message := <-messages
+	if message.from != "<magnet@example.com>" {
+		t.Errorf("from %q", message.from)
+	}
+	if len(message.to) != 1 || message.to[0] != "<ana@example.com>" {
+		t.Errorf("to %q", message.to)
+	}
+	for _, want := range []string{"Subject: Hello\r\n", "To: ana@example.com\r\n", "\r\n\r\nfirst line\r\nsecond line"} {
+		if !strings.Contains(message.data, want) {
+			t.Errorf("message does not contain %q:\n%s", want, message.data)
+		}
+	}
+}
+
+func TestMailerSendAuthenticates(t *testing.T) {
+	host, port, messages := fakeSMTPServer(t, true)
+	mailer := NewMailer(&Config{SMTPHost: host, SMTPPort: port, SMTPUsername: "magnet", SMTPPassword: "secret", MailFrom: "magnet@example.com"})
+
+	if err := mailer.Send("ana@example.com", "Hello", "body"); err != nil {
+		t.Fatal(err)
+	}
+
+	if message := <-messages; message.auth != "\x00magnet\x00secret" {
+		t.Errorf("auth %q", message.auth)
+	}
+}
+
+func TestMailerSendTemplate(t *testing.T) {
+	host, port, messages := fakeSMTPServer(t, false)
+	mailer := NewMailer(&Config{SMTPHost: host, SMTPPort: port, MailFrom: "magnet@example.com", BaseURL: "https://magnet.example.com/"})
+
+	mailer.SendTemplate("ana@example.com", "Verify", "email_verify", map[string]interface{}{
+		"username": "ana",
+		"token":    "abc",
+	})
+	mailer.Wait()
+
+	message := <-messages
+	if !strings.Contains(message.data, "https://magnet.example.com/verify/abc") {
+		t.Errorf("message does not contain the link:\n%s", message.data)
+	}
+}
+
+func TestNewTokenStoresHash(t *testing.T) {
+	secret, token := NewToken(TokenResetPassword, "user", "ana@example.com", ResetPasswordExpires)
+
+	if token.ID == secret || token.ID != HashToken(secret) {
+		t.Errorf("token id %q is not the hash of the secret", token.ID)
+	}
+	if token.Kind != TokenResetPassword || token.User != "user" || token.Email != "ana@example.com" {
+		t.Errorf("token %+v", token)
+	}
+}
@@ -1,12 +1,12 @@
 package main
 
-func main() {
-	config := Load()
-
-	DB := &Connection{}
+import (
+	"log"
+	"os"
+)
 
-	// Init database
-	DB.initDatabase(config.ConnectionString)
-
-	Start(DB, config)
+func main() {
+	if err := RunCLI(os.Args[1:]); err != nil {
+		log.Fatal(err)
+	}
 }
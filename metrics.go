@@ -0,0 +1,349 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"github.com/codegangsta/martini"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// instanceStatsInterval is how often the instance wide counts are refreshed,
+// as counting every table on each scrape is expensive
+const instanceStatsInterval = time.Minute
+
+// metricBuckets are the upper bounds, in seconds, of the latency histograms
+var metricBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var routeType = reflect.TypeOf((*martini.Route)(nil)).Elem()
+
+// histogram counts observations in metricBuckets
+type histogram struct {
+	counts []int64
+	sum    float64
+	count  int64
+}
+
+func (h *histogram) observe(seconds float64) {
+	if h.counts == nil {
+		h.counts = make([]int64, len(metricBuckets))
+	}
+
+	for i, bound := range metricBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// jobStatus tracks the runs of a background job
+type jobStatus struct {
+	lastRun     int64
+	lastSuccess int64
+	failures    int64
+}
+
+type requestKey struct {
+	method, route, status string
+}
+
+type routeKey struct {
+	method, route string
+}
+
+// gauge is a value read every time the metrics are written
+type gauge struct {
+	help  string
+	value func() float64
+}
+
+// Metrics collects request, store and background job figures, written out
+// in the Prometheus text format. A nil *Metrics ignores every observation,
+// so command line tools can use a Connection without it.
+type Metrics struct {
+	mu        sync.Mutex
+	requests  map[requestKey]int64
+	latencies map[routeKey]*histogram
+	queries   map[string]*histogram
+	jobs      map[string]*jobStatus
+	gauges    map[string]gauge
+}
+
+// NewMetrics returns empty metrics
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:  make(map[requestKey]int64),
+		latencies: make(map[routeKey]*histogram),
+		queries:   make(map[string]*histogram),
+		jobs:      make(map[string]*jobStatus),
+		gauges:    make(map[string]gauge),
+	}
+}
+
+// ObserveRequest records a request served by a route pattern
+func (m *Metrics) ObserveRequest(method, route string, status int, start time.Time) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[requestKey{method, route, strconv.Itoa(status)}]++
+
+	key := routeKey{method, route}
+	if m.latencies[key] == nil {
+		m.latencies[key] = new(histogram)
+	}
+	m.latencies[key].observe(time.Since(start).Seconds())
+}
+
+// ObserveQuery records the latency of a Connection method, it is meant to
+// be deferred at the start of the method
+func (m *Metrics) ObserveQuery(method string, start time.Time) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.queries[method] == nil {
+		m.queries[method] = new(histogram)
+	}
+	m.queries[method].observe(time.Since(start).Seconds())
+}
+
+// JobRun records a run of a background job, failed if err is not nil
+func (m *Metrics) JobRun(job string, err error) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status := m.jobs[job]
+	if status == nil {
+		status = new(jobStatus)
+		m.jobs[job] = status
+	}
+
+	status.lastRun = time.Now().Unix()
+	if err != nil {
+		status.failures++
+	} else {
+		status.lastSuccess = status.lastRun
+	}
+}
+
+// Gauge registers a value read every time the metrics are written
+func (m *Metrics) Gauge(name, help string, value func() float64) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	m.gauges[name] = gauge{help, value}
+	m.mu.Unlock()
+}
+
+// Print writes the metrics in the Prometheus text format
+func (m *Metrics) Print(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeHeader(w, "magnet_http_requests_total", "counter", "HTTP requests by route and status.")
+	requests := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		requests = append(requests, key)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		a, b := requests[i], requests[j]
+		return a.route+a.method+a.status < b.route+b.method+b.status
+	})
+	for _, key := range requests {
+		fmt.Fprintf(w, "magnet_http_requests_total{method=%q,route=%q,status=%q} %d\n", key.method, key.route, key.status, m.requests[key])
+	}
+
+	writeHeader(w, "magnet_http_request_duration_seconds", "histogram", "HTTP request latencies by route.")
+	routes := make([]routeKey, 0, len(m.latencies))
+	for key := range m.latencies {
+		routes = append(routes, key)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].route+routes[i].method < routes[j].route+routes[j].method
+	})
+	for _, key := range routes {
+		labels := fmt.Sprintf("method=%q,route=%q", key.method, key.route)
+		writeHistogram(w, "magnet_http_request_duration_seconds", labels, m.latencies[key])
+	}
+
+	writeHeader(w, "magnet_store_query_duration_seconds", "histogram", "Store query latencies by Connection method.")
+	for _, method := range sortedKeys(m.queries) {
+		writeHistogram(w, "magnet_store_query_duration_seconds", fmt.Sprintf("method=%q", method), m.queries[method])
+	}
+
+	jobs := make([]string, 0, len(m.jobs))
+	for job := range m.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Strings(jobs)
+
+	writeHeader(w, "magnet_job_last_run_timestamp_seconds", "gauge", "Last run of a background job.")
+	for _, job := range jobs {
+		fmt.Fprintf(w, "magnet_job_last_run_timestamp_seconds{job=%q} %d\n", job, m.jobs[job].lastRun)
+	}
+	writeHeader(w, "magnet_job_last_success_timestamp_seconds", "gauge", "Last successful run of a background job.")
+	for _, job := range jobs {
+		fmt.Fprintf(w, "magnet_job_last_success_timestamp_seconds{job=%q} %d\n", job, m.jobs[job].lastSuccess)
+	}
+	writeHeader(w, "magnet_job_failures_total", "counter", "Failed runs of a background job.")
+	for _, job := range jobs {
+		fmt.Fprintf(w, "magnet_job_failures_total{job=%q} %d\n", job, m.jobs[job].failures)
+	}
+
+	gauges := make([]string, 0, len(m.gauges))
+	for name := range m.gauges {
+		gauges = append(gauges, name)
+	}
+	sort.Strings(gauges)
+	for _, name := range gauges {
+		writeHeader(w, name, "gauge", m.gauges[name].help)
+		fmt.Fprintf(w, "%s %s\n", name, formatFloat(m.gauges[name].value()))
+	}
+}
+
+func sortedKeys(histograms map[string]*histogram) []string {
+	keys := make([]string, 0, len(histograms))
+	for key := range histograms {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeHeader(w io.Writer, name, kind, help string) {
+	if help != "" {
+		fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	}
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+func writeHistogram(w io.Writer, name, labels string, h *histogram) {
+	for i, bound := range metricBuckets {
+		fmt.Fprintf(w, "%s_bucket{%s,le=%q} %d\n", name, labels, formatFloat(bound), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+	fmt.Fprintf(w, "%s_sum{%s} %s\n", name, labels, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// MetricsMiddleware times every request and counts it by the pattern of the
+// route that served it, so paths with ids don't each get their own series
+func MetricsMiddleware(c martini.Context, req *http.Request, w http.ResponseWriter, metrics *Metrics) {
+	start := time.Now()
+	c.Next()
+
+	route := "unmatched"
+	if value := c.Get(routeType); value.IsValid() {
+		route = value.Interface().(martini.Route).Pattern()
+	}
+
+	status := http.StatusOK
+	if rw, ok := w.(martini.ResponseWriter); ok && rw.Status() != 0 {
+		status = rw.Status()
+	}
+
+	metrics.ObserveRequest(req.Method, route, status, start)
+}
+
+// HealthHandler tells the process is up, without checking its dependencies
+func HealthHandler(w http.ResponseWriter) {
+	WriteAPIResponse(200, map[string]string{"status": "ok"}, w)
+}
+
+// ReadyHandler tells whether the store answers, so an orchestrator only
+// sends traffic to instances that can serve it. Instances shutting down are
+// not ready.
+func ReadyHandler(w http.ResponseWriter, connection *Connection, shutdown Shutdown, logger *Logger) {
+	if shutdown.Draining() {
+		WriteAPIResponse(503, map[string]string{"status": "unavailable"}, w)
+		return
+	}
+
+	if err := connection.Ping(); err != nil {
+		logger.Error("database not ready", "err", err)
+		WriteAPIResponse(503, map[string]string{"status": "unavailable", "database": "unavailable"}, w)
+		return
+	}
+
+	WriteAPIResponse(200, map[string]string{"status": "ok", "database": "ok"}, w)
+}
+
+// WatchInstanceStats keeps the instance wide counts as gauges, counting
+// them again every interval until stop is closed
+func WatchInstanceStats(connection *Connection, interval time.Duration, stop <-chan struct{}) {
+	var mu sync.Mutex
+	var stats InstanceStats
+
+	for _, count := range []struct {
+		name, help string
+		value      func() int64
+	}{
+		{"magnet_users", "Registered users.", func() int64 { return stats.Users }},
+		{"magnet_bookmarks", "Bookmarks of every user.", func() int64 { return stats.Bookmarks }},
+		{"magnet_active_sessions", "Sessions not expired.", func() int64 { return stats.ActiveSessions }},
+		{"magnet_webhooks", "Registered webhooks.", func() int64 { return stats.Webhooks }},
+	} {
+		value := count.value
+		connection.metrics.Gauge(count.name, count.help, func() float64 {
+			mu.Lock()
+			defer mu.Unlock()
+			return float64(value())
+		})
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		latest, err := connection.GetInstanceStats()
+		connection.metrics.JobRun("instance_stats", err)
+		if err == nil {
+			mu.Lock()
+			stats = *latest
+			mu.Unlock()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// MetricsHandler writes out the metrics. With a MetricsToken set, scrapers
+// must send it as a bearer token.
+func MetricsHandler(req *http.Request, w http.ResponseWriter, metrics *Metrics, cfg *Config) {
+	if cfg.MetricsToken != "" && subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), []byte("Bearer "+cfg.MetricsToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.Print(w)
+}
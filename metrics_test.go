@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsHandlerToken(t *testing.T) {
+	cfg := &Config{MetricsToken: "scrape"}
+	metrics := NewMetrics()
+	metrics.Gauge("magnet_users", "Registered users.", func() float64 { return 3 })
+
+	for header, status := range map[string]int{"": 401, "Bearer other": 401, "Bearer scrapes": 401, "Bearer scrape": 200} {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		w := httptest.NewRecorder()
+		MetricsHandler(req, w, metrics, cfg)
+
+		if w.Code != status {
+			t.Errorf("%q: status %d, want %d", header, w.Code, status)
+		}
+		if status == 200 && !strings.Contains(w.Body.String(), "# HELP magnet_users Registered users.\n# TYPE magnet_users gauge\nmagnet_users 3\n") {
+			t.Errorf("gauge missing:\n%s", w.Body.String())
+		}
+	}
+}
+
+func TestValidateRequiresMetricsTokenInProduction(t *testing.T) {
+	cfg := &Config{Production: true, MetricsToken: ""}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "MAGNET_METRICS_TOKEN") {
+		t.Errorf("error %v", err)
+	}
+}
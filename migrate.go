@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// Migration upgrades the database schema to a version
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(c *Connection) error
+}
+
+// Index is a secondary index of a table. Multi indexes store one entry for
+// each element of an array field.
+type Index struct {
+	Table string
+	Field string
+	Multi bool
+}
+
+// DatabaseTables lists every table used by Magnet
+var DatabaseTables = []string{
+	"users",
+	"bookmarks",
+	"sessions",
+	"tokens",
+	"tombstones",
+	"saved_searches",
+	"webhooks",
+	"webhook_deliveries",
+	"webhook_retries",
+	"webhook_claims",
+	"audit_log",
+}
+
+// DatabaseIndexes lists the secondary indexes of every table
+var DatabaseIndexes = []Index{
+	{Table: "bookmarks", Field: "Created"},
+	{Table: "bookmarks", Field: "User"},
+	{Table: "bookmarks", Field: "Tags", Multi: true},
+}
+
+// migrations are applied in order, each one exactly once. Never edit or
+// reorder a released migration, append a new one instead.
+var migrations = []Migration{
+	{1, "Create tables and the Created index", func(c *Connection) error {
+		// The tables of the first schema, later ones are created by their
+		// own migrations
+		tables := []string{
+			"users",
+			"bookmarks",
+			"sessions",
+			"tokens",
+			"tombstones",
+			"saved_searches",
+			"webhooks",
+			"webhook_deliveries",
+			"audit_log",
+		}
+		for _, table := range tables {
+			if err := c.CreateTable(table); err != nil {
+				return err
+			}
+		}
+		return c.CreateIndex("bookmarks", "Created", false)
+	}},
+	{2, "Rename the Url field of bookmarks to URL", func(c *Connection) error {
+		response, err := c.RenameBookmarkField("Url", "URL")
+		if err == nil && response.Replaced > 0 {
+			log.Printf("Renamed the Url field of %d bookmarks", response.Replaced)
+		}
+		return err
+	}},
+	{3, "Add User and Tags indexes to bookmarks", func(c *Connection) error {
+		if err := c.CreateIndex("bookmarks", "User", false); err != nil {
+			return err
+		}
+		return c.CreateIndex("bookmarks", "Tags", true)
+	}},
+	{4, "Close sessions stored under their cookie id", func(c *Connection) error {
+		// Sessions are now stored under the hash of their token, so the
+		// old ones can't be found from any cookie
+		response, err := c.DeleteAllSessions()
+		if err == nil && response.Deleted > 0 {
+			log.Printf("Closed %d sessions", response.Deleted)
+		}
+		return err
+	}},
+	{5, "Create the webhook_retries table", func(c *Connection) error {
+		return c.CreateTable("webhook_retries")
+	}},
+	{6, "Create the webhook_claims table", func(c *Connection) error {
+		return c.CreateTable("webhook_claims")
+	}},
+}
+
+// LatestSchemaVersion is the schema version this build of Magnet expects
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// Migrate applies every pending migration. It refuses to touch a database
+// migrated by a newer Magnet.
+func Migrate(c *Connection) error {
+	if err := c.CreateDatabase(); err != nil {
+		return fmt.Errorf("creating database: %s", err)
+	}
+
+	version, err := c.SchemaVersion()
+	if err != nil {
+		return fmt.Errorf("reading schema version: %s", err)
+	}
+
+	if version > LatestSchemaVersion() {
+		return fmt.Errorf("database schema version %d is newer than %d, upgrade Magnet", version, LatestSchemaVersion())
+	}
+
+	for _, migration := range migrations {
+		if migration.Version <= version {
+			continue
+		}
+
+		log.Printf("Migrating database to version %d: %s", migration.Version, migration.Description)
+		if err := migration.Up(c); err != nil {
+			return fmt.Errorf("migration %d: %s", migration.Version, err)
+		}
+		if _, err := c.RecordMigration(migration); err != nil {
+			return fmt.Errorf("recording migration %d: %s", migration.Version, err)
+		}
+	}
+
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
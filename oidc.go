@@ -0,0 +1,551 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	oidcTimeout = 10 * time.Second
+	// oidcSkew is the clock difference allowed when checking token times
+	oidcSkew = 2 * time.Minute
+	// oidcKeysMinAge keeps unknown key ids from refetching the keys on
+	// every login
+	oidcKeysMinAge = time.Minute
+)
+
+// OIDCClaims for JSON schema, the ID token claims used to find the user
+type OIDCClaims struct {
+	Issuer            string      `json:"iss"`
+	Subject           string      `json:"sub"`
+	Audience          interface{} `json:"aud"`
+	AuthorizedParty   string      `json:"azp"`
+	Expires           float64     `json:"exp"`
+	IssuedAt          float64     `json:"iat"`
+	Nonce             string      `json:"nonce"`
+	Email             string      `json:"email"`
+	EmailVerified     interface{} `json:"email_verified"`
+	PreferredUsername string      `json:"preferred_username"`
+	Name              string      `json:"name"`
+}
+
+// oidcDiscovery is the part of the provider metadata Magnet needs
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// OIDCProvider logs users in with an OpenID Connect provider using the
+// authorization code flow with PKCE
+type OIDCProvider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	scopes       string
+	client       *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]crypto.PublicKey
+	keysTime  time.Time
+}
+
+// NewOIDCProvider creates a provider from the config, or returns nil if
+// OpenID Connect is not configured. The provider metadata is fetched on the
+// first login.
+func NewOIDCProvider(config *Config) *OIDCProvider {
+	if config.OIDCIssuer == "" {
+		return nil
+	}
+
+	redirectURL := config.OIDCRedirectURL
+	if redirectURL == "" {
+		redirectURL = strings.TrimSuffix(config.BaseURL, "/") + "/login/oidc/callback"
+	}
+
+	return &OIDCProvider{
+		issuer:       strings.TrimSuffix(config.OIDCIssuer, "/"),
+		clientID:     config.OIDCClientID,
+		clientSecret: config.OIDCClientSecret,
+		redirectURL:  redirectURL,
+		scopes:       config.OIDCScopes,
+		client:       &http.Client{Timeout: oidcTimeout},
+	}
+}
+
+// PKCEChallenge returns the S256 code challenge of a verifier
+func PKCEChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthURL returns the URL of the provider the user is sent to
+func (p *OIDCProvider) AuthURL(state, nonce, verifier string) (string, error) {
+	discovery, err := p.metadata()
+	if err != nil {
+		return "", err
+	}
+
+	values := url.Values{}
+	values.Set("response_type", "code")
+	values.Set("client_id", p.clientID)
+	values.Set("redirect_uri", p.redirectURL)
+	values.Set("scope", p.scopes)
+	values.Set("state", state)
+	values.Set("nonce", nonce)
+	values.Set("code_challenge", PKCEChallenge(verifier))
+	values.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+
+	return discovery.AuthorizationEndpoint + separator + values.Encode(), nil
+}
+
+// Exchange trades an authorization code for the ID token and returns its
+// verified claims
+func (p *OIDCProvider) Exchange(code, verifier, nonce string) (*OIDCClaims, error) {
+	discovery, err := p.metadata()
+	if err != nil {
+		return nil, err
+	}
+
+	values := url.Values{}
+	values.Set("grant_type", "authorization_code")
+	values.Set("code", code)
+	values.Set("redirect_uri", p.redirectURL)
+	values.Set("client_id", p.clientID)
+	values.Set("code_verifier", verifier)
+
+	req, err := http.NewRequest("POST", discovery.TokenEndpoint, strings.NewReader(values.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.clientSecret))
+	}
+
+	var token struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := p.doJSON(req, &token); err != nil && token.Error == "" {
+		return nil, err
+	}
+
+	if token.Error != "" {
+		return nil, fmt.Errorf("token endpoint: %s %s", token.Error, token.ErrorDescription)
+	}
+
+	if token.IDToken == "" {
+		return nil, errors.New("token endpoint: no id_token in the response")
+	}
+
+	return p.VerifyIDToken(token.IDToken, nonce)
+}
+
+// VerifyIDToken checks the signature, issuer, audience, times and nonce of
+// an ID token and returns its claims
+func (p *OIDCProvider) VerifyIDToken(raw, nonce string) (*OIDCClaims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("id token: malformed")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("id token: malformed signature")
+	}
+
+	if err := verifyJWTSignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	claims := new(OIDCClaims)
+	if err := decodeJWTPart(parts[1], claims); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	switch {
+	case strings.TrimSuffix(claims.Issuer, "/") != p.issuer:
+		return nil, fmt.Errorf("id token: unexpected issuer %q", claims.Issuer)
+	case !claims.hasAudience(p.clientID):
+		return nil, errors.New("id token: not issued for this client")
+	case claims.AuthorizedParty != "" && claims.AuthorizedParty != p.clientID:
+		return nil, errors.New("id token: issued to another party")
+	case time.Unix(int64(claims.Expires), 0).Add(oidcSkew).Before(now):
+		return nil, errors.New("id token: expired")
+	case time.Unix(int64(claims.IssuedAt), 0).Add(-oidcSkew).After(now):
+		return nil, errors.New("id token: issued in the future")
+	case claims.Nonce != nonce:
+		return nil, errors.New("id token: nonce mismatch")
+	case claims.Subject == "":
+		return nil, errors.New("id token: no subject")
+	}
+
+	return claims, nil
+}
+
+// UserSubject returns the value stored in User.OIDCSubject, unique across
+// providers
+func (c *OIDCClaims) UserSubject() string {
+	return c.Issuer + "|" + c.Subject
+}
+
+// IsEmailVerified tells if the provider vouches for the email, which some
+// providers send as a string
+func (c *OIDCClaims) IsEmailVerified() bool {
+	switch verified := c.EmailVerified.(type) {
+	case bool:
+		return verified
+	case string:
+		return verified == "true"
+	}
+	return false
+}
+
+func (c *OIDCClaims) hasAudience(clientID string) bool {
+	switch audience := c.Audience.(type) {
+	case string:
+		return audience == clientID
+	case []interface{}:
+		for _, value := range audience {
+			if value == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// metadata returns the provider metadata, fetching it the first time
+func (p *OIDCProvider) metadata() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	req, err := http.NewRequest("GET", p.issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	discovery := new(oidcDiscovery)
+	if err := p.doJSON(req, discovery); err != nil {
+		return nil, fmt.Errorf("discovery: %s", err)
+	}
+
+	if strings.TrimSuffix(discovery.Issuer, "/") != p.issuer {
+		return nil, fmt.Errorf("discovery: issuer %q does not match %q", discovery.Issuer, p.issuer)
+	}
+
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, errors.New("discovery: missing endpoints")
+	}
+
+	p.discovery = discovery
+	return discovery, nil
+}
+
+// key returns the signing key with an id, fetching the keys again if it is
+// unknown since providers rotate them
+func (p *OIDCProvider) key(kid string) (crypto.PublicKey, error) {
+	discovery, err := p.metadata()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.findKey(kid); ok {
+		return key, nil
+	}
+
+	if time.Since(p.keysTime) < oidcKeysMinAge {
+		return nil, fmt.Errorf("id token: unknown key %q", kid)
+	}
+
+	req, err := http.NewRequest("GET", discovery.JWKSURI, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := p.doJSON(req, &jwks); err != nil {
+		return nil, fmt.Errorf("jwks: %s", err)
+	}
+
+	p.keys = make(map[string]crypto.PublicKey)
+	p.keysTime = time.Now()
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if key, err := jwk.publicKey(); err == nil {
+			p.keys[jwk.Kid] = key
+		}
+	}
+
+	if key, ok := p.findKey(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("id token: unknown key %q", kid)
+}
+
+// findKey looks a key up by id. Tokens without a key id can only use the
+// only key of the provider.
+func (p *OIDCProvider) findKey(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+
+	key, ok := p.keys[kid]
+	return key, ok
+}
+
+func (p *OIDCProvider) doJSON(req *http.Request, value interface{}) error {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	jsonErr := json.Unmarshal(body, value)
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return jsonErr
+}
+
+// jsonWebKey is a key of the provider JWK set
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, errN := decodeBigInt(k.N)
+		e, errE := decodeBigInt(k.E)
+		if errN != nil || errE != nil || !e.IsInt64() {
+			return nil, errors.New("jwk: invalid RSA key")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("jwk: unsupported curve %q", k.Crv)
+		}
+		x, errX := decodeBigInt(k.X)
+		y, errY := decodeBigInt(k.Y)
+		if errX != nil || errY != nil || !elliptic.P256().IsOnCurve(x, y) {
+			return nil, errors.New("jwk: invalid EC key")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+
+	return nil, fmt.Errorf("jwk: unsupported key type %q", k.Kty)
+}
+
+// verifyJWTSignature checks a RS256 or ES256 signature
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed, signature []byte) error {
+	sum := sha256.Sum256(signed)
+
+	switch alg {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, sum[:], signature) != nil {
+			return errors.New("id token: invalid signature")
+		}
+		return nil
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return errors.New("id token: invalid signature")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(ecKey, sum[:], r, s) {
+			return errors.New("id token: invalid signature")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("id token: unsupported algorithm %q", alg)
+}
+
+func decodeJWTPart(part string, value interface{}) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("id token: malformed")
+	}
+
+	if err := json.Unmarshal(decoded, value); err != nil {
+		return errors.New("id token: malformed")
+	}
+	return nil
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(decoded), nil
+}
+
+// ErrOIDCUnknownUser is returned when the claims match no user and users
+// are not created automatically
+var ErrOIDCUnknownUser = errors.New("no user for this account")
+
+// ErrOIDCEmailTaken is returned when a new user would have the email of an
+// existing one that cannot be linked
+var ErrOIDCEmailTaken = errors.New("the email belongs to another user")
+
+// OIDCUser finds the user the claims belong to. Depending on the config an
+// existing user with the same email, verified on both sides, is linked, or a new user is
+// created if the registration mode lets them in.
+func OIDCUser(connection *Connection, cfg *Config, registration *Registration, claims *OIDCClaims) (*User, error) {
+	user, err := connection.GetUserByOIDCSubject(claims.UserSubject())
+	if err != nil || user != nil {
+		return user, err
+	}
+
+	if claims.Email != "" {
+		existing, err := connection.GetUserByEmail(claims.Email)
+		if err != nil {
+			return nil, err
+		}
+
+		if existing != nil {
+			// Both addresses must be verified, or someone could sign up
+			// with the email of a victim before they first use the
+			// provider and take over the account once they do
+			if !cfg.OIDCLinkEmail || !claims.IsEmailVerified() || !existing.EmailVerified || existing.OIDCSubject != "" {
+				return nil, ErrOIDCEmailTaken
+			}
+
+			if _, err := connection.LinkOIDCSubject(existing.ID, claims.UserSubject()); err != nil {
+				return nil, err
+			}
+			return existing, nil
+		}
+	}
+
+	if !cfg.OIDCAutoProvision || !registration.Provisions(claims.Email, claims.IsEmailVerified()) {
+		return nil, ErrOIDCUnknownUser
+	}
+
+	username, err := availableUsername(connection, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	// Without a password the user can only log in through the provider
+	user = &User{
+		Username:      username,
+		Email:         claims.Email,
+		EmailVerified: claims.IsEmailVerified(),
+		OIDCSubject:   claims.UserSubject(),
+	}
+
+	response, err := connection.SignUpInsert(user)
+	if err != nil {
+		return nil, err
+	}
+	if response.Inserted < 1 {
+		return nil, errors.New("error creating the user")
+	}
+
+	user.ID = response.GeneratedKeys[0]
+	return user, nil
+}
+
+// availableUsername picks an unused username from the claims
+func availableUsername(connection *Connection, claims *OIDCClaims) (string, error) {
+	base := claims.PreferredUsername
+	if base == "" {
+		base = strings.SplitN(claims.Email, "@", 2)[0]
+	}
+
+	base = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-' {
+			return r
+		}
+		return -1
+	}, base)
+	if base == "" {
+		base = "user"
+	}
+
+	for i := 1; i <= 100; i++ {
+		username := base
+		if i > 1 {
+			username = fmt.Sprintf("%s%d", base, i)
+		}
+
+		user, err := connection.GetUserByUsername(username)
+		if err != nil {
+			return "", err
+		}
+		if user == nil {
+			return username, nil
+		}
+	}
+
+	return base + "-" + RandomToken(4), nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testClientID = "magnet"
+
+// mockIssuer is an OpenID Connect provider serving discovery, JWKS and a
+// token endpoint that checks the PKCE verifier
+type mockIssuer struct {
+	server *httptest.Server
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]mockGrant
+}
+
+// mockGrant is what the provider remembers of an authorization request
+type mockGrant struct {
+	challenge string
+	nonce     string
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issuer := &mockIssuer{rsaKey: rsaKey, ecKey: ecKey, codes: make(map[string]mockGrant)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 issuer.server.URL,
+			"authorization_endpoint": issuer.server.URL + "/authorize",
+			"token_endpoint":         issuer.server.URL + "/token",
+			"jwks_uri":               issuer.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa", "use": "sig", "n": encodeBigInt(rsaKey.N), "e": encodeBigInt(big.NewInt(int64(rsaKey.E)))},
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "x": encodeBigInt(ecKey.X), "y": encodeBigInt(ecKey.Y)},
+		}})
+	})
+	mux.HandleFunc("/token", issuer.token)
+	issuer.server = httptest.NewServer(mux)
+	t.Cleanup(issuer.server.Close)
+
+	return issuer
+}
+
+// authorize does what the provider does when the user logs in, returning
+// the code sent back to Magnet
+func (m *mockIssuer) authorize(t *testing.T, authURL string) string {
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := parsed.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("client_id") != testClientID {
+		t.Fatalf("unexpected authorization request %s", authURL)
+	}
+
+	code := RandomToken(8)
+	m.mu.Lock()
+	m.codes[code] = mockGrant{challenge: query.Get("code_challenge"), nonce: query.Get("nonce")}
+	m.mu.Unlock()
+	return code
+}
+
+func (m *mockIssuer) token(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+
+	m.mu.Lock()
+	grant, ok := m.codes[req.PostForm.Get("code")]
+	delete(m.codes, req.PostForm.Get("code"))
+	m.mu.Unlock()
+
+	if !ok || PKCEChallenge(req.PostForm.Get("code_verifier")) != grant.challenge {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"id_token": m.sign("rsa", m.claims(grant.nonce))})
+}
+
+func (m *mockIssuer) claims(nonce string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":            m.server.URL,
+		"sub":            "ana",
+		"aud":            testClientID,
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          nonce,
+		"email":          "ana@example.com",
+		"email_verified": true,
+	}
+}
+
+// sign returns an ID token signed with the RSA or EC key
+func (m *mockIssuer) sign(kid string, claims map[string]interface{}) string {
+	alg := "RS256"
+	if kid == "ec" {
+		alg = "ES256"
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	if kid == "ec" {
+		r, s, _ := ecdsa.Sign(rand.Reader, m.ecKey, sum[:])
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	} else {
+		signature, _ = rsa.SignPKCS1v15(rand.Reader, m.rsaKey, crypto.SHA256, sum[:])
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (m *mockIssuer) provider() *OIDCProvider {
+	return NewOIDCProvider(&Config{
+		OIDCIssuer:   m.server.URL,
+		OIDCClientID: testClientID,
+		OIDCScopes:   "openid email",
+		BaseURL:      "https://magnet.example.com",
+	})
+}
+
+func encodeBigInt(n *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(n.Bytes())
+}
+
+func TestOIDCLogin(t *testing.T) {
+	issuer := newMockIssuer(t)
+	provider := issuer.provider()
+	state, nonce, verifier := RandomToken(16), RandomToken(16), RandomToken(32)
+
+	authURL, err := provider.AuthURL(state, nonce, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(authURL, "redirect_uri="+url.QueryEscape("https://magnet.example.com/login/oidc/callback")) {
+		t.Errorf("redirect_uri missing from %s", authURL)
+	}
+
+	claims, err := provider.Exchange(issuer.authorize(t, authURL), verifier, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.UserSubject() != issuer.server.URL+"|ana" || !claims.IsEmailVerified() {
+		t.Errorf("claims %+v", claims)
+	}
+}
+
+func TestOIDCExchangeChecksVerifier(t *testing.T) {
+	issuer := newMockIssuer(t)
+	provider := issuer.provider()
+	nonce := RandomToken(16)
+
+	authURL, err := provider.AuthURL(RandomToken(16), nonce, RandomToken(32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := provider.Exchange(issuer.authorize(t, authURL), RandomToken(32), nonce); err == nil {
+		t.Error("code exchanged with another verifier")
+	}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	issuer := newMockIssuer(t)
+	provider := issuer.provider()
+
+	if _, err := provider.VerifyIDToken(issuer.sign("ec", issuer.claims("n")), "n"); err != nil {
+		t.Errorf("ES256 token: %s", err)
+	}
+
+	tests := []struct {
+		name   string
+		kid    string
+		change func(claims map[string]interface{})
+	}{
+		{"other issuer", "rsa", func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" }},
+		{"other audience", "rsa", func(c map[string]interface{}) { c["aud"] = "other" }},
+		{"other party", "rsa", func(c map[string]interface{}) { c["azp"] = "other" }},
+		{"expired", "rsa", func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() }},
+		{"issued in the future", "rsa", func(c map[string]interface{}) { c["iat"] = time.Now().Add(time.Hour).Unix() }},
+		{"other nonce", "rsa", func(c map[string]interface{}) { c["nonce"] = "other" }},
+		{"no subject", "rsa", func(c map[string]interface{}) { c["sub"] = "" }},
+		{"unknown key", "other", func(c map[string]interface{}) {}},
+	}
+
+	for _, test := range tests {
+		claims := issuer.claims("n")
+		test.change(claims)
+
+		if _, err := provider.VerifyIDToken(issuer.sign(test.kid, claims), "n"); err == nil {
+			t.Errorf("%s: accepted", test.name)
+		}
+	}
+
+	token := issuer.sign("rsa", issuer.claims("n"))
+	tampered := token[:len(token)-4] + "AAAA"
+	if _, err := provider.VerifyIDToken(tampered, "n"); err == nil {
+		t.Error("tampered signature accepted")
+	}
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/codegangsta/martini"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// OpenAPISpecPath is where the OpenAPI document is read from. As it lives in
+// the public folder it is also served at /openapi.json.
+const OpenAPISpecPath = "public/openapi.json"
+
+var openAPIMethods = []string{"get", "post", "put", "patch", "delete", "head", "options"}
+
+// OpenAPISpec is a parsed OpenAPI 3 document
+type OpenAPISpec struct {
+	document map[string]interface{}
+	paths    map[string]interface{}
+}
+
+// LoadOpenAPISpec reads and parses the OpenAPI document at path
+func LoadOpenAPISpec(path string) (*OpenAPISpec, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	spec := &OpenAPISpec{}
+	if err := json.Unmarshal(content, &spec.document); err != nil {
+		return nil, fmt.Errorf("parsing %s: %s", path, err)
+	}
+
+	spec.paths, _ = spec.document["paths"].(map[string]interface{})
+	if spec.paths == nil {
+		return nil, fmt.Errorf("%s has no paths", path)
+	}
+
+	return spec, nil
+}
+
+// CheckRoutes compares the registered routes with the documented ones and
+// returns a description of every difference
+func (s *OpenAPISpec) CheckRoutes(routes []martini.Route) []string {
+	var problems []string
+	registered := make(map[string]bool)
+
+	for _, route := range routes {
+		method := strings.ToLower(route.Method())
+		template := openAPITemplate(route.Pattern())
+		registered[method+" "+template] = true
+
+		if s.operation(method, template) == nil {
+			problems = append(problems, fmt.Sprintf("route %s %s is not documented", route.Method(), template))
+		}
+	}
+
+	for template, item := range s.paths {
+		for _, method := range openAPIMethods {
+			// Operations marked x-optional depend on the config
+			op, ok := item.(map[string]interface{})[method].(map[string]interface{})
+			if optional, _ := op["x-optional"].(bool); ok && !optional && !registered[method+" "+template] {
+				problems = append(problems, fmt.Sprintf("documented route %s %s is not registered", strings.ToUpper(method), template))
+			}
+		}
+	}
+
+	sort.Strings(problems)
+	return problems
+}
+
+// ValidateRequest checks the parameters and body of a request against the
+// documented operation. Requests for undocumented paths are ignored.
+func (s *OpenAPISpec) ValidateRequest(req *http.Request, body []byte) error {
+	template, pathParams := s.match(req.URL.Path)
+	if template == "" {
+		return nil
+	}
+
+	op := s.operation(strings.ToLower(req.Method), template)
+	if op == nil {
+		return fmt.Errorf("%s %s is not documented", req.Method, template)
+	}
+
+	for _, param := range s.parameters(template, op) {
+		name, _ := param["name"].(string)
+		schema, _ := param["schema"].(map[string]interface{})
+		var value string
+		var present bool
+
+		switch param["in"] {
+		case "path":
+			value, present = pathParams[name]
+		case "query":
+			_, present = req.URL.Query()[name]
+			value = req.URL.Query().Get(name)
+		default:
+			continue
+		}
+
+		if !present {
+			if required, _ := param["required"].(bool); required {
+				return fmt.Errorf("parameter %s is required", name)
+			}
+			continue
+		}
+
+		if err := s.validateParameter(schema, value); err != nil {
+			return fmt.Errorf("parameter %s %s", name, err)
+		}
+	}
+
+	requestBody := s.resolve(op["requestBody"])
+	if requestBody == nil || (len(body) == 0 && req.Method == "GET") {
+		return nil
+	}
+
+	if len(body) == 0 {
+		if required, _ := requestBody["required"].(bool); required {
+			return fmt.Errorf("request body is required")
+		}
+		return nil
+	}
+
+	contentType := mediaType(req.Header.Get("Content-Type"))
+	content, _ := requestBody["content"].(map[string]interface{})
+	media, ok := content[contentType].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("request content type %q is not documented", contentType)
+	}
+
+	value, err := decodeBody(contentType, body)
+	if err != nil {
+		return fmt.Errorf("request body: %s", err)
+	}
+
+	return s.validate(media["schema"], value, "request body")
+}
+
+// ValidateResponse checks the status, content type and body of a response
+// against the documented operation. Responses for undocumented paths are
+// ignored.
+func (s *OpenAPISpec) ValidateResponse(method, path string, status int, contentType string, body []byte) error {
+	template, _ := s.match(path)
+	if template == "" {
+		return nil
+	}
+
+	op := s.operation(strings.ToLower(method), template)
+	if op == nil {
+		return fmt.Errorf("%s %s is not documented", method, template)
+	}
+
+	responses, _ := op["responses"].(map[string]interface{})
+	response := s.resolve(responses[strconv.Itoa(status)])
+	if response == nil {
+		response = s.resolve(responses["default"])
+	}
+	if response == nil {
+		return fmt.Errorf("status %d is not documented for %s %s", status, method, template)
+	}
+
+	content, _ := response["content"].(map[string]interface{})
+	if len(content) == 0 {
+		if len(body) > 0 {
+			return fmt.Errorf("status %d should not have a body", status)
+		}
+		return nil
+	}
+
+	contentType = mediaType(contentType)
+	media, ok := content[contentType].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("response content type %q is not documented for status %d", contentType, status)
+	}
+
+	if contentType != "application/json" {
+		return nil
+	}
+
+	value, err := decodeBody(contentType, body)
+	if err != nil {
+		return fmt.Errorf("response body: %s", err)
+	}
+
+	return s.validate(media["schema"], value, "response body")
+}
+
+// OpenAPIValidator checks every request and response of a documented route
+// against the spec, logging whatever does not match
+func OpenAPIValidator(spec *OpenAPISpec) martini.Handler {
+	return func(c martini.Context, req *http.Request, w http.ResponseWriter, logger *Logger) {
+		if template, _ := spec.match(req.URL.Path); template == "" {
+			return
+		}
+
+		var body []byte
+		if req.Body != nil {
+			body, _ = ioutil.ReadAll(req.Body)
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		if err := spec.ValidateRequest(req, body); err != nil {
+			logger.Warn("request does not match the OpenAPI document", "method", req.Method, "path", req.URL.Path, "err", err)
+		}
+
+		recorder := &responseRecorder{ResponseWriter: w, status: 200}
+		c.MapTo(recorder, (*http.ResponseWriter)(nil))
+		c.Next()
+
+		if err := spec.ValidateResponse(req.Method, req.URL.Path, recorder.status, recorder.Header().Get("Content-Type"), recorder.body.Bytes()); err != nil {
+			logger.Warn("response does not match the OpenAPI document", "method", req.Method, "path", req.URL.Path, "err", err)
+		}
+	}
+}
+
+// responseRecorder keeps a copy of the status and body written through it
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	rr.status = status
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	// Streams never end, so they are not kept
+	if mediaType(rr.Header().Get("Content-Type")) != "text/event-stream" {
+		rr.body.Write(b)
+	}
+	return rr.ResponseWriter.Write(b)
+}
+
+func (rr *responseRecorder) Flush() {
+	if flusher, ok := rr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// match finds the documented path template for a request path, returning
+// the values of its path parameters. Literal segments win over parameters.
+func (s *OpenAPISpec) match(path string) (string, map[string]string) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	best, bestParams, bestLiterals := "", map[string]string(nil), -1
+
+	for template := range s.paths {
+		templateSegments := strings.Split(strings.Trim(template, "/"), "/")
+		if len(templateSegments) != len(segments) {
+			continue
+		}
+
+		params := make(map[string]string)
+		literals := 0
+		matched := true
+		for i, segment := range templateSegments {
+			if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+				params[segment[1:len(segment)-1]], _ = url.PathUnescape(segments[i])
+			} else if segment == segments[i] {
+				literals++
+			} else {
+				matched = false
+				break
+			}
+		}
+
+		if matched && literals > bestLiterals {
+			best, bestParams, bestLiterals = template, params, literals
+		}
+	}
+
+	return best, bestParams
+}
+
+func (s *OpenAPISpec) operation(method, template string) map[string]interface{} {
+	item, _ := s.paths[template].(map[string]interface{})
+	op, _ := item[method].(map[string]interface{})
+	return op
+}
+
+// parameters returns the path level and operation level parameters
+func (s *OpenAPISpec) parameters(template string, op map[string]interface{}) []map[string]interface{} {
+	var params []map[string]interface{}
+	item, _ := s.paths[template].(map[string]interface{})
+
+	for _, list := range []interface{}{item["parameters"], op["parameters"]} {
+		values, _ := list.([]interface{})
+		for _, value := range values {
+			if param := s.resolve(value); param != nil {
+				params = append(params, param)
+			}
+		}
+	}
+
+	return params
+}
+
+// resolve follows a local $ref, if any
+func (s *OpenAPISpec) resolve(value interface{}) map[string]interface{} {
+	object, _ := value.(map[string]interface{})
+
+	for object != nil {
+		ref, ok := object["$ref"].(string)
+		if !ok {
+			break
+		}
+
+		var current interface{} = s.document
+		for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+			parent, _ := current.(map[string]interface{})
+			current = parent[part]
+		}
+		object, _ = current.(map[string]interface{})
+	}
+
+	return object
+}
+
+// validateParameter checks a path or query parameter value
+func (s *OpenAPISpec) validateParameter(schema map[string]interface{}, value string) error {
+	schema = s.resolve(schema)
+
+	switch schema["type"] {
+	case "integer":
+		number, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("must be an integer")
+		}
+		return s.validate(schema, float64(number), "value")
+	case "number":
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("must be a number")
+		}
+		return s.validate(schema, number, "value")
+	case "array":
+		return nil
+	default:
+		return s.validate(schema, value, "value")
+	}
+}
+
+// validate checks value against the subset of JSON schema used by the spec:
+// type, nullable, enum, minimum, required, properties, additionalProperties,
+// items and oneOf
+func (s *OpenAPISpec) validate(rawSchema interface{}, value interface{}, at string) error {
+	schema := s.resolve(rawSchema)
+	if schema == nil {
+		return nil
+	}
+
+	if oneOf, ok := schema["oneOf"].([]interface{}); ok {
+		matches := 0
+		for _, option := range oneOf {
+			if s.validate(option, value, at) == nil {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return fmt.Errorf("%s must match exactly one schema of oneOf", at)
+		}
+		return nil
+	}
+
+	if value == nil {
+		if nullable, _ := schema["nullable"].(bool); nullable || schema["type"] == nil {
+			return nil
+		}
+		return fmt.Errorf("%s must not be null", at)
+	}
+
+	switch schema["type"] {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be an object", at)
+		}
+
+		required, _ := schema["required"].([]interface{})
+		for _, name := range required {
+			if _, ok := object[name.(string)]; !ok {
+				return fmt.Errorf("%s.%s is required", at, name)
+			}
+		}
+
+		properties, _ := schema["properties"].(map[string]interface{})
+		for name, property := range object {
+			propertySchema, ok := properties[name]
+			if !ok {
+				propertySchema = schema["additionalProperties"]
+			}
+			if err := s.validate(propertySchema, property, at+"."+name); err != nil {
+				return err
+			}
+		}
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be an array", at)
+		}
+
+		for i, item := range array {
+			if err := s.validate(schema["items"], item, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			return fmt.Errorf("%s must be a string", at)
+		}
+	case "integer":
+		number, ok := value.(float64)
+		if !ok || number != math.Trunc(number) {
+			return fmt.Errorf("%s must be an integer", at)
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			return fmt.Errorf("%s must be a number", at)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s must be a boolean", at)
+		}
+	}
+
+	if minimum, ok := schema["minimum"].(float64); ok {
+		if number, ok := value.(float64); ok && number < minimum {
+			return fmt.Errorf("%s must be at least %v", at, minimum)
+		}
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		for _, allowed := range enum {
+			if allowed == value {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s must be one of %v", at, enum)
+	}
+
+	return nil
+}
+
+// openAPITemplate converts a martini route pattern into an OpenAPI path
+func openAPITemplate(pattern string) string {
+	segments := strings.Split(pattern, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") {
+			segments[i] = "{" + segment[1:] + "}"
+		}
+	}
+
+	return strings.Join(segments, "/")
+}
+
+func mediaType(contentType string) string {
+	return strings.TrimSpace(strings.Split(contentType, ";")[0])
+}
+
+// decodeBody decodes a JSON or form encoded body into generic values
+func decodeBody(contentType string, body []byte) (interface{}, error) {
+	if contentType == "application/x-www-form-urlencoded" {
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, err
+		}
+
+		values := make(map[string]interface{})
+		for name := range form {
+			values[name] = form.Get(name)
+		}
+		return values, nil
+	}
+
+	var value interface{}
+	err := json.Unmarshal(body, &value)
+	return value, err
+}
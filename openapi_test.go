@@ -0,0 +1,110 @@
+package main
+
+import (
+	"github.com/codegangsta/martini"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func loadTestSpec(t *testing.T) *OpenAPISpec {
+	spec, err := LoadOpenAPISpec(OpenAPISpecPath)
+	if err != nil {
+		t.Fatalf("loading the OpenAPI document: %s", err)
+	}
+	return spec
+}
+
+// testPath fills the parameters of an OpenAPI path template
+func testPath(template string) string {
+	segments := strings.Split(template, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, "{") {
+			segments[i] = "1"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func TestRoutesMatchOpenAPI(t *testing.T) {
+	spec := loadTestSpec(t)
+
+	for _, oidc := range []bool{false, true} {
+		router := martini.NewRouter()
+		RegisterRoutes(router, oidc)
+
+		for _, problem := range spec.CheckRoutes(router.All()) {
+			t.Errorf("oidc %v: %s", oidc, problem)
+		}
+	}
+}
+
+// Every route requiring a login answers anonymous requests with its
+// documented 401 response
+func TestUnauthorizedResponsesMatchOpenAPI(t *testing.T) {
+	spec := loadTestSpec(t)
+	cs := NewCookieStore(&Config{SecretKey: "a secret key used by the tests"})
+	cfg := &Config{}
+
+	for template, item := range spec.paths {
+		for method, value := range item.(map[string]interface{}) {
+			op, ok := value.(map[string]interface{})
+			responses, _ := op["responses"].(map[string]interface{})
+			if !ok || responses["401"] == nil || template == "/metrics" {
+				continue
+			}
+
+			method = strings.ToUpper(method)
+			req := httptest.NewRequest(method, testPath(template), nil)
+			w := httptest.NewRecorder()
+
+			if strings.HasPrefix(template, "/api/") {
+				APIAuthRequired(cs, req, w, nil, cfg)
+			} else {
+				AuthRequired(cs, req, w, nil, cfg)
+			}
+
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("%s %s: status %d, want 401", method, template, w.Code)
+				continue
+			}
+			if err := spec.ValidateResponse(method, req.URL.Path, w.Code, w.Header().Get("Content-Type"), w.Body.Bytes()); err != nil {
+				t.Errorf("%s %s: %s", method, template, err)
+			}
+		}
+	}
+}
+
+func TestHealthResponseMatchesOpenAPI(t *testing.T) {
+	spec := loadTestSpec(t)
+	w := httptest.NewRecorder()
+
+	HealthHandler(w)
+
+	if err := spec.ValidateResponse("GET", "/healthz", w.Code, w.Header().Get("Content-Type"), w.Body.Bytes()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValidateResponseRejectsDrift(t *testing.T) {
+	spec := loadTestSpec(t)
+
+	tests := []struct {
+		name        string
+		status      int
+		contentType string
+		body        string
+	}{
+		{"undocumented status", 418, "application/json", `{"status": "ok"}`},
+		{"wrong content type", 200, "text/plain", "ok"},
+		{"wrong type", 200, "application/json", `{"status": 1}`},
+		{"not json", 200, "application/json", "ok"},
+	}
+
+	for _, test := range tests {
+		if err := spec.ValidateResponse("GET", "/healthz", test.status, test.contentType, []byte(test.body)); err == nil {
+			t.Errorf("%s: accepted", test.name)
+		}
+	}
+}
@@ -11,13 +11,16 @@ function accessFormChangeMode() {
     var submit = document.getElementById('submit-button');
     var modeChanger = document.getElementById('no-account');
     var email = document.getElementById('email-field');
+    var invite = document.getElementById('invite-field');
     
     if (submit.value === 'Login') {
         email.className = 'form-field';
+        invite.className = 'form-field';
         submit.value = 'Sign up';
         modeChanger.value = 'I have an account';
     } else {
         email.className = 'form-field hidden';
+        invite.className = 'form-field hidden';
         submit.value = 'Login';
         modeChanger.value = 'I don\'t have an account';
     }
@@ -28,7 +31,7 @@ function AJAXRequest(method, url, data, callback, token) {
     xhr.open(method, url, true);
     xhr.onload = function() {
         response = JSON.parse(xhr.responseText);
-        callback(response);
+        callback(response, xhr);
     };
     xhr.setRequestHeader("Content-type", "application/x-www-form-urlencoded");
     if (token !== undefined)
@@ -59,8 +62,10 @@ function submitAccessForm(form) {
     var token = form.csrf_token.value;
     var data = 'username=' + username;
     data += '&password=' + password;
-    if (form.submit.value !== 'Login')
+    if (form.submit.value !== 'Login') {
         data += '&email=' + mail;
+        data += '&invite=' + encodeURIComponent(form.invite.value);
+    }
 
     AJAXRequest(
         'POST',
@@ -69,6 +74,10 @@ function submitAccessForm(form) {
         form.submit.value === 'Login' ? function(response) {
             if (response.error) {
                 showAlert(response.message, 'error');
+            } else if (response.data && response.data.two_factor) {
+                form.className = 'hidden';
+                document.getElementById('two-factor-form').className = '';
+                document.getElementById('code').focus();
             } else {
                 showAlert('You have been successfully logged in!', 'success');
                 refresh();
@@ -85,6 +94,311 @@ function submitAccessForm(form) {
     );
 }
 
+function submitTwoFactor(form) {
+    AJAXRequest(
+        'POST',
+        '/login/2fa',
+        'code=' + encodeURIComponent(form.code.value),
+        function(response) {
+            if (response.error) {
+                showAlert(response.message, 'error');
+            } else {
+                showAlert('You have been successfully logged in!', 'success');
+                refresh();
+            }
+        },
+        form.csrf_token.value
+    );
+}
+
+function showRecoveryCodes(codes) {
+    var pre = document.getElementById('recovery-codes');
+    pre.innerHTML = 'Keep these recovery codes somewhere safe, each one can be used once instead of a code:\n\n' + codes.join('\n');
+    pre.className = 'access-message';
+}
+
+function enableTwoFactor(form) {
+    AJAXRequest(
+        'POST',
+        '/account/2fa/enable',
+        'code=' + encodeURIComponent(form.code.value),
+        function(response) {
+            if (response.error) {
+                showAlert(response.message, 'error');
+            } else {
+                showAlert('Two-factor authentication enabled.', 'success');
+                form.className = 'hidden';
+                showRecoveryCodes(response.data.recovery_codes);
+            }
+        },
+        form.csrf_token.value
+    );
+}
+
+function disableTwoFactor(form) {
+    var data = 'password=' + encodeURIComponent(form.password.value);
+    data += '&code=' + encodeURIComponent(form.code.value);
+
+    AJAXRequest(
+        'POST',
+        '/account/2fa/disable',
+        data,
+        function(response) {
+            if (response.error) {
+                showAlert(response.message, 'error');
+            } else {
+                showAlert(response.message, 'success');
+                refresh();
+            }
+        },
+        form.csrf_token.value
+    );
+}
+
+function regenerateRecoveryCodes(form) {
+    AJAXRequest(
+        'POST',
+        '/account/2fa/recovery_codes',
+        'code=' + encodeURIComponent(form.code.value),
+        function(response) {
+            if (response.error) {
+                showAlert(response.message, 'error');
+            } else {
+                showAlert('New recovery codes created.', 'success');
+                showRecoveryCodes(response.data.recovery_codes);
+            }
+        },
+        form.csrf_token.value
+    );
+}
+
+function revokeSession(id, elem) {
+    AJAXRequest(
+        'DELETE',
+        '/account/sessions/' + id,
+        '',
+        function(response) {
+            if (response.error) {
+                showAlert(response.message, 'error');
+            } else {
+                showAlert(response.message, 'success');
+                elem.parentNode.removeChild(elem);
+            }
+        },
+        document.getElementsByName('csrf_token')[0].value
+    );
+}
+
+function revokeOtherSessions(form) {
+    AJAXRequest(
+        'DELETE',
+        '/account/sessions',
+        '',
+        function(response) {
+            if (response.error) {
+                showAlert(response.message, 'error');
+            } else {
+                showAlert(response.message, 'success');
+                refresh();
+            }
+        },
+        form.csrf_token.value
+    );
+}
+
+function changeUsername(form) {
+    AJAXRequest(
+        'POST',
+        '/account/username',
+        'username=' + encodeURIComponent(form.username.value),
+        function(response) {
+            showAlert(response.message, response.error ? 'error' : 'success');
+        },
+        form.csrf_token.value
+    );
+}
+
+function changePassword(form) {
+    AJAXRequest(
+        'POST',
+        '/account/password',
+        'current_password=' + encodeURIComponent(form.current_password.value) +
+            '&password=' + encodeURIComponent(form.password.value),
+        function(response) {
+            showAlert(response.message, response.error ? 'error' : 'success');
+            if (!response.error) {
+                form.current_password.value = '';
+                form.password.value = '';
+            }
+        },
+        form.csrf_token.value
+    );
+}
+
+function changeEmail(form) {
+    AJAXRequest(
+        'POST',
+        '/account/email',
+        'email=' + encodeURIComponent(form.email.value) +
+            '&password=' + encodeURIComponent(form.password.value),
+        function(response) {
+            showAlert(response.message, response.error ? 'error' : 'success');
+            if (!response.error)
+                form.password.value = '';
+        },
+        form.csrf_token.value
+    );
+}
+
+function deleteAccount(form) {
+    if (!confirm('Delete your account and all of your bookmarks? This cannot be undone.'))
+        return;
+
+    AJAXRequest(
+        'POST',
+        '/account/delete',
+        'password=' + encodeURIComponent(form.password.value),
+        function(response) {
+            if (response.error) {
+                showAlert(response.message, 'error');
+            } else {
+                showAlert(response.message, 'success');
+                window.setTimeout(function() {
+                    window.location.href = '/';
+                }, 3000);
+            }
+        },
+        form.csrf_token.value
+    );
+}
+
+function createInvite(form) {
+    AJAXRequest(
+        'POST',
+        '/account/invites',
+        '',
+        function(response) {
+            if (response.error) {
+                showAlert(response.message, 'error');
+            } else {
+                prompt('Send this invite link, it works once:', response.data.url);
+                refresh();
+            }
+        },
+        form.csrf_token.value
+    );
+}
+
+function revokeInvite(id, elem) {
+    AJAXRequest(
+        'DELETE',
+        '/account/invites/' + id,
+        '',
+        function(response) {
+            if (response.error) {
+                showAlert(response.message, 'error');
+            } else {
+                showAlert(response.message, 'success');
+                elem.parentNode.removeChild(elem);
+            }
+        },
+        document.getElementsByName('csrf_token')[0].value
+    );
+}
+
+function adminUserAction(id, action, data) {
+    AJAXRequest(
+        'POST',
+        '/admin/users/' + id + '/' + action,
+        data || '',
+        function(response) {
+            if (response.error) {
+                showAlert(response.message, 'error');
+            } else {
+                refresh();
+            }
+        },
+        document.getElementsByName('csrf_token')[0].value
+    );
+}
+
+function adminResetPassword(id, username) {
+    if (!confirm('Reset the password of ' + username + ' and email them a link to choose a new one?'))
+        return;
+
+    AJAXRequest(
+        'POST',
+        '/admin/users/' + id + '/password',
+        '',
+        function(response) {
+            if (response.error) {
+                showAlert(response.message, 'error');
+            } else {
+                showAlert(response.message, 'success');
+            }
+        },
+        document.getElementsByName('csrf_token')[0].value
+    );
+}
+
+function adminDeleteUser(id, username, elem) {
+    if (!confirm('Delete ' + username + ' and all of their bookmarks?'))
+        return;
+
+    AJAXRequest(
+        'DELETE',
+        '/admin/users/' + id,
+        '',
+        function(response) {
+            if (response.error) {
+                showAlert(response.message, 'error');
+            } else {
+                showAlert(response.message, 'success');
+                elem.parentNode.removeChild(elem);
+            }
+        },
+        document.getElementsByName('csrf_token')[0].value
+    );
+}
+
+function submitForgotPassword(form) {
+    AJAXRequest(
+        'POST',
+        '/password/forgot',
+        'email=' + encodeURIComponent(form.email.value),
+        function(response) {
+            showAlert(response.message, response.error ? 'error' : 'success');
+            if (!response.error)
+                form.email.value = '';
+        },
+        form.csrf_token.value
+    );
+}
+
+function submitPasswordReset(form) {
+    if (form.password.value !== form.password_confirm.value) {
+        showAlert('The passwords do not match.', 'error');
+        return;
+    }
+
+    AJAXRequest(
+        'POST',
+        '/password/reset/' + encodeURIComponent(form.reset_token.value),
+        'password=' + encodeURIComponent(form.password.value),
+        function(response) {
+            if (response.error) {
+                showAlert(response.message, 'error');
+            } else {
+                showAlert(response.message, 'success');
+                window.setTimeout(function() {
+                    window.location.href = '/';
+                }, 3000);
+            }
+        },
+        form.csrf_token.value
+    );
+}
+
 function submitNewBookmark(form) {
     var title = form.title,
         url = form.url,
@@ -126,7 +440,7 @@ function submitNewBookmark(form) {
                 }
  
                 lb = document.getElementById('list-bookmarks');
-                lb.innerHTML = renderBookmark(response.message, title.value, url.value, tags.value) + lb.innerHTML;
+                lb.innerHTML = renderBookmark(response.message, title.value, url.value, tags.value, undefined, false, 1) + lb.innerHTML;
                 updateTags(tags.value);
                 title.value = '';
                 url.value = '';
@@ -151,7 +465,7 @@ function showAlert(msg, htmlClass) {
     }, 2000);
 }
 
-function renderBookmark(bkId, title, url, tags, date, forceComplete) {
+function renderBookmark(bkId, title, url, tags, date, forceComplete, version) {
     var editing = true && !forceComplete;
     if (date === undefined) {
         date = 'Just now';
@@ -166,7 +480,7 @@ function renderBookmark(bkId, title, url, tags, date, forceComplete) {
         url = url.substring(0, 50) + '...';
     }
 
-	bookmarkHtml = ((!editing) ? '<article id="bookmark_' + bkId + '">' : '') + 
+	bookmarkHtml = ((!editing) ? '<article id="bookmark_' + bkId + '" data-version="' + (version || 0) + '">' : '') + 
         '<div class="bookmark-actions">' +
 		'<a href="#" class="bookmark-edit" onclick="openEditBookmarkForm(this.parentNode.parentNode); return false;"><span class="ion-levels"></span></a>' +
 		'<a href="#" class="bookmark-delete" onclick="deleteBookmark(\'' + bkId + '\', this.parentNode.parentNode); return false;"><span class="ion-trash-b"></span></a>' +
@@ -280,7 +594,7 @@ function deleteBookmark(id, elem) {
     if (confirm("Are you sure you want to delete that?")) {
         AJAXRequest(
             'DELETE',
-            '/bookmark/delete/' + id,
+            '/bookmark/delete/' + id + '?version=' + (elem.getAttribute('data-version') || 0),
             '',
             function(response) {
                 if (response.error) {
@@ -304,6 +618,7 @@ function editBookmark(form) {
         tags = form.tags,
         token = form.csrf_token.value,
         bookmarkId = form.bookmark_id,
+        currBk = document.getElementById('bookmark_' + bookmarkId.value),
         date = form.bookmark_date,
         oldTags = form.old_tags,
         data = '',
@@ -326,12 +641,13 @@ function editBookmark(form) {
     data += 'title=' + encodeURIComponent(title.value);
     data += '&url=' + encodeURIComponent(url.value);
     data += '&tags=' + encodeURIComponent(tags.value);
+    data += '&version=' + (currBk.getAttribute('data-version') || 0);
 
     AJAXRequest(
         'POST',
         '/bookmark/update/' + bookmarkId.value,
         data,
-        function(response) {
+        function(response, xhr) {
             if (response.error) {
                 showAlert(response.message, 'error');
             } else {
@@ -370,7 +686,9 @@ function editBookmark(form) {
                     // Remove the tags
                     updateTags(oldTags.value, true);
                 }
-                currBk = document.getElementById('bookmark_' + bookmarkId.value);
+                if (xhr.getResponseHeader('ETag') !== null) {
+                    currBk.setAttribute('data-version', xhr.getResponseHeader('ETag').replace(/"/g, ''));
+                }
                 currBk.innerHTML = renderBookmark(bookmarkId.value, title.value, url.value, tags.value, date.value);
                 closeEditBookmarkForm(form);
                 var viewportOffset = currBk.getBoundingClientRect();
@@ -439,10 +757,11 @@ function getBookmarksForTag(tag) {
                     for (i = 0; i < data.length; i++) {
                         list.innerHTML += renderBookmark(data[i].id,
                                                         data[i].Title,
-                                                        data[i].Url,
+                                                        data[i].URL,
                                                         data[i].Tags.join(', '),
                                                         data[i].Date,
-                                                        true);
+                                                        true,
+                                                        data[i].Version);
                     }
                     
                     document.getElementById('back-index').className = '';
@@ -487,10 +806,11 @@ function searchBookmarks(query) {
                     for (i = 0; i < data.length; i++) {
                         list.innerHTML += renderBookmark(data[i].id,
                                                         data[i].Title,
-                                                        data[i].Url,
+                                                        data[i].URL,
                                                         data[i].Tags.join(', '),
                                                         data[i].Date,
-                                                        true);
+                                                        true,
+                                                        data[i].Version);
                     }
                     
                     document.getElementById('back-index').className = '';
@@ -514,6 +834,112 @@ function searchBookmarks(query) {
     );
 }
 
+function getBookmarksForSavedSearch(id) {
+    var form = document.getElementById('bookmark-add'),
+        token = form.csrf_token.value,
+        list = document.getElementById('list-bookmarks'),
+        i = 0;
+
+    AJAXRequest(
+        'GET',
+        '/saved_search/' + id + '/0',
+        '',
+        function(response) {
+            if (response.error) {
+                showAlert(response.message, 'error');
+            } else {
+                data = response.data;
+                list.className = 'saved_search_' + id;
+                if (data.length > 0) {
+                    list.innerHTML = '';
+                    for (i = 0; i < data.length; i++) {
+                        list.innerHTML += renderBookmark(data[i].id,
+                                                        data[i].Title,
+                                                        data[i].URL,
+                                                        (data[i].Tags || []).join(', '),
+                                                        data[i].Date,
+                                                        true,
+                                                        data[i].Version);
+                    }
+                    
+                    document.getElementById('back-index').className = '';
+                    
+                    if (data.length == 50) {
+                        document.getElementById('load-more').onclick = function() {
+                            loadMore(1);
+                            return false;
+                        };
+                    } else {
+                        document.getElementById('load-more').style.display = 'none';
+                    }
+                    
+                    heightCallback();
+                } else {
+                    showAlert('There are no bookmarks for this saved search.', 'info')
+                }
+            }
+        },
+        token
+    );
+}
+
+function saveSearch(query) {
+    var token = document.getElementById('csrf_token').value,
+        name = prompt('Name for this search:', query),
+        data = '';
+
+    if (name === null || name.trim() === '') {
+        return;
+    }
+
+    data += 'name=' + encodeURIComponent(name);
+    data += '&query=' + encodeURIComponent(query);
+
+    AJAXRequest(
+        'POST',
+        '/saved_search/new',
+        data,
+        function(response) {
+            if (response.error) {
+                showAlert(response.message, 'error');
+            } else {
+                showAlert('Search saved successfully.', 'success');
+                ulNode = document.getElementById('saved-searches').
+                    getElementsByTagName('ul')[0];
+                empty = ulNode.getElementsByClassName('empty-searches');
+                if (empty.length > 0) {
+                    empty[0].style.display = 'none';
+                }
+                ulNode.innerHTML += '<li class="clickable" id="saved_search_' + response.message + '">' +
+                    '<span onclick="getBookmarksForSavedSearch(\'' + response.message + '\');">' +
+                    escapeHTMLEntities(name) + '</span> ' +
+                    '<a href="#" class="saved-search-delete" onclick="deleteSavedSearch(\'' + response.message +
+                    '\', this.parentNode); return false;"><span class="ion-trash-b"></span></a></li>';
+            }
+        },
+        token
+    );
+}
+
+function deleteSavedSearch(id, elem) {
+    if (confirm("Are you sure you want to delete that search?")) {
+        AJAXRequest(
+            'DELETE',
+            '/saved_search/delete/' + id,
+            '',
+            function(response) {
+                if (response.error) {
+                    showAlert(response.message, 'error');
+                } else {
+                    showAlert('Saved search deleted successfully.', 'success');
+                    elem.style.display = 'none';
+                }
+            },
+            document.getElementById('csrf_token').value
+        );
+    }
+}
+
 function browseAll() {
     var form = document.getElementById('bookmark-add'),
         token = form.csrf_token.value,
@@ -542,7 +968,8 @@ function browseAll() {
                                                         data[i].URL,
                                                         data[i].Tags.join(', '),
                                                         data[i].Date,
-                                                        true);
+                                                        true,
+                                                        data[i].Version);
                     }
                     
                     document.getElementById('back-index').className = 'hidden';
@@ -579,6 +1006,10 @@ function loadMore(page) {
         method = 'GET';
         requestUrl = '/tag/' + list.className.substring(list.className.indexOf('tag_') + 4) + '/' + page;
         queryData = '';
+    } else if (list.className.indexOf('saved_search_') !== -1) {
+        method = 'GET';
+        requestUrl = '/saved_search/' + list.className.substring(list.className.indexOf('search_') + 7) + '/' + page;
+        queryData = '';
     } else if (list.className.indexOf('searching_') !== -1) {
         method = 'POST';
         requestUrl = '/search/' + page;
@@ -602,10 +1033,11 @@ function loadMore(page) {
                     for (i = 0; i < data.length; i++) {
                         list.innerHTML += renderBookmark(data[i].id,
                                                         data[i].Title,
-                                                        data[i].Url,
+                                                        data[i].URL,
                                                         data[i].Tags.join(', '),
                                                         data[i].Date,
-                                                        true);
+                                                        true,
+                                                        data[i].Version);
                     }
                     
                     if (data.length == 50) {
@@ -625,4 +1057,61 @@ function loadMore(page) {
         },
         token
     );
-}
\ No newline at end of file
+}
+function listenBookmarkEvents() {
+    var source = new EventSource('/api/v2/events');
+
+    source.addEventListener('created', function(e) {
+        var event = JSON.parse(e.data),
+            bookmark = event.bookmark,
+            list = document.getElementById('list-bookmarks'),
+            tags = (bookmark.Tags || []).join(', ');
+
+        if (list.className !== '' || document.getElementById('bookmark_' + event.id) !== null) {
+            return;
+        }
+
+        empty = document.getElementsByClassName('empty');
+        if (empty.length > 0) {
+            empty[0].style.display = 'none';
+        }
+
+        list.innerHTML = renderBookmark(event.id, bookmark.Title, bookmark.URL, tags,
+                                        bookmark.Date, true, bookmark.Version) + list.innerHTML;
+        updateTags(tags);
+        heightCallback();
+    });
+
+    source.addEventListener('updated', function(e) {
+        var event = JSON.parse(e.data),
+            bookmark = event.bookmark,
+            elem = document.getElementById('bookmark_' + event.id);
+
+        if (elem === null || Number(elem.getAttribute('data-version')) >= bookmark.Version) {
+            return;
+        }
+
+        updateTags(getTagsFromBookmark(elem), true);
+        updateTags((bookmark.Tags || []).join(', '));
+        elem.setAttribute('data-version', bookmark.Version);
+        elem.innerHTML = renderBookmark(event.id, bookmark.Title, bookmark.URL,
+                                        (bookmark.Tags || []).join(', '), bookmark.Date);
+    });
+
+    source.addEventListener('deleted', function(e) {
+        var event = JSON.parse(e.data),
+            elem = document.getElementById('bookmark_' + event.id);
+
+        if (elem === null || elem.style.display === 'none') {
+            return;
+        }
+
+        elem.style.display = 'none';
+        updateTags(getTagsFromBookmark(elem), true);
+        heightCallback();
+    });
+}
+
+if (window.EventSource && document.getElementById('list-bookmarks') !== null) {
+    listenBookmarkEvents();
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Registration modes
+const (
+	RegistrationOpen    = "open"
+	RegistrationInvite  = "invite"
+	RegistrationDomains = "domains"
+	RegistrationClosed  = "closed"
+)
+
+// Invite for JSON schema, the code itself is only shown when it is created
+type Invite struct {
+	ID      string `json:"id"`
+	Expires int64  `json:"expires"`
+}
+
+// NewInvite for JSON schema, a freshly created invite along with its code
+type NewInvite struct {
+	Invite
+	Code string `json:"code"`
+	URL  string `json:"url"`
+}
+
+// Registration decides who can sign up. In the domains mode addresses of the
+// allowed domains sign up freely and everyone else needs an invite.
+type Registration struct {
+	mode          string
+	domains       []string
+	inviteExpires time.Duration
+	userInvites   bool
+	baseURL       string
+}
+
+// NewRegistration creates the registration policy from the config
+func NewRegistration(config *Config) *Registration {
+	mode := strings.ToLower(config.Registration)
+	switch mode {
+	case RegistrationOpen, RegistrationInvite, RegistrationDomains, RegistrationClosed:
+	default:
+		panic(fmt.Sprintf("invalid MAGNET_REGISTRATION %q, use open, invite, domains or closed", config.Registration))
+	}
+
+	var domains []string
+	for _, domain := range strings.Split(config.RegistrationDomains, ",") {
+		if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+			domains = append(domains, strings.TrimPrefix(domain, "@"))
+		}
+	}
+
+	if mode == RegistrationDomains && len(domains) == 0 {
+		panic("MAGNET_REGISTRATION=domains needs MAGNET_REGISTRATION_DOMAINS")
+	}
+
+	return &Registration{
+		mode:          mode,
+		domains:       domains,
+		inviteExpires: time.Duration(config.InviteExpire) * time.Second,
+		userInvites:   config.UserInvites,
+		baseURL:       strings.TrimSuffix(config.BaseURL, "/"),
+	}
+}
+
+// Closed tells if nobody can sign up
+func (g *Registration) Closed() bool {
+	return g.mode == RegistrationClosed
+}
+
+// InviteRequired tells if signing up with an email needs an invite code
+func (g *Registration) InviteRequired(email string) bool {
+	switch g.mode {
+	case RegistrationInvite:
+		return true
+	case RegistrationDomains:
+		return !g.allowedDomain(email)
+	}
+	return false
+}
+
+// VerificationRequired tells if an user signing up without an invite must
+// verify the email before logging in, as only the domain vouches for them
+func (g *Registration) VerificationRequired(email string) bool {
+	return g.mode == RegistrationDomains && g.allowedDomain(email)
+}
+
+// Provisions tells if single sign-on can create an user with the email. Only
+// open registration and verified emails of the allowed domains do, as there
+// is no way to enter an invite code.
+func (g *Registration) Provisions(email string, verified bool) bool {
+	switch g.mode {
+	case RegistrationOpen:
+		return true
+	case RegistrationDomains:
+		return verified && g.allowedDomain(email)
+	}
+	return false
+}
+
+// RequirementMessage explains to the user why an invite code is needed
+func (g *Registration) RequirementMessage() string {
+	if g.mode == RegistrationDomains {
+		return fmt.Sprintf("Sign up is limited to %s addresses, other addresses need an invite code.", strings.Join(g.domains, ", "))
+	}
+	return "Sign up is by invitation only, enter your invite code."
+}
+
+func (g *Registration) allowedDomain(email string) bool {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+
+	domain := strings.ToLower(email[at+1:])
+	for _, allowed := range g.domains {
+		if domain == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// CanInvite tells if an user can create invite codes
+func (g *Registration) CanInvite(user *User) bool {
+	return g.mode != RegistrationOpen && g.mode != RegistrationClosed && (user.Admin || g.userInvites)
+}
+
+// NewInvite creates an invite code for an user, returning it along with the
+// token to store
+func (g *Registration) NewInvite(userID string) (*NewInvite, *Token) {
+	code := RandomToken(10)
+	token := &Token{
+		ID:      HashToken(code),
+		Kind:    TokenInvite,
+		User:    userID,
+		Expires: time.Now().Add(g.inviteExpires).Unix(),
+	}
+
+	return &NewInvite{
+		Invite: Invite{ID: token.ID, Expires: token.Expires},
+		Code:   code,
+		URL:    g.baseURL + "/?invite=" + code,
+	}, token
+}
+
+// Invites converts invite tokens
+func Invites(tokens []Token) []Invite {
+	invites := make([]Invite, len(tokens))
+	for i, token := range tokens {
+		invites[i] = Invite{ID: token.ID, Expires: token.Expires}
+	}
+	return invites
+}
+
+// CreateInvite stores a new invite code of an user who is allowed to invite
+func CreateInvite(connection *Connection, registration *Registration, user *User) (*NewInvite, *APIError) {
+	if !registration.CanInvite(user) {
+		return nil, NewAPIError(403, APIErrForbidden, "You cannot invite users.")
+	}
+
+	invite, token := registration.NewInvite(user.ID)
+	if response, err := connection.NewToken(token); err != nil || response.Inserted < 1 {
+		return nil, NewAPIError(500, APIErrInternal, "Error creating the invite.")
+	}
+
+	return invite, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestRegistrationDomains(t *testing.T) {
+	registration := NewRegistration(&Config{Registration: "domains", RegistrationDomains: "example.com"})
+
+	tests := []struct {
+		email        string
+		verified     bool
+		invite       bool
+		verification bool
+		provisions   bool
+	}{
+		{"ana@example.com", true, false, true, true},
+		{"ana@example.com", false, false, true, false},
+		{"ana@EXAMPLE.com", true, false, true, true},
+		{"ana@other.com", true, true, false, false},
+		{"ana@example.com.other.com", true, true, false, false},
+	}
+
+	for _, test := range tests {
+		if got := registration.InviteRequired(test.email); got != test.invite {
+			t.Errorf("%s: invite required %v", test.email, got)
+		}
+		if got := registration.VerificationRequired(test.email); got != test.verification {
+			t.Errorf("%s: verification required %v", test.email, got)
+		}
+		if got := registration.Provisions(test.email, test.verified); got != test.provisions {
+			t.Errorf("%s verified %v: provisions %v", test.email, test.verified, got)
+		}
+	}
+}
+
+func TestRegistrationProvisions(t *testing.T) {
+	for mode, want := range map[string]bool{"open": true, "invite": false, "closed": false} {
+		if got := NewRegistration(&Config{Registration: mode}).Provisions("ana@example.com", true); got != want {
+			t.Errorf("%s: provisions %v", mode, got)
+		}
+	}
+}
+
+func TestEmailRegexpIsAnchored(t *testing.T) {
+	for _, email := range []string{"ana@example.com", "ana.b+tag@mail.example.org"} {
+		if !emailRegexp.MatchString(email) {
+			t.Errorf("%q rejected", email)
+		}
+	}
+	for _, email := range []string{"<script>ana@example.com", "ana@example.com\nBcc: eve@example.com", "ana@example.com>", "ana@example"} {
+		if emailRegexp.MatchString(email) {
+			t.Errorf("%q accepted", email)
+		}
+	}
+}
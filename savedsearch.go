@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// SavedSearch for JSON schema
+type SavedSearch struct {
+	ID         string `gorethink:"id,omitempty" json:"id"`
+	User       string
+	Name       string
+	Query      string
+	Tags       []string
+	From       int64
+	To         int64
+	Unread     string
+	Visibility string
+	Created    float64
+}
+
+// SavedSearchFromForm builds a saved search from the posted form values
+func SavedSearchFromForm(req *http.Request) *SavedSearch {
+	search := new(SavedSearch)
+	search.Name, _ = url.QueryUnescape(req.PostFormValue("name"))
+	search.Query, _ = url.QueryUnescape(req.PostFormValue("query"))
+	tags, _ := url.QueryUnescape(req.PostFormValue("tags"))
+	search.Tags = ParseTags(tags)
+	search.From = parseFormDate(req.PostFormValue("from"), 0)
+	search.To = parseFormDate(req.PostFormValue("to"), 24*time.Hour-time.Second)
+	search.Unread = strings.ToLower(req.PostFormValue("unread"))
+	search.Visibility = strings.ToLower(req.PostFormValue("visibility"))
+	return search
+}
+
+// Validate returns a description of what is wrong with the saved search or
+// an empty string if it can be stored
+func (s *SavedSearch) Validate() string {
+	errors := ""
+
+	if len(strings.TrimSpace(s.Name)) == 0 {
+		errors += "The name is empty. "
+	}
+
+	if s.Unread != "" && s.Unread != "read" && s.Unread != "unread" {
+		errors += "Unread filter must be read or unread. "
+	}
+
+	if s.Visibility != "" && s.Visibility != "public" && s.Visibility != "private" {
+		errors += "Visibility filter must be public or private. "
+	}
+
+	if s.From > 0 && s.To > 0 && s.From > s.To {
+		errors += "The date range is not valid. "
+	}
+
+	return strings.TrimSpace(errors)
+}
+
+// GetSavedSearches fetches the saved searches of an user from rethinkdb
+func GetSavedSearches(connection *Connection, userID string) []SavedSearch {
+	searches, err := connection.GetSavedSearches(userID)
+	if err != nil {
+		return []SavedSearch{}
+	}
+
+	return searches
+}
+
+// parseFormDate parses a YYYY-MM-DD date into an unix timestamp, adding
+// offset to it. Empty or invalid dates return 0, meaning no bound.
+func parseFormDate(value string, offset time.Duration) int64 {
+	date, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return 0
+	}
+
+	return date.Add(offset).Unix()
+}
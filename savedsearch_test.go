@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPIPage(t *testing.T) {
+	tests := []struct {
+		value string
+		page  int64
+		valid bool
+	}{
+		{"", 0, true},
+		{"0", 0, true},
+		{"3", 3, true},
+		{"-1", 0, false},
+		{"two", 0, false},
+		{"100000", 0, false},
+	}
+
+	for _, test := range tests {
+		page, err := apiPage(test.value)
+		if (err == nil) != test.valid || page != test.page {
+			t.Errorf("%q: page %d, error %v", test.value, page, err)
+		}
+		if err != nil && (err.Status != 400 || err.Fields["page"] == "") {
+			t.Errorf("%q: error %+v", test.value, err)
+		}
+	}
+}
+
+func TestBookmarksPageHasMoreWhenFull(t *testing.T) {
+	tests := []struct {
+		bookmarks []Bookmark
+		more      bool
+	}{
+		{nil, false},
+		{make([]Bookmark, 49), false},
+		{make([]Bookmark, 50), true},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		writeBookmarksPage(test.bookmarks, 2, w)
+
+		var page struct {
+			Data []Bookmark `json:"data"`
+			Page int64      `json:"page"`
+			More bool       `json:"more"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+		if page.Data == nil || len(page.Data) != len(test.bookmarks) || page.Page != 2 || page.More != test.more {
+			t.Errorf("%d bookmarks: %s", len(test.bookmarks), w.Body.String())
+		}
+	}
+}
+
+func TestFilterBookmarksPages(t *testing.T) {
+	connection := testConnection(t)
+	ana, luis := testUser(t, connection, "ana"), testUser(t, connection, "luis")
+
+	for i := 0; i < 60; i++ {
+		bookmark := NewBookmarkDocument(ana, fmt.Sprintf("Go %02d", i), fmt.Sprintf("https://example.com/%d", i), []string{"go"})
+		bookmark["Created"] = float64(1500000000 + i)
+		if _, err := connection.NewBookmark(ana, bookmark); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := connection.NewBookmark(luis, NewBookmarkDocument(luis, "Go", "https://example.com/", []string{"go"})); err != nil {
+		t.Fatal(err)
+	}
+
+	search := &SavedSearch{User: ana, Query: "go", Tags: []string{"go"}}
+	first, err := connection.FilterBookmarks(search, 0)
+	if err != nil || len(first) != 50 {
+		t.Fatalf("first page: %d bookmarks, %v", len(first), err)
+	}
+	second, err := connection.FilterBookmarks(search, 1)
+	if err != nil || len(second) != 10 {
+		t.Fatalf("second page: %d bookmarks, %v", len(second), err)
+	}
+
+	// Newest first, without repeating bookmarks across pages
+	if first[0].Title != "Go 59" || first[49].Title != "Go 10" || second[0].Title != "Go 09" || second[9].Title != "Go 00" {
+		t.Errorf("pages out of order: %s..%s, %s..%s", first[0].Title, first[49].Title, second[0].Title, second[9].Title)
+	}
+	for _, bookmark := range append(first, second...) {
+		if bookmark.User != ana {
+			t.Errorf("bookmark %s of another user", bookmark.ID)
+		}
+	}
+
+	if third, err := connection.FilterBookmarks(search, 2); err != nil || len(third) != 0 {
+		t.Errorf("page past the end: %d bookmarks, %v", len(third), err)
+	}
+}
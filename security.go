@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/gorilla/sessions"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// DefaultContentSecurityPolicy allows the scripts, styles and fonts the
+// templates use. Inline scripts are allowed for their onclick attributes.
+const DefaultContentSecurityPolicy = "default-src 'self'; " +
+	"script-src 'self' 'unsafe-inline'; " +
+	"style-src 'self' 'unsafe-inline' https://fonts.googleapis.com; " +
+	"font-src 'self' https://fonts.gstatic.com; " +
+	"img-src 'self' data:; " +
+	"object-src 'none'; " +
+	"base-uri 'self'; " +
+	"form-action 'self'; " +
+	"frame-ancestors 'none'"
+
+// cookieSameSite maps the MAGNET_COOKIE_SAMESITE values
+var cookieSameSite = map[string]http.SameSite{
+	"lax":    http.SameSiteLaxMode,
+	"strict": http.SameSiteStrictMode,
+	"none":   http.SameSiteNoneMode,
+}
+
+// CookieKeyPairs returns the signing and encryption key pairs of the
+// session cookie, current first. Cookies are written with the current pair
+// and read with any of them, so old keys keep sessions alive while rotating.
+func CookieKeyPairs(config *Config) [][]byte {
+	signing := config.CookieKey
+	if signing == "" {
+		signing = config.SecretKey
+	}
+
+	pairs := cookieKeyPair(signing, config.CookieEncryptionKey)
+	for _, old := range strings.Split(config.OldCookieKeys, ",") {
+		old = strings.TrimSpace(old)
+		if old == "" {
+			continue
+		}
+
+		parts := strings.SplitN(old, ":", 2)
+		if len(parts) == 1 {
+			parts = append(parts, "")
+		}
+		pairs = append(pairs, cookieKeyPair(parts[0], parts[1])...)
+	}
+
+	return pairs
+}
+
+// cookieKeyPair returns a signing key and an AES-256 key derived from the
+// encryption key, nil when cookies are only signed
+func cookieKeyPair(signing, encryption string) [][]byte {
+	if encryption == "" {
+		return [][]byte{[]byte(signing), nil}
+	}
+
+	key := sha256.Sum256([]byte(encryption))
+	return [][]byte{[]byte(signing), key[:]}
+}
+
+// SecureCookies tells whether cookies must only be sent over HTTPS, when
+// serving it or behind a proxy that does
+func (c *Config) SecureCookies() bool {
+	return c.CookieSecure || c.TLSEnabled()
+}
+
+// NewCookieStore returns the store of the magnet_session cookie, which
+// scripts can't read and browsers don't send on cross-site subrequests
+func NewCookieStore(config *Config) *sessions.CookieStore {
+	store := sessions.NewCookieStore(CookieKeyPairs(config)...)
+	store.Options.HttpOnly = true
+	store.Options.Secure = config.SecureCookies()
+	store.Options.SameSite = cookieSameSite[config.CookieSameSite]
+
+	return store
+}
+
+// ParseTrustedProxies parses the comma separated addresses and CIDR ranges
+// of MAGNET_TRUSTED_PROXIES
+func ParseTrustedProxies(value string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("has an invalid address %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("has an invalid range %q", entry)
+		}
+		proxies = append(proxies, network)
+	}
+
+	return proxies, nil
+}
+
+// TrustedProxies sets the remote address of requests sent by the proxies
+// to the client they forward for, the last address of X-Forwarded-For that
+// is not a proxy. Requests from other addresses are left as they are, as
+// anyone can send the header.
+func TrustedProxies(proxies []*net.IPNet, next http.Handler) http.Handler {
+	trusted := func(address string) bool {
+		ip := net.ParseIP(address)
+		for _, proxy := range proxies {
+			if ip != nil && proxy.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		forwarded := req.Header.Get("X-Forwarded-For")
+		if forwarded == "" || !trusted(ClientIP(req)) {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		addresses := strings.Split(forwarded, ",")
+		client := ""
+		for i := len(addresses) - 1; i >= 0; i-- {
+			client = strings.TrimSpace(addresses[i])
+			if !trusted(client) {
+				break
+			}
+		}
+
+		if net.ParseIP(client) != nil {
+			req.RemoteAddr = net.JoinHostPort(client, "0")
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// SecurityHeaders sets the headers limiting what browsers allow pages to
+// do, leaving out the ones configured empty
+func SecurityHeaders(config *Config, next http.Handler) http.Handler {
+	headers := map[string]string{
+		"Content-Security-Policy": config.ContentSecurityPolicy,
+		"X-Frame-Options":         config.FrameOptions,
+		"Referrer-Policy":         config.ReferrerPolicy,
+		"X-Content-Type-Options":  "nosniff",
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for name, value := range headers {
+			if value != "" {
+				w.Header().Set(name, value)
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
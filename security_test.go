@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrustedProxies(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.1, 172.16.0.0/12")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded string
+		want      string
+	}{
+		{"direct", "203.0.113.5:1234", "", "203.0.113.5"},
+		{"spoofed header", "203.0.113.5:1234", "198.51.100.7", "203.0.113.5"},
+		{"proxy", "10.0.0.1:1234", "198.51.100.7", "198.51.100.7"},
+		{"proxy range", "172.16.3.4:1234", "198.51.100.7", "198.51.100.7"},
+		{"chain of proxies", "10.0.0.1:1234", "198.51.100.7, 172.16.0.9", "198.51.100.7"},
+		{"client spoofing through the proxy", "10.0.0.1:1234", "192.0.2.1, 198.51.100.7", "198.51.100.7"},
+		{"invalid header", "10.0.0.1:1234", "unknown", "10.0.0.1"},
+	}
+
+	for _, test := range tests {
+		var got string
+		handler := TrustedProxies(proxies, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			got = ClientIP(req)
+		}))
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = test.remote
+		if test.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if got != test.want {
+			t.Errorf("%s: client %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseTrustedProxiesRejectsInvalid(t *testing.T) {
+	for _, value := range []string{"proxy", "10.0.0.0/33"} {
+		if _, err := ParseTrustedProxies(value); err == nil {
+			t.Errorf("%q accepted", value)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Shutdown is closed when the server starts shutting down, so responses
+// that never end on their own, such as event streams, can finish
+type Shutdown chan struct{}
+
+// Draining tells whether the server is shutting down
+func (s Shutdown) Draining() bool {
+	select {
+	case <-s:
+		return true
+	default:
+		return false
+	}
+}
+
+// NewHTTPServer returns a server for handler with the timeouts and limits
+// of the config
+func NewHTTPServer(handler http.Handler, config *Config) *http.Server {
+	return &http.Server{
+		Addr:              config.Port,
+		Handler:           handler,
+		ReadTimeout:       time.Duration(config.ReadTimeout) * time.Second,
+		ReadHeaderTimeout: time.Duration(config.ReadHeaderTimeout) * time.Second,
+		WriteTimeout:      time.Duration(config.WriteTimeout) * time.Second,
+		IdleTimeout:       time.Duration(config.IdleTimeout) * time.Second,
+		MaxHeaderBytes:    config.MaxHeaderBytes,
+		ErrorLog:          log.New(defaultLogger.Writer(LevelWarn), "", 0),
+	}
+}
+
+// Serve runs the servers until one fails or the process gets SIGINT or
+// SIGTERM. Then it closes shutdown, stops accepting connections and waits up
+// to timeout for the requests being served. A second signal kills the
+// process. Servers with a TLSConfig serve HTTPS.
+func Serve(shutdown Shutdown, timeout time.Duration, servers ...*http.Server) error {
+	failed := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *http.Server) {
+			defaultLogger.Info("listening", "address", server.Addr, "tls", server.TLSConfig != nil)
+			if server.TLSConfig != nil {
+				failed <- server.ListenAndServeTLS("", "")
+			} else {
+				failed <- server.ListenAndServe()
+			}
+		}(server)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	var err error
+	select {
+	case err = <-failed:
+		signal.Stop(signals)
+	case sig := <-signals:
+		signal.Stop(signals)
+		defaultLogger.Info("shutting down", "signal", sig.String(), "timeout", timeout.String())
+	}
+
+	close(shutdown)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, server := range servers {
+		if shutdownErr := server.Shutdown(ctx); err == nil {
+			err = shutdownErr
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// freeAddress returns a local address nothing listens on
+func freeAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// startServing runs Serve in the background until it listens, returning
+// the channel of its result
+func startServing(t *testing.T, shutdown Shutdown, timeout time.Duration, server *http.Server) <-chan error {
+	// Keeps the test process alive if the signal arrives before Serve
+	// listens to it
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM)
+	t.Cleanup(func() { signal.Stop(signals) })
+
+	done := make(chan error, 1)
+	go func() { done <- Serve(shutdown, timeout, server) }()
+
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("tcp", server.Addr); err == nil {
+			conn.Close()
+			return done
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("server not listening")
+	return nil
+}
+
+func waitServe(t *testing.T, done <-chan error) error {
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return")
+		return nil
+	}
+}
+
+func TestServeFinishesRequestsOnSignal(t *testing.T) {
+	started := make(chan struct{})
+	server := &http.Server{Addr: freeAddress(t), Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		w.WriteHeader(204)
+	})}
+	shutdown := make(Shutdown)
+	done := startServing(t, shutdown, 5*time.Second, server)
+
+	status := make(chan int, 1)
+	go func() {
+		response, err := http.Get("http://" + server.Addr)
+		if err != nil {
+			status <- 0
+			return
+		}
+		response.Body.Close()
+		status <- response.StatusCode
+	}()
+
+	<-started
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+
+	if err := waitServe(t, done); err != nil {
+		t.Errorf("error %v", err)
+	}
+	if !shutdown.Draining() {
+		t.Error("shutdown not closed")
+	}
+	if code := <-status; code != 204 {
+		t.Errorf("request being served got %d", code)
+	}
+	if _, err := http.Get("http://" + server.Addr); err == nil {
+		t.Error("connections accepted after shutting down")
+	}
+}
+
+func TestServeStopsWaitingAfterTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	started := make(chan struct{})
+	server := &http.Server{Addr: freeAddress(t), Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		close(started)
+		<-release
+	})}
+	done := startServing(t, make(Shutdown), 100*time.Millisecond, server)
+
+	go http.Get("http://" + server.Addr)
+	<-started
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+
+	if err := waitServe(t, done); err != context.DeadlineExceeded {
+		t.Errorf("error %v, want the deadline", err)
+	}
+}
+
+func TestServeReturnsServerFailures(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	shutdown := make(Shutdown)
+	done := make(chan error, 1)
+	go func() { done <- Serve(shutdown, time.Second, &http.Server{Addr: listener.Addr().String()}) }()
+
+	if err := waitServe(t, done); err == nil {
+		t.Error("serving on an address in use")
+	}
+	if !shutdown.Draining() {
+		t.Error("shutdown not closed after a failure")
+	}
+}
+
+func TestNotReadyWhileShuttingDown(t *testing.T) {
+	shutdown := make(Shutdown)
+	close(shutdown)
+
+	// Draining answers before asking the database, which is nil
+	w := httptest.NewRecorder()
+	ReadyHandler(w, nil, shutdown, nil)
+	if w.Code != 503 {
+		t.Errorf("status %d while shutting down", w.Code)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"net"
+	"net/http"
+	"time"
+)
+
+// sessionCookie names the cookie holding the session token, the only value
+// kept on the client
+const sessionCookie = "magnet_session"
+
+// sessionTouchInterval limits how often the last seen time and expiry of a
+// session are written, so every request does not cost a write
+const sessionTouchInterval = time.Minute
+
+// flowExpires limits how long a login through the identity provider may
+// take
+const flowExpires = 10 * time.Minute
+
+// SessionInfo for JSON schema, an active session as shown to its user
+type SessionInfo struct {
+	ID        string `json:"id"`
+	UserAgent string `json:"user_agent"`
+	IP        string `json:"ip"`
+	Created   int64  `json:"created"`
+	LastSeen  int64  `json:"last_seen"`
+	Expires   int64  `json:"expires"`
+	Current   bool   `json:"current"`
+}
+
+// NewSession returns a session of an user logging in with a request, along
+// with the token for its cookie. The session is stored under the hash of
+// the token, so the sessions table holds nothing a client can log in with.
+// Sessions of no user keep the state of a login flow in data.
+func NewSession(userID string, req *http.Request, expires time.Duration, data map[string]string) (string, Session) {
+	token := RandomToken(32)
+	now := time.Now().Unix()
+
+	return token, Session{
+		ID:        HashToken(token),
+		UserID:    userID,
+		Expires:   now + int64(expires/time.Second),
+		UserAgent: req.UserAgent(),
+		IP:        ClientIP(req),
+		Created:   now,
+		LastSeen:  now,
+		Data:      data,
+	}
+}
+
+// SessionInfos converts the sessions of an user, marking the one with
+// currentID
+func SessionInfos(sessions []Session, currentID string) []SessionInfo {
+	infos := make([]SessionInfo, len(sessions))
+
+	for i, session := range sessions {
+		infos[i] = SessionInfo{
+			ID:        session.ID,
+			UserAgent: session.UserAgent,
+			IP:        session.IP,
+			Created:   session.Created,
+			LastSeen:  session.LastSeen,
+			Expires:   session.Expires,
+			Current:   session.ID == currentID,
+		}
+	}
+
+	return infos
+}
+
+// ClientIP returns the address a request comes from, without the port
+func ClientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	return host
+}
+
+// CurrentSessionID returns the id of the session of the request, empty
+// without a session cookie
+func CurrentSessionID(cs *sessions.CookieStore, req *http.Request) string {
+	session, _ := cs.Get(req, sessionCookie)
+	token, _ := session.Values["token"].(string)
+	if token == "" {
+		return ""
+	}
+
+	return HashToken(token)
+}
+
+// CurrentSession returns the stored session of the request, nil when it
+// has none or it expired
+func CurrentSession(cs *sessions.CookieStore, req *http.Request, connection *Connection) *Session {
+	sessionID := CurrentSessionID(cs, req)
+	if sessionID == "" {
+		return nil
+	}
+
+	stored, err := connection.GetUnexpiredSession(sessionID)
+	if err != nil || stored == nil || stored.Expires <= time.Now().Unix() {
+		return nil
+	}
+
+	return stored
+}
+
+// SetSessionCookie points the cookie to a session token, dropping anything
+// else it held, or removes the cookie when token is empty
+func SetSessionCookie(cs *sessions.CookieStore, req *http.Request, w http.ResponseWriter, token string) error {
+	session, _ := cs.Get(req, sessionCookie)
+	session.Values = make(map[interface{}]interface{})
+
+	if token == "" {
+		session.Options.MaxAge = -1
+	} else {
+		session.Values["token"] = token
+	}
+
+	return session.Save(req, w)
+}
+
+// RefreshSessionCookie writes the session cookie again with the current
+// keys when it was read with an old one, so old keys can be dropped once
+// every logged in user has made a request
+func RefreshSessionCookie(cs *sessions.CookieStore, req *http.Request, w http.ResponseWriter, cfg *Config) {
+	cookie, err := req.Cookie(sessionCookie)
+	if err != nil || cfg.OldCookieKeys == "" {
+		return
+	}
+
+	values := make(map[interface{}]interface{})
+	current := securecookie.CodecsFromPairs(CookieKeyPairs(cfg)[:2]...)
+	if securecookie.DecodeMulti(sessionCookie, cookie.Value, &values, current...) == nil {
+		return
+	}
+
+	session, _ := cs.Get(req, sessionCookie)
+	if token, _ := session.Values["token"].(string); token != "" {
+		SetSessionCookie(cs, req, w, token)
+	}
+}
+
+// StartFlow keeps the state of a login step, such as the user waiting for
+// their second factor, in a session of no user the cookie points to. The
+// session the request had is deleted, as when logging in again.
+func StartFlow(cs *sessions.CookieStore, req *http.Request, w http.ResponseWriter, connection *Connection, data map[string]string, expires time.Duration) error {
+	if sessionID := CurrentSessionID(cs, req); sessionID != "" {
+		connection.Logout(sessionID)
+	}
+
+	token, flow := NewSession("", req, expires, data)
+
+	if _, err := connection.LoginPostInsertSession(flow); err != nil {
+		return err
+	}
+
+	return SetSessionCookie(cs, req, w, token)
+}
+
+// FlowData returns the state kept by StartFlow, nil when there is none or
+// it expired
+func FlowData(cs *sessions.CookieStore, req *http.Request, connection *Connection) map[string]string {
+	stored := CurrentSession(cs, req, connection)
+	if stored == nil || stored.UserID != "" {
+		return nil
+	}
+
+	return stored.Data
+}
+
+// EndSession deletes the session of the request and removes the cookie
+func EndSession(cs *sessions.CookieStore, req *http.Request, w http.ResponseWriter, connection *Connection) {
+	if sessionID := CurrentSessionID(cs, req); sessionID != "" {
+		connection.Logout(sessionID)
+	}
+
+	SetSessionCookie(cs, req, w, "")
+}
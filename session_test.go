@@ -0,0 +1,174 @@
+package main
+
+import (
+	"github.com/codegangsta/martini"
+	"github.com/gorilla/sessions"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testCookieStore() (*Config, *sessions.CookieStore) {
+	cfg := &Config{SecretKey: "a session key of the tests, long enough", CookieSameSite: "lax", SessionExpires: 3600}
+	return cfg, NewCookieStore(cfg)
+}
+
+// requestWithSession returns a request carrying the session cookie pointing
+// to token
+func requestWithSession(t *testing.T, cs *sessions.CookieStore, token string) *http.Request {
+	recorder := httptest.NewRecorder()
+	if err := SetSessionCookie(cs, httptest.NewRequest("GET", "/", nil), recorder, token); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	for _, cookie := range recorder.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	return req
+}
+
+// testStoredSession inserts a session of an user last seen at lastSeen and
+// expiring at expires, returning its token
+func testStoredSession(t *testing.T, connection *Connection, userID string, lastSeen, expires int64) (string, Session) {
+	token, session := NewSession(userID, httptest.NewRequest("GET", "/", nil), time.Hour, nil)
+	session.LastSeen, session.Expires = lastSeen, expires
+
+	if response, err := connection.LoginPostInsertSession(session); err != nil || response.Inserted < 1 {
+		t.Fatalf("session not inserted: %v", err)
+	}
+	return token, session
+}
+
+func TestSessionCookieCarriesTheToken(t *testing.T) {
+	_, cs := testCookieStore()
+	req := requestWithSession(t, cs, "a token")
+
+	if id := CurrentSessionID(cs, req); id != HashToken("a token") {
+		t.Errorf("session id %q, want the hash of the token", id)
+	}
+
+	// The sessions read are kept in the request, so read it again fresh
+	forged := httptest.NewRequest("GET", "/", nil)
+	for _, cookie := range req.Cookies() {
+		forged.AddCookie(cookie)
+	}
+	other := NewCookieStore(&Config{SecretKey: "another key of the tests, long enough", CookieSameSite: "lax"})
+	if id := CurrentSessionID(other, forged); id != "" {
+		t.Errorf("cookie signed with another key read as %q", id)
+	}
+}
+
+func TestSetSessionCookieWithoutTokenRemovesIt(t *testing.T) {
+	_, cs := testCookieStore()
+	w := httptest.NewRecorder()
+
+	if err := SetSessionCookie(cs, requestWithSession(t, cs, "a token"), w, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != sessionCookie || cookies[0].MaxAge >= 0 {
+		t.Errorf("cookie not removed: %+v", cookies)
+	}
+}
+
+func TestRequestsWithoutSessionCookie(t *testing.T) {
+	cfg, cs := testCookieStore()
+	req := httptest.NewRequest("GET", "/", nil)
+
+	// None of these reach the database, which is nil
+	if session := CurrentSession(cs, req, nil); session != nil {
+		t.Errorf("session %+v without a cookie", session)
+	}
+	if userID := GetUserID(cs, req, nil, cfg); userID != "" {
+		t.Errorf("user %q without a cookie", userID)
+	}
+
+	w := httptest.NewRecorder()
+	if err := renewSession("ana", req, w, cs, cfg, nil); err != nil || len(w.Result().Cookies()) > 0 {
+		t.Errorf("session renewed without a cookie: %v, %v", w.Result().Cookies(), err)
+	}
+}
+
+func TestSessionExpirySlidesWhileUsed(t *testing.T) {
+	connection := testConnection(t)
+	cfg, cs := testCookieStore()
+	ana := testUser(t, connection, "ana")
+	now := time.Now().Unix()
+
+	token, session := testStoredSession(t, connection, ana, now-120, now+60)
+	if GetUserID(cs, requestWithSession(t, cs, token), connection, cfg) != ana {
+		t.Fatal("session not accepted")
+	}
+
+	stored, err := connection.GetUnexpiredSession(session.ID)
+	if err != nil || stored == nil {
+		t.Fatalf("session gone: %v", err)
+	}
+	if stored.Expires < now+int64(cfg.SessionExpires) || stored.LastSeen < now {
+		t.Errorf("expiry not moved forward: expires %d, last seen %d", stored.Expires-now, stored.LastSeen-now)
+	}
+}
+
+func TestSessionTouchedAtMostEveryInterval(t *testing.T) {
+	connection := testConnection(t)
+	cfg, cs := testCookieStore()
+	ana := testUser(t, connection, "ana")
+	now := time.Now().Unix()
+
+	token, session := testStoredSession(t, connection, ana, now, now+60)
+	if GetUserID(cs, requestWithSession(t, cs, token), connection, cfg) != ana {
+		t.Fatal("session not accepted")
+	}
+
+	if stored, err := connection.GetUnexpiredSession(session.ID); err != nil || stored == nil || stored.Expires != now+60 {
+		t.Errorf("session written within the touch interval: %+v, %v", stored, err)
+	}
+}
+
+func TestExpiredSessionRejected(t *testing.T) {
+	connection := testConnection(t)
+	cfg, cs := testCookieStore()
+	ana := testUser(t, connection, "ana")
+	now := time.Now().Unix()
+
+	token, _ := testStoredSession(t, connection, ana, now-7200, now-1)
+	if userID := GetUserID(cs, requestWithSession(t, cs, token), connection, cfg); userID != "" {
+		t.Errorf("expired session accepted for %q", userID)
+	}
+}
+
+func TestRevokedSessionsRejected(t *testing.T) {
+	connection := testConnection(t)
+	cfg, cs := testCookieStore()
+	ana, luis := testUser(t, connection, "ana"), testUser(t, connection, "luis")
+	now := time.Now().Unix()
+
+	current, currentSession := testStoredSession(t, connection, ana, now, now+3600)
+	other, otherSession := testStoredSession(t, connection, ana, now, now+3600)
+	third, thirdSession := testStoredSession(t, connection, ana, now, now+3600)
+
+	// Sessions can only be revoked by their user
+	if response, err := connection.RevokeSession(luis, martini.Params{"session": otherSession.ID}); err != nil || response.Deleted != 0 {
+		t.Errorf("session of another user revoked: %d, %v", response.Deleted, err)
+	}
+
+	if response, err := connection.RevokeSession(ana, martini.Params{"session": otherSession.ID}); err != nil || response.Deleted != 1 {
+		t.Fatalf("session not revoked: %d, %v", response.Deleted, err)
+	}
+	if GetUserID(cs, requestWithSession(t, cs, other), connection, cfg) != "" {
+		t.Error("revoked session accepted")
+	}
+
+	if _, err := connection.RevokeOtherSessions(ana, currentSession.ID); err != nil {
+		t.Fatal(err)
+	}
+	if GetUserID(cs, requestWithSession(t, cs, third), connection, cfg) != "" {
+		t.Errorf("session %s accepted after revoking the others", thirdSession.ID)
+	}
+	if GetUserID(cs, requestWithSession(t, cs, current), connection, cfg) != ana {
+		t.Error("current session revoked with the others")
+	}
+}
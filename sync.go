@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"github.com/codegangsta/martini"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// syncWindow is subtracted from the sync token time so writes that were in
+// flight when the token was issued are sent again rather than missed
+const syncWindow = 2 * time.Second
+
+// SyncPageSize is the most bookmarks a delta carries, the rest are fetched
+// with the token it returns
+const SyncPageSize = 500
+
+// Sync change operations
+const (
+	SyncCreate = "create"
+	SyncUpdate = "update"
+	SyncDelete = "delete"
+)
+
+// Sync change results
+const (
+	SyncOk       = "ok"
+	SyncConflict = "conflict"
+	SyncNotFound = "not_found"
+	SyncInvalid  = "invalid"
+	SyncError    = "error"
+)
+
+// ErrInvalidSyncToken is returned for tokens not issued by NewSyncToken
+var ErrInvalidSyncToken = errors.New("invalid sync token")
+
+// Tombstone for JSON schema, left behind by a deleted bookmark
+type Tombstone struct {
+	ID      string  `gorethink:"id" json:"id"`
+	User    string  `gorethink:"User" json:"-"`
+	Deleted float64 `gorethink:"Deleted" json:"deleted"`
+}
+
+// SyncDelta for JSON schema. With More set there are more changed bookmarks
+// to fetch with Token right away.
+type SyncDelta struct {
+	Bookmarks []Bookmark  `json:"bookmarks"`
+	Deleted   []Tombstone `json:"deleted"`
+	Token     string      `json:"token"`
+	More      bool        `json:"more"`
+}
+
+// SyncChange for JSON schema, a change made by a client while offline.
+// ClientID identifies created bookmarks in the results and Version, if
+// given, is the version the update or delete is based on.
+type SyncChange struct {
+	Op       string         `json:"op"`
+	ID       string         `json:"id"`
+	ClientID string         `json:"client_id"`
+	Version  *int64         `json:"version"`
+	Bookmark *bookmarkInput `json:"bookmark"`
+}
+
+// SyncResult for JSON schema. On conflicts Bookmark is the server version.
+type SyncResult struct {
+	Op       string            `json:"op"`
+	ID       string            `json:"id,omitempty"`
+	ClientID string            `json:"client_id,omitempty"`
+	Status   string            `json:"status"`
+	Error    string            `json:"error,omitempty"`
+	Fields   map[string]string `json:"fields,omitempty"`
+	Bookmark *Bookmark         `json:"bookmark,omitempty"`
+}
+
+// NewSyncToken issues a token for the changes made at or after since, a
+// time of the database clock in fractional unix seconds. After is the id of
+// the last bookmark of a page changed at since, if the delta was paged.
+func NewSyncToken(since float64, after string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("2:" + strconv.FormatFloat(since, 'g', -1, 64) + ":" + after))
+}
+
+// ParseSyncToken returns the time and the bookmark id from which changes
+// have to be sent. An empty token means everything. Tokens of the first
+// version hold the time of the Magnet server.
+func ParseSyncToken(token string) (float64, string, error) {
+	if token == "" {
+		return 0, "", nil
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, "", ErrInvalidSyncToken
+	}
+
+	parts := strings.SplitN(string(decoded), ":", 3)
+	switch {
+	case len(parts) == 2 && parts[0] == "1":
+		nanos, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return 0, "", ErrInvalidSyncToken
+		}
+		return float64(nanos-int64(syncWindow)) / 1e9, "", nil
+	case len(parts) == 3 && parts[0] == "2":
+		since, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || since < 0 {
+			return 0, "", ErrInvalidSyncToken
+		}
+		return since, parts[2], nil
+	}
+
+	return 0, "", ErrInvalidSyncToken
+}
+
+// ApplySyncChange applies a client change for an user and reports how it
+// went
+func ApplySyncChange(connection *Connection, userID string, change SyncChange) SyncResult {
+	result := SyncResult{Op: change.Op, ID: change.ID, ClientID: change.ClientID}
+	params := martini.Params{"bookmark": change.ID}
+	input := change.Bookmark
+	if input == nil {
+		input = new(bookmarkInput)
+	}
+
+	version := AnyVersion
+	if change.Version != nil {
+		version = *change.Version
+	}
+
+	if change.Op != SyncCreate && change.Op != SyncUpdate && change.Op != SyncDelete {
+		result.Status, result.Error = SyncInvalid, "Unknown operation."
+		return result
+	}
+
+	if change.Op != SyncCreate && change.ID == "" {
+		result.Status, result.Error = SyncInvalid, "The bookmark id is required."
+		return result
+	}
+
+	if change.Op != SyncDelete {
+		if err := input.validate(change.Op == SyncCreate); err != nil {
+			result.Status, result.Error, result.Fields = SyncInvalid, err.Message, err.Fields
+			return result
+		}
+	}
+
+	var err error
+	switch change.Op {
+	case SyncCreate:
+		var tags []string
+		if input.Tags != nil {
+			tags = *input.Tags
+		}
+		bookmark := NewBookmarkDocument(userID, *input.Title, *input.URL, ParseTags(strings.Join(tags, ",")))
+		if input.Unread != nil {
+			bookmark["Unread"] = *input.Unread
+		}
+		if input.Private != nil {
+			bookmark["Private"] = *input.Private
+		}
+
+		response, insertErr := connection.NewBookmark(userID, bookmark)
+		if insertErr != nil || response.Inserted < 1 {
+			result.Status, result.Error = SyncError, "Error inserting bookmark."
+			return result
+		}
+		result.ID = response.GeneratedKeys[0]
+		params["bookmark"] = result.ID
+	case SyncUpdate:
+		edit := input.edit()
+		edit.Version = version
+
+		response, editErr := connection.EditBookmark(userID, params, edit)
+		if editErr == nil && !EditFound(response) {
+			result.Status = SyncNotFound
+			return result
+		}
+		err = editErr
+	case SyncDelete:
+		response, deleteErr := connection.DeleteBookmark(userID, params, version)
+		if deleteErr == nil {
+			result.Status = SyncOk
+			if response.Deleted < 1 {
+				result.Status = SyncNotFound
+			}
+			return result
+		}
+		err = deleteErr
+	}
+
+	switch err {
+	case nil:
+		result.Status = SyncOk
+	case ErrVersionConflict:
+		result.Status = SyncConflict
+	default:
+		result.Status, result.Error = SyncError, "Error applying change."
+		return result
+	}
+
+	result.Bookmark, _ = connection.GetBookmark(userID, params)
+	return result
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestSyncTokenRoundTrip(t *testing.T) {
+	tests := []struct {
+		since float64
+		after string
+	}{
+		{1500000000.123, ""},
+		{1500000000.123, "3f2a9c"},
+		{0, "3f2a9c"},
+	}
+
+	for _, test := range tests {
+		since, after, err := ParseSyncToken(NewSyncToken(test.since, test.after))
+		if err != nil || since != test.since || after != test.after {
+			t.Errorf("%v %q: got %v %q, %v", test.since, test.after, since, after, err)
+		}
+	}
+}
+
+func TestParseSyncTokenVersions(t *testing.T) {
+	legacy := base64.RawURLEncoding.EncodeToString([]byte("1:1500000002000000000"))
+	if since, after, err := ParseSyncToken(legacy); err != nil || since != 1500000000 || after != "" {
+		t.Errorf("legacy token: %v %q, %v", since, after, err)
+	}
+
+	if since, after, err := ParseSyncToken(""); err != nil || since != 0 || after != "" {
+		t.Errorf("empty token: %v %q, %v", since, after, err)
+	}
+
+	for _, token := range []string{"not base64!", base64.RawURLEncoding.EncodeToString([]byte("3:1:x")), base64.RawURLEncoding.EncodeToString([]byte("2:-1:")), base64.RawURLEncoding.EncodeToString([]byte("2:soon:"))} {
+		if _, _, err := ParseSyncToken(token); err != ErrInvalidSyncToken {
+			t.Errorf("%q: error %v", token, err)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// throttlePruneInterval is how often forgotten entries are removed
+const throttlePruneInterval = time.Minute
+
+// throttleEntry counts the recent failures of a key
+type throttleEntry struct {
+	failures    int
+	last        time.Time
+	next        time.Time
+	lockedUntil time.Time
+}
+
+// LoginThrottle slows down repeated failed attempts of the same key, an IP
+// address or an username. Each failure doubles the wait before the next
+// attempt, and too many failures lock the key for a while. Failures are
+// forgotten after the lockout duration without new ones.
+type LoginThrottle struct {
+	mu        sync.Mutex
+	entries   map[string]*throttleEntry
+	baseDelay time.Duration
+	maxDelay  time.Duration
+	lockout   time.Duration
+	lastPrune time.Time
+}
+
+// NewLoginThrottle creates a throttle with the limits of the config
+func NewLoginThrottle(config *Config) *LoginThrottle {
+	return &LoginThrottle{
+		entries:   make(map[string]*throttleEntry),
+		baseDelay: time.Duration(config.ThrottleDelay) * time.Second,
+		maxDelay:  time.Duration(config.ThrottleMaxDelay) * time.Second,
+		lockout:   time.Duration(config.LockoutDuration) * time.Second,
+		lastPrune: time.Now(),
+	}
+}
+
+// Wait returns how long the caller has to wait before trying again with
+// any of the keys, zero if it can try now
+func (t *LoginThrottle) Wait(keys ...string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	var wait time.Duration
+
+	for _, key := range keys {
+		entry, ok := t.entries[key]
+		if !ok {
+			continue
+		}
+
+		for _, until := range []time.Time{entry.next, entry.lockedUntil} {
+			if until.Sub(now) > wait {
+				wait = until.Sub(now)
+			}
+		}
+	}
+
+	return wait
+}
+
+// Fail records a failed attempt for a key. It returns true if the key has
+// just been locked because it reached maxFailures.
+func (t *LoginThrottle) Fail(key string, maxFailures int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.prune(now)
+
+	entry, ok := t.entries[key]
+	if !ok || now.Sub(entry.last) > t.lockout {
+		entry = &throttleEntry{}
+		t.entries[key] = entry
+	}
+
+	entry.failures++
+	entry.last = now
+
+	delay := t.baseDelay
+	for i := 1; i < entry.failures && delay < t.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > t.maxDelay {
+		delay = t.maxDelay
+	}
+	entry.next = now.Add(delay)
+
+	if maxFailures > 0 && entry.failures >= maxFailures && now.After(entry.lockedUntil) {
+		entry.lockedUntil = now.Add(t.lockout)
+		entry.failures = 0
+		return true
+	}
+
+	return false
+}
+
+// Reset forgets the failures of a key after a successful attempt
+func (t *LoginThrottle) Reset(key string) {
+	t.mu.Lock()
+	delete(t.entries, key)
+	t.mu.Unlock()
+}
+
+// prune removes the entries that would be forgotten anyway
+func (t *LoginThrottle) prune(now time.Time) {
+	if now.Sub(t.lastPrune) < throttlePruneInterval {
+		return
+	}
+	t.lastPrune = now
+
+	for key, entry := range t.entries {
+		if now.Sub(entry.last) > t.lockout && now.After(entry.lockedUntil) {
+			delete(t.entries, key)
+		}
+	}
+}
+
+// IPThrottleKey returns the throttle key of the address of a request for an
+// action such as login or signup
+func IPThrottleKey(action string, req *http.Request) string {
+	return action + ":ip:" + ClientIP(req)
+}
+
+// UserThrottleKey returns the throttle key of an username for an action
+func UserThrottleKey(action, username string) string {
+	return action + ":user:" + strings.ToLower(username)
+}
+
+// WriteThrottledResponse tells the client how long to wait before trying
+// again
+func WriteThrottledResponse(wait time.Duration, req *http.Request, w http.ResponseWriter) {
+	seconds := int64(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	WriteJSONResponse(429, true, fmt.Sprintf("Too many failed attempts, try again in %d seconds.", seconds), req, w)
+}
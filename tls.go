@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// certCheckInterval limits how often the certificate files are checked for
+// changes, so handshakes don't all stat them
+const certCheckInterval = 10 * time.Second
+
+// CertReloader serves a certificate loaded from files, loading it again
+// when the files change so renewed certificates need no restart
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+// NewCertReloader loads the certificate and key files, failing if they
+// are not a valid pair
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	reloader := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+
+	return reloader, nil
+}
+
+// load reads the pair, keeping the modification time of the newest file
+func (c *CertReloader) load() error {
+	modTime, err := c.filesModTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+func (c *CertReloader) filesModTime() (time.Time, error) {
+	var newest time.Time
+
+	for _, name := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return newest, err
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+
+	return newest, nil
+}
+
+// GetCertificate returns the current certificate, for tls.Config. A pair
+// that fails to load is logged and the previous certificate kept, as the
+// files may be halfway replaced.
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.lastCheck) < certCheckInterval {
+		return c.cert, nil
+	}
+	c.lastCheck = time.Now()
+
+	modTime, err := c.filesModTime()
+	if err == nil && modTime.Equal(c.modTime) {
+		return c.cert, nil
+	}
+
+	if err == nil {
+		err = c.load()
+	}
+	if err != nil {
+		defaultLogger.Error("certificate not reloaded", "cert", c.certFile, "err", err)
+	} else {
+		defaultLogger.Info("certificate reloaded", "cert", c.certFile)
+	}
+
+	return c.cert, nil
+}
+
+// TLSConfig returns the TLS settings of a server using the reloader
+func (c *CertReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: c.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// NewRedirectServer returns a server sending every request on the
+// TLSRedirectPort to the same URL over HTTPS
+func NewRedirectServer(config *Config) *http.Server {
+	port := ""
+	if _, p, err := net.SplitHostPort(config.Port); err == nil && p != "443" {
+		port = ":" + p
+	}
+
+	server := NewHTTPServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		http.Redirect(w, req, "https://"+host+port+req.URL.RequestURI(), http.StatusMovedPermanently)
+	}), config)
+	server.Addr = config.TLSRedirectPort
+
+	return server
+}
+
+// HSTS tells browsers to only use HTTPS for the next maxAge seconds, on
+// responses served over TLS
+func HSTS(maxAge int, next http.Handler) http.Handler {
+	value := "max-age=" + strconv.Itoa(maxAge)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.TLS != nil && maxAge > 0 {
+			w.Header().Set("Strict-Transport-Security", value)
+		}
+		next.ServeHTTP(w, req)
+	})
+}
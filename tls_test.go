@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for name and its key,
+// dated modTime
+func writeTestCert(t *testing.T, certFile, keyFile, name string, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), modTime)
+	writeTestFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), modTime)
+}
+
+func writeTestFile(t *testing.T, name string, content []byte, modTime time.Time) {
+	if err := os.WriteFile(name, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(name, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// certName returns the name the reloader currently serves
+func certName(t *testing.T, reloader *CertReloader) string {
+	cert, err := reloader.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed.Subject.CommonName
+}
+
+func TestCertReloaderReloadsChangedFiles(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	then := time.Now().Add(-time.Hour)
+	writeTestCert(t, certFile, keyFile, "old.example.com", then)
+
+	reloader, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := certName(t, reloader); name != "old.example.com" {
+		t.Fatalf("serving %s", name)
+	}
+
+	writeTestCert(t, certFile, keyFile, "new.example.com", then.Add(time.Minute))
+
+	// The files are only checked once every interval
+	if name := certName(t, reloader); name != "old.example.com" {
+		t.Errorf("files checked within the interval, serving %s", name)
+	}
+
+	reloader.lastCheck = time.Time{}
+	if name := certName(t, reloader); name != "new.example.com" {
+		t.Errorf("renewed certificate not served, serving %s", name)
+	}
+}
+
+func TestCertReloaderKeepsCertificateWhileFilesAreInvalid(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	then := time.Now().Add(-time.Hour)
+	writeTestCert(t, certFile, keyFile, "old.example.com", then)
+
+	reloader, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A certificate replaced before its key
+	writeTestFile(t, keyFile, []byte("half written"), then.Add(time.Minute))
+	reloader.lastCheck = time.Time{}
+	if name := certName(t, reloader); name != "old.example.com" {
+		t.Errorf("serving %s with an invalid key", name)
+	}
+
+	os.Remove(certFile)
+	reloader.lastCheck = time.Time{}
+	if name := certName(t, reloader); name != "old.example.com" {
+		t.Errorf("serving %s without a certificate file", name)
+	}
+}
+
+func TestNewCertReloaderRejectsInvalidPairs(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	otherCert, otherKey := filepath.Join(dir, "other.pem"), filepath.Join(dir, "other-key.pem")
+	writeTestCert(t, certFile, keyFile, "magnet.example.com", time.Now())
+	writeTestCert(t, otherCert, otherKey, "other.example.com", time.Now())
+
+	if _, err := NewCertReloader(certFile, otherKey); err == nil {
+		t.Error("certificate loaded with the key of another")
+	}
+	if _, err := NewCertReloader(filepath.Join(dir, "missing.pem"), keyFile); err == nil {
+		t.Error("missing certificate loaded")
+	}
+
+	reloader, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config := reloader.TLSConfig(); config.MinVersion != tls.VersionTLS12 || config.GetCertificate == nil {
+		t.Errorf("TLS config %+v", config)
+	}
+}
+
+func TestRedirectServer(t *testing.T) {
+	tests := []struct {
+		port string
+		want string
+	}{
+		{":443", "https://magnet.example.com/bookmarks?page=2"},
+		{":8443", "https://magnet.example.com:8443/bookmarks?page=2"},
+	}
+
+	for _, test := range tests {
+		server := NewRedirectServer(&Config{Port: test.port, TLSRedirectPort: ":80"})
+		if server.Addr != ":80" {
+			t.Errorf("listening on %s", server.Addr)
+		}
+
+		w := httptest.NewRecorder()
+		server.Handler.ServeHTTP(w, httptest.NewRequest("GET", "http://magnet.example.com:80/bookmarks?page=2", nil))
+		if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != test.want {
+			t.Errorf("%s: %d to %s", test.port, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
+
+func TestHSTSOnlyOverTLS(t *testing.T) {
+	handler := HSTS(31536000, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://magnet.example.com/", nil))
+	if value := w.Header().Get("Strict-Transport-Security"); value != "" {
+		t.Errorf("HSTS over plain HTTP: %q", value)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "https://magnet.example.com/", nil))
+	if value := w.Header().Get("Strict-Transport-Security"); value != "max-age=31536000" {
+		t.Errorf("HSTS over TLS: %q", value)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP parameters, the defaults of RFC 6238 which every authenticator app
+// supports
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	totpSkew   = 1
+)
+
+// TwoFactorExpires is how long the code can be entered after the password
+const TwoFactorExpires = 5 * time.Minute
+
+// RecoveryCodeCount is the number of recovery codes issued at once
+const RecoveryCodeCount = 10
+
+// NewTOTPSecret returns a random secret encoded as unpadded base32
+func NewTOTPSecret() string {
+	b := make([]byte, 20)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		panic(err)
+	}
+
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+}
+
+// TOTPURI returns the otpauth URI authenticator apps enroll from, usually by
+// scanning it as a QR code
+func TOTPURI(issuer, account, secret string) string {
+	values := url.Values{}
+	values.Set("secret", secret)
+	values.Set("issuer", issuer)
+	values.Set("period", fmt.Sprint(totpPeriod))
+	values.Set("digits", fmt.Sprint(totpDigits))
+
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + values.Encode()
+}
+
+// TOTPCode returns the code of a secret for a time step
+func TOTPCode(secret string, step int64) (string, error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", totpDigits, value%mod), nil
+}
+
+// ValidateTOTP checks a code against the steps around t, allowing for clock
+// drift. It returns the matching step, which must be later than lastStep so
+// a code cannot be used twice.
+func ValidateTOTP(secret, code string, t time.Time, lastStep int64) (int64, bool) {
+	code = strings.Replace(strings.TrimSpace(code), " ", "", -1)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := t.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+
+		expected, err := TOTPCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+
+		if hmac.Equal([]byte(expected), []byte(code)) {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// NewRecoveryCodes returns a set of recovery codes to show the user along
+// with the hashes to store
+func NewRecoveryCodes() ([]string, []string) {
+	codes := make([]string, RecoveryCodeCount)
+	hashes := make([]string, RecoveryCodeCount)
+
+	for i := range codes {
+		token := RandomToken(5)
+		codes[i] = token[:5] + "-" + token[5:]
+		hashes[i] = HashRecoveryCode(codes[i])
+	}
+
+	return codes, hashes
+}
+
+// HashRecoveryCode returns the stored form of a recovery code, ignoring case
+// and the dash
+func HashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	return HashToken(code)
+}
+
+// CheckTwoFactorCode checks a TOTP or recovery code of an user, marking it
+// as used
+func CheckTwoFactorCode(connection *Connection, user *User, code string) bool {
+	if strings.TrimSpace(code) == "" {
+		return false
+	}
+
+	if step, ok := ValidateTOTP(user.TOTPSecret, code, time.Now(), user.TOTPLastStep); ok {
+		used, err := connection.UseTOTPStep(user.ID, step)
+		return err == nil && used
+	}
+
+	used, err := connection.UseRecoveryCode(user.ID, HashRecoveryCode(code))
+	return err == nil && used
+}
+
+// DisableTwoFactorFor turns off two-factor authentication for an user who
+// lost their authenticator and recovery codes, closing their sessions
+func DisableTwoFactorFor(connection *Connection, username string) error {
+	user, err := connection.GetUserByUsername(username)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return fmt.Errorf("user %s not found", username)
+	}
+
+	if _, err := connection.DisableTOTP(user.ID); err != nil {
+		return fmt.Errorf("error disabling two-factor authentication: %s", err)
+	}
+	connection.DeleteUserSessions(user.ID)
+
+	connection.logger.Info("two-factor authentication disabled", "username", username)
+	return nil
+}
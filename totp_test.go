@@ -0,0 +1,115 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 key of the RFC 6238 test vectors,
+// "12345678901234567890" in base32
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCodeRFC6238Vectors(t *testing.T) {
+	// The RFC gives eight digits, six digit codes are their last six
+	tests := []struct {
+		time int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, test := range tests {
+		code, err := TOTPCode(rfc6238Secret, test.time/totpPeriod)
+		if err != nil || code != test.code {
+			t.Errorf("time %d: code %q, %v, want %q", test.time, code, err, test.code)
+		}
+
+		step, ok := ValidateTOTP(rfc6238Secret, test.code, time.Unix(test.time, 0), 0)
+		if !ok || step != test.time/totpPeriod {
+			t.Errorf("time %d: step %d, %v", test.time, step, ok)
+		}
+	}
+}
+
+func TestValidateTOTPSkew(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	step := now.Unix() / totpPeriod
+
+	tests := []struct {
+		step int64
+		ok   bool
+	}{
+		{step - 2, false},
+		{step - 1, true},
+		{step + 1, true},
+		{step + 2, false},
+	}
+
+	for _, test := range tests {
+		code, _ := TOTPCode(rfc6238Secret, test.step)
+		if _, ok := ValidateTOTP(rfc6238Secret, code, now, 0); ok != test.ok {
+			t.Errorf("step %+d: valid %v, want %v", test.step-step, ok, test.ok)
+		}
+	}
+}
+
+func TestValidateTOTPRejectsReplay(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	code, _ := TOTPCode(rfc6238Secret, now.Unix()/totpPeriod)
+
+	step, ok := ValidateTOTP(rfc6238Secret, code, now, 0)
+	if !ok {
+		t.Fatal("code rejected")
+	}
+	if _, ok := ValidateTOTP(rfc6238Secret, code, now, step); ok {
+		t.Error("code accepted again after its step was used")
+	}
+	if _, ok := ValidateTOTP(rfc6238Secret, code, now.Add(totpPeriod*time.Second), step); ok {
+		t.Error("code accepted again in the next period")
+	}
+}
+
+func TestValidateTOTPRejectsMalformedCodes(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	code, _ := TOTPCode(rfc6238Secret, now.Unix()/totpPeriod)
+
+	if _, ok := ValidateTOTP(rfc6238Secret, code[:3]+" "+code[3:], now, 0); !ok {
+		t.Error("code with a space rejected")
+	}
+	for _, bad := range []string{"", code[:5], code + "0", "abcdef"} {
+		if _, ok := ValidateTOTP(rfc6238Secret, bad, now, 0); ok {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+	if _, ok := ValidateTOTP("not base32!", code, now, 0); ok {
+		t.Error("invalid secret accepted")
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes := NewRecoveryCodes()
+	if len(codes) != RecoveryCodeCount || len(hashes) != RecoveryCodeCount {
+		t.Fatalf("%d codes and %d hashes", len(codes), len(hashes))
+	}
+
+	seen := make(map[string]bool)
+	for i, code := range codes {
+		if seen[hashes[i]] {
+			t.Errorf("code %q repeated", code)
+		}
+		seen[hashes[i]] = true
+
+		// Codes are accepted without the dash and in any case
+		for _, typed := range []string{code, " " + code + " ", code[:5] + code[6:], strings.ToUpper(code)} {
+			if HashRecoveryCode(typed) != hashes[i] {
+				t.Errorf("%q does not match the hash of %q", typed, code)
+			}
+		}
+	}
+}
@@ -10,21 +10,64 @@ import (
 
 // User for JSON schema
 type User struct {
-	Username string `json:"Username"`
-	Email    string `json:"Email"`
-	Password string `json:"Password"`
+	ID            string   `gorethink:"id,omitempty" json:"id"`
+	Username      string   `json:"Username"`
+	Email         string   `json:"Email"`
+	Password      string   `json:"Password"`
+	EmailVerified bool     `json:"EmailVerified"`
+	TOTPEnabled   bool     `json:"TOTPEnabled"`
+	TOTPSecret    string   `gorethink:"TOTPSecret" json:"-"`
+	TOTPPending   string   `gorethink:"TOTPPending" json:"-"`
+	TOTPLastStep  int64    `gorethink:"TOTPLastStep" json:"-"`
+	RecoveryCodes []string `gorethink:"RecoveryCodes" json:"-"`
+	OIDCSubject   string   `json:"OIDCSubject"`
+	LDAPDN        string   `json:"LDAPDN"`
+	Admin         bool     `json:"Admin"`
+	Disabled      bool     `json:"Disabled"`
+	InvitedBy     string   `json:"InvitedBy"`
+	// DomainSignUp users signed up without an invite for being in an allowed
+	// domain, so they cannot log in before verifying their email
+	DomainSignUp bool `json:"DomainSignUp"`
 }
 
-// Session for JSON schema
+// Session for JSON schema. Expires moves forward while the session is used.
+// The id is the hash of the token in the cookie.
 type Session struct {
-	UserID  string `json:"UserId"`
-	Expires int64  `json:"Expires"`
+	ID        string `gorethink:"id,omitempty" json:"id"`
+	UserID    string `gorethink:"UserID" json:"UserId"`
+	Expires   int64  `json:"Expires"`
+	UserAgent string `json:"UserAgent"`
+	IP        string `json:"IP"`
+	Created   int64  `json:"Created"`
+	LastSeen  int64  `json:"LastSeen"`
+	// Data is the state of a login flow, for sessions of no user
+	Data map[string]string `json:"Data,omitempty"`
 }
 
-// GetUserData fetches user session data
-func GetUserData(cs *sessions.CookieStore, req *http.Request) (string, string) {
-	session, _ := cs.Get(req, "magnet_session")
-	return session.Values["username"].(string), session.Values["user_id"].(string)
+// GetUserData returns the username and id of the user logged in, resolved
+// from the stored session. Disabled users are not logged in.
+func GetUserData(cs *sessions.CookieStore, req *http.Request, connection *Connection) (string, string) {
+	userID := SessionUserID(cs, req, connection)
+	if userID == "" {
+		return "", ""
+	}
+
+	user, err := connection.GetUser(userID)
+	if err != nil || user == nil || user.Disabled {
+		return "", ""
+	}
+
+	return user.Username, userID
+}
+
+// SessionUserID returns the id of the user logged in, empty if none
+func SessionUserID(cs *sessions.CookieStore, req *http.Request, connection *Connection) string {
+	stored := CurrentSession(cs, req, connection)
+	if stored == nil {
+		return ""
+	}
+
+	return stored.UserID
 }
 
 func cryptPassword(password, salt string) string {
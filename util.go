@@ -5,6 +5,7 @@ import (
 	"github.com/gorilla/sessions"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 )
 
@@ -32,28 +33,33 @@ func WriteJSONResponse(status int, error bool, message string, r *http.Request,
 	w.Write(jsonResp)
 }
 
-// GetUserID fetches userID from rethinkdb
-func GetUserID(cs *sessions.CookieStore, req *http.Request, connection *Connection) string {
-	session, _ := cs.Get(req, "magnet_session")
-	var response map[string]interface{}
-
-	userID := ""
+// GetUserID fetches userID from rethinkdb, extending the session expiry
+// while it is used. Sessions of disabled or deleted users are not valid.
+func GetUserID(cs *sessions.CookieStore, req *http.Request, connection *Connection, cfg *Config) string {
+	stored := CurrentSession(cs, req, connection)
+	if stored == nil || stored.UserID == "" {
+		return ""
+	}
 
-	response, err := connection.GetUnexpiredSession(session)
+	user, err := connection.GetUser(stored.UserID)
+	if err != nil || user == nil || user.Disabled {
+		return ""
+	}
 
-	if err == nil && len(response) > 0 {
-		if int64(response["Expires"].(float64)) > time.Now().Unix() {
-			userID = response["UserID"].(string)
-		}
+	now := time.Now()
+	if now.Sub(time.Unix(stored.LastSeen, 0)) >= sessionTouchInterval {
+		connection.TouchSession(stored.ID, now.Unix(), now.Unix()+int64(cfg.SessionExpires))
 	}
 
-	return userID
+	return stored.UserID
 }
 
 // AuthRequired checks user session
-func AuthRequired(cs *sessions.CookieStore, req *http.Request, w http.ResponseWriter, connection *Connection) {
-	if GetUserID(cs, req, connection) == "" {
+func AuthRequired(cs *sessions.CookieStore, req *http.Request, w http.ResponseWriter, connection *Connection, cfg *Config) {
+	if GetUserID(cs, req, connection, cfg) == "" {
 		WriteJSONResponse(401, true, "User is not logged in.", req, w)
+	} else {
+		RefreshSessionCookie(cs, req, w, cfg)
 	}
 }
 
@@ -66,3 +72,26 @@ func IsValidURL(urlStr string) bool {
 
 	return parsedURL.IsAbs()
 }
+
+// ParseTags splits a comma separated list of tags, normalizing each one
+func ParseTags(tags string) []string {
+	result := []string{}
+	for _, tag := range strings.Split(tags, ",") {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag != "" {
+			result = append(result, tag)
+		}
+	}
+
+	return result
+}
+
+// RequestVersion returns the bookmark version a request is based on, taken
+// from the If-Match header or the version form value
+func RequestVersion(req *http.Request) (int64, bool) {
+	if header := req.Header.Get("If-Match"); header != "" {
+		return ParseIfMatch(header)
+	}
+
+	return ParseIfMatch(req.FormValue("version"))
+}
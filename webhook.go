@@ -0,0 +1,628 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/codegangsta/martini"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	webhookMaxAttempts = 6
+	webhookBaseDelay   = 10 * time.Second
+	webhookTimeout     = 10 * time.Second
+
+	// webhookPollInterval is how often due retries are looked for
+	webhookPollInterval = 5 * time.Second
+	// webhookPruneInterval is how often old delivery attempts are deleted
+	webhookPruneInterval = time.Hour
+	// webhookClaimRetention is how long delivery claims are kept, longer
+	// than any changefeed takes to reach every instance
+	webhookClaimRetention = 24 * time.Hour
+	// webhookMaxResubscribeDelay caps the wait between attempts to open
+	// the bookmark changefeed again
+	webhookMaxResubscribeDelay = time.Minute
+)
+
+// ErrWebhookDestination is returned when a webhook URL points at an address
+// webhooks are not delivered to
+var ErrWebhookDestination = errors.New("webhook destination is a private address")
+
+// privateNetworks are the loopback, private, shared, link-local, multicast
+// and unspecified ranges webhooks are not delivered to, unless
+// MAGNET_WEBHOOK_ALLOW_PRIVATE is set
+var privateNetworks = parseNetworks(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.168.0.0/16", "224.0.0.0/4", "240.0.0.0/4",
+	"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+
+	return networks
+}
+
+// PublicIP tells if an address is outside the private networks
+func PublicIP(ip net.IP) bool {
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Webhook for JSON schema
+type Webhook struct {
+	ID      string `gorethink:"id,omitempty" json:"id"`
+	User    string
+	URL     string
+	Secret  string `gorethink:"Secret" json:"-"`
+	Events  []string
+	Tag     string
+	Active  bool
+	Created float64
+}
+
+// WebhookDelivery for JSON schema, one per delivery attempt
+type WebhookDelivery struct {
+	ID         string `gorethink:"id,omitempty" json:"id"`
+	Webhook    string
+	User       string
+	Delivery   string
+	Event      string
+	Attempt    int
+	StatusCode int
+	Error      string
+	Success    bool
+	Duration   int64
+	Created    float64
+}
+
+// WebhookRetry for JSON schema, a failed delivery waiting to be attempted
+// again once Due has passed
+type WebhookRetry struct {
+	ID       string `gorethink:"id,omitempty" json:"id"`
+	Webhook  string
+	User     string
+	Delivery string
+	Event    string
+	Payload  string
+	Attempt  int
+	Due      float64
+}
+
+// WebhookClaim for JSON schema, taken by the instance making the first
+// attempt of a delivery
+type WebhookClaim struct {
+	ID      string `gorethink:"id" json:"id"`
+	Webhook string
+	Created float64
+}
+
+// WebhookPayload for JSON schema, the body posted to webhooks
+type WebhookPayload struct {
+	Delivery string    `json:"delivery"`
+	Event    string    `json:"event"`
+	Created  int64     `json:"created"`
+	Bookmark *Bookmark `json:"bookmark"`
+}
+
+// Validate returns the problems of each invalid field, if any. Unless
+// allowPrivate is set the URL can't name a private address; host names are
+// checked when delivering, once they are resolved.
+func (wh *Webhook) Validate(allowPrivate bool) map[string]string {
+	fields := make(map[string]string)
+
+	parsedURL, err := url.Parse(wh.URL)
+	if err != nil || !parsedURL.IsAbs() || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") || parsedURL.Hostname() == "" {
+		fields["url"] = "must be an absolute http or https URL"
+	} else if !allowPrivate && privateHost(parsedURL.Hostname()) {
+		fields["url"] = "must not point at a private address"
+	}
+
+	if len(wh.Events) == 0 {
+		fields["events"] = "must not be empty"
+	}
+
+	for _, event := range wh.Events {
+		if event != EventCreated && event != EventUpdated && event != EventDeleted {
+			fields["events"] = "must only contain created, updated or deleted"
+		}
+	}
+
+	return fields
+}
+
+// Matches tells if an event has to be delivered to the webhook
+func (wh *Webhook) Matches(event BookmarkEvent) bool {
+	if !wh.Active || event.User != wh.User {
+		return false
+	}
+
+	subscribed := false
+	for _, name := range wh.Events {
+		subscribed = subscribed || name == event.Type
+	}
+
+	if !subscribed {
+		return false
+	}
+
+	if wh.Tag == "" {
+		return true
+	}
+
+	if event.Bookmark != nil {
+		for _, tag := range event.Bookmark.Tags {
+			if tag == wh.Tag {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// privateHost tells if a host is localhost or a private address
+func privateHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && !PublicIP(ip)
+}
+
+// SignWebhookPayload returns the value of the X-Magnet-Signature header, an
+// HMAC-SHA256 of the body keyed with the webhook secret
+func SignWebhookPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// RandomToken returns n random bytes encoded as hex
+func RandomToken(n int) string {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// webhookJob is a pending delivery attempt
+type webhookJob struct {
+	webhook  Webhook
+	delivery string
+	event    string
+	payload  []byte
+	attempt  int
+}
+
+// WebhookDispatcher delivers bookmark events to the matching webhooks from
+// a pool of background workers, retrying failed deliveries with exponential
+// backoff. First attempts are claimed and retries kept in the store, so
+// instances sharing it deliver each attempt once.
+type WebhookDispatcher struct {
+	connection   *Connection
+	client       *http.Client
+	dialer       *net.Dialer
+	workers      int
+	retention    time.Duration
+	allowPrivate bool
+	jobs         chan *webhookJob
+	stop         chan struct{}
+	wg           sync.WaitGroup
+
+	mu     sync.Mutex
+	cancel func()
+}
+
+// NewWebhookDispatcher creates a dispatcher with the given number of
+// workers, keeping delivery attempts for retention or forever if it is 0.
+// Deliveries to private addresses fail unless allowPrivate is set.
+func NewWebhookDispatcher(connection *Connection, workers int, retention time.Duration, allowPrivate bool) *WebhookDispatcher {
+	if workers < 1 {
+		workers = 1
+	}
+
+	d := &WebhookDispatcher{
+		connection:   connection,
+		dialer:       &net.Dialer{Timeout: webhookTimeout},
+		workers:      workers,
+		retention:    retention,
+		allowPrivate: allowPrivate,
+		jobs:         make(chan *webhookJob, 256),
+		stop:         make(chan struct{}),
+	}
+	d.client = &http.Client{
+		Timeout:   webhookTimeout,
+		Transport: &http.Transport{DialContext: d.dial, TLSHandshakeTimeout: webhookTimeout},
+	}
+
+	return d
+}
+
+// dial connects to a webhook destination. The resolved addresses are
+// checked, rather than the URL, so host names and redirects pointing at
+// private addresses are refused too.
+func (d *WebhookDispatcher) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ip := range addresses {
+		if !d.allowPrivate && !PublicIP(ip.IP) {
+			return nil, ErrWebhookDestination
+		}
+	}
+
+	var conn net.Conn
+	for _, ip := range addresses {
+		if conn, err = d.dialer.DialContext(ctx, network, net.JoinHostPort(ip.IP.String(), port)); err == nil {
+			return conn, nil
+		}
+	}
+
+	return nil, err
+}
+
+// Start subscribes to the bookmark events of every user and starts the
+// workers, the retries and the pruning of old delivery attempts
+func (d *WebhookDispatcher) Start() error {
+	events, cancel, err := d.connection.Subscribe("")
+	if err != nil {
+		return err
+	}
+	d.setCancel(cancel)
+
+	d.connection.metrics.Gauge("magnet_webhook_queue_length", "Webhook deliveries waiting for a worker.", func() float64 {
+		return float64(len(d.jobs))
+	})
+
+	d.wg.Add(2)
+	go d.listen(events)
+	go d.maintain()
+
+	for i := 0; i < d.workers; i++ {
+		d.wg.Add(1)
+		go d.work()
+	}
+
+	return nil
+}
+
+// Stop stops listening for events and waits for the running deliveries.
+// Deliveries still queued, claimed first attempts and retries alike, go
+// back to the store due right away, to be attempted after a restart or by
+// another instance.
+func (d *WebhookDispatcher) Stop() {
+	d.mu.Lock()
+	close(d.stop)
+	if d.cancel != nil {
+		d.cancel()
+	}
+	d.mu.Unlock()
+
+	d.wg.Wait()
+
+	for {
+		select {
+		case job := <-d.jobs:
+			d.schedule(job, job.attempt, time.Now())
+		default:
+			return
+		}
+	}
+}
+
+// setCancel keeps the function ending the current subscription, ending it
+// right away if the dispatcher stopped meanwhile
+func (d *WebhookDispatcher) setCancel(cancel func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	select {
+	case <-d.stop:
+		cancel()
+	default:
+		d.cancel = cancel
+	}
+}
+
+func (d *WebhookDispatcher) stopped() bool {
+	select {
+	case <-d.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// listen dispatches events until the dispatcher stops. When the feed ends,
+// as changefeeds do if the store restarts, it subscribes again with
+// exponential backoff.
+func (d *WebhookDispatcher) listen(events <-chan BookmarkEvent) {
+	defer d.wg.Done()
+	delay := time.Second
+
+	for {
+		if events != nil {
+			for event := range events {
+				d.dispatch(event)
+				delay = time.Second
+			}
+		}
+
+		if d.stopped() {
+			return
+		}
+
+		d.connection.logger.Warn("bookmark events ended, subscribing again", "delay", delay)
+		select {
+		case <-time.After(delay):
+		case <-d.stop:
+			return
+		}
+		if delay *= 2; delay > webhookMaxResubscribeDelay {
+			delay = webhookMaxResubscribeDelay
+		}
+
+		next, cancel, err := d.connection.Subscribe("")
+		if err != nil {
+			events = nil
+			continue
+		}
+		events = next
+		d.setCancel(cancel)
+	}
+}
+
+// maintain queues the due retries and deletes old delivery attempts until
+// the dispatcher stops
+func (d *WebhookDispatcher) maintain() {
+	defer d.wg.Done()
+
+	poll := time.NewTicker(webhookPollInterval)
+	defer poll.Stop()
+	prune := time.NewTicker(webhookPruneInterval)
+	defer prune.Stop()
+
+	d.prune()
+	for {
+		select {
+		case <-poll.C:
+			d.retry()
+		case <-prune.C:
+			d.prune()
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// retry queues the due retries whose webhook still exists
+func (d *WebhookDispatcher) retry() {
+	retries, err := d.connection.GetDueWebhookRetries(float64(time.Now().Unix()))
+	if err != nil {
+		return
+	}
+
+	for _, retry := range retries {
+		if response, err := d.connection.DeleteWebhookRetry(retry.ID); err != nil || response.Deleted == 0 {
+			continue
+		}
+
+		webhook, err := d.connection.GetWebhook(retry.User, martini.Params{"webhook": retry.Webhook})
+		if err != nil || webhook == nil {
+			continue
+		}
+
+		d.enqueue(&webhookJob{webhook: *webhook, delivery: retry.Delivery, event: retry.Event, payload: []byte(retry.Payload), attempt: retry.Attempt})
+	}
+}
+
+func (d *WebhookDispatcher) prune() {
+	_, err := d.connection.PruneWebhookClaims(float64(time.Now().Add(-webhookClaimRetention).Unix()))
+
+	if d.retention > 0 && err == nil {
+		before := time.Now().Add(-d.retention)
+		_, err = d.connection.PruneWebhookDeliveries(float64(before.Unix()))
+	}
+	d.connection.metrics.JobRun("webhook_prune", err)
+}
+
+// webhookClaimID identifies the delivery of an event to a webhook the same
+// way in every instance receiving the event from the changefeed
+func webhookClaimID(webhookID string, event BookmarkEvent) string {
+	key := webhookID + "|" + event.Type + "|" + event.ID
+	if event.Bookmark != nil {
+		key += fmt.Sprintf("|%d|%v", event.Bookmark.Version, event.Bookmark.Updated)
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// dispatch queues a delivery for every webhook matching the event, once it
+// claimed it
+func (d *WebhookDispatcher) dispatch(event BookmarkEvent) {
+	webhooks, err := d.connection.GetWebhooks(event.User)
+	if err != nil {
+		return
+	}
+
+	for _, webhook := range webhooks {
+		if !webhook.Matches(event) {
+			continue
+		}
+
+		claim := &WebhookClaim{ID: webhookClaimID(webhook.ID, event), Webhook: webhook.ID, Created: float64(time.Now().Unix())}
+		if response, err := d.connection.ClaimWebhookDelivery(claim); err != nil || response.Inserted == 0 {
+			continue
+		}
+
+		delivery := claim.ID[:32]
+		payload, _ := json.Marshal(WebhookPayload{
+			Delivery: delivery,
+			Event:    event.Type,
+			Created:  time.Now().Unix(),
+			Bookmark: event.Bookmark,
+		})
+
+		d.enqueue(&webhookJob{webhook: webhook, delivery: delivery, event: event.Type, payload: payload, attempt: 1})
+	}
+}
+
+func (d *WebhookDispatcher) enqueue(job *webhookJob) {
+	select {
+	case d.jobs <- job:
+	case <-d.stop:
+	}
+}
+
+func (d *WebhookDispatcher) work() {
+	defer d.wg.Done()
+
+	for {
+		select {
+		case job := <-d.jobs:
+			d.deliver(job)
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// deliver posts the payload once, records the attempt and schedules a
+// retry if it failed
+func (d *WebhookDispatcher) deliver(job *webhookJob) {
+	record := &WebhookDelivery{
+		Webhook:  job.webhook.ID,
+		User:     job.webhook.User,
+		Delivery: job.delivery,
+		Event:    job.event,
+		Attempt:  job.attempt,
+		Created:  float64(time.Now().Unix()),
+	}
+
+	start := time.Now()
+	statusCode, err := d.post(job)
+	record.Duration = int64(time.Since(start) / time.Millisecond)
+	record.StatusCode = statusCode
+
+	if err != nil {
+		record.Error = webhookError(err)
+	} else if statusCode < 200 || statusCode > 299 {
+		record.Error = fmt.Sprintf("unexpected status %d", statusCode)
+	} else {
+		record.Success = true
+	}
+
+	d.connection.NewWebhookDelivery(record)
+
+	if record.Success {
+		d.connection.metrics.JobRun("webhook_delivery", nil)
+	} else {
+		d.connection.metrics.JobRun("webhook_delivery", errors.New(record.Error))
+	}
+
+	if record.Success || job.attempt >= webhookMaxAttempts {
+		if !record.Success {
+			d.connection.logger.Warn("webhook delivery abandoned", "webhook", job.webhook.ID, "delivery", job.delivery, "attempts", job.attempt, "err", record.Error)
+		}
+		return
+	}
+
+	delay := webhookBaseDelay * time.Duration(1<<uint(job.attempt-1))
+	d.schedule(job, job.attempt+1, time.Now().Add(delay))
+}
+
+// schedule stores a delivery as a retry making the given attempt once due
+func (d *WebhookDispatcher) schedule(job *webhookJob, attempt int, due time.Time) {
+	d.connection.NewWebhookRetry(&WebhookRetry{
+		Webhook:  job.webhook.ID,
+		User:     job.webhook.User,
+		Delivery: job.delivery,
+		Event:    job.event,
+		Payload:  string(job.payload),
+		Attempt:  attempt,
+		Due:      float64(due.Unix()),
+	})
+}
+
+// webhookError describes why a delivery failed for its record, shown to the
+// user, without the URL, addresses or other details of the error
+func webhookError(err error) string {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) && urlErr.Timeout() {
+		return "timed out"
+	}
+
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	switch {
+	case errors.Is(err, ErrWebhookDestination):
+		return "destination is a private address"
+	case errors.As(err, &dnsErr):
+		return "could not resolve the host"
+	case errors.As(err, &opErr):
+		return "could not connect"
+	}
+
+	return "request failed"
+}
+
+func (d *WebhookDispatcher) post(job *webhookJob) (int, error) {
+	req, err := http.NewRequest("POST", job.webhook.URL, bytes.NewReader(job.payload))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Magnet-Webhook")
+	req.Header.Set("X-Magnet-Event", job.event)
+	req.Header.Set("X-Magnet-Delivery", job.delivery)
+	req.Header.Set("X-Magnet-Signature", SignWebhookPayload(job.webhook.Secret, job.payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	return resp.StatusCode, nil
+}
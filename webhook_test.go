@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebhookValidateRejectsPrivateURLs(t *testing.T) {
+	tests := []struct {
+		url   string
+		valid bool
+	}{
+		{"https://hooks.example.com/magnet", true},
+		{"http://93.184.216.34/magnet", true},
+		{"ftp://hooks.example.com/magnet", false},
+		{"file:///etc/passwd", false},
+		{"http://localhost:8080/", false},
+		{"http://api.localhost/", false},
+		{"http://127.0.0.1/", false},
+		{"http://10.1.2.3/", false},
+		{"http://169.254.169.254/latest/meta-data", false},
+		{"http://[::1]/", false},
+		{"http://[::ffff:192.168.1.1]/", false},
+		{"http://0.0.0.0/", false},
+	}
+
+	for _, test := range tests {
+		webhook := &Webhook{URL: test.url, Events: []string{EventCreated}}
+		if _, invalid := webhook.Validate(false)["url"]; invalid == test.valid {
+			t.Errorf("%s: valid %v, want %v", test.url, !invalid, test.valid)
+		}
+	}
+
+	webhook := &Webhook{URL: "http://127.0.0.1/", Events: []string{EventCreated}}
+	if fields := webhook.Validate(true); len(fields) > 0 {
+		t.Errorf("private URL refused when allowed: %v", fields)
+	}
+}
+
+func TestWebhookDeliveryRefusesPrivateAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(204)
+	}))
+	defer server.Close()
+
+	job := &webhookJob{webhook: Webhook{URL: server.URL + "/hook?key=secret"}, event: EventCreated, payload: []byte("{}")}
+
+	_, err := NewWebhookDispatcher(nil, 1, 0, false).post(job)
+	if err == nil {
+		t.Fatal("delivered to a loopback address")
+	}
+	if message := webhookError(err); message != "destination is a private address" || strings.Contains(message, "secret") {
+		t.Errorf("error %q", message)
+	}
+
+	if status, err := NewWebhookDispatcher(nil, 1, 0, true).post(job); err != nil || status != 204 {
+		t.Errorf("allowed delivery: %d, %v", status, err)
+	}
+}
+
+func TestWebhookClaimIDIsStable(t *testing.T) {
+	event := BookmarkEvent{Type: EventUpdated, ID: "b1", Bookmark: &Bookmark{ID: "b1", Version: 3, Updated: 1500000000.25}}
+
+	if webhookClaimID("w1", event) != webhookClaimID("w1", event) {
+		t.Error("claim id differs for the same event")
+	}
+
+	next := event
+	next.Bookmark = &Bookmark{ID: "b1", Version: 4, Updated: 1500000001}
+	if webhookClaimID("w1", event) == webhookClaimID("w1", next) || webhookClaimID("w1", event) == webhookClaimID("w2", event) {
+		t.Error("claim id shared by different deliveries")
+	}
+}